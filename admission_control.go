@@ -0,0 +1,195 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// available implementations of AdmissionController, selectable by the admission flag
+const (
+	AdmissionManagementAPI = "management_api"
+	AdmissionAMQP          = "amqp"
+	AdmissionInFlight      = "in_flight"
+)
+
+// errNoConsumers is returned if the broker is reachable but no worker is consuming the queue
+var errNoConsumers = errors.New("no workers are connected to the queue")
+
+// AdmissionState is a snapshot of the load, taken by an AdmissionController
+type AdmissionState struct {
+	NumMessages  uint `json:"messages"`
+	NumConsumers uint `json:"consumers"`
+	// Capacity is the number of requests which may be in flight at the same time
+	Capacity uint `json:"capacity"`
+	// MemUsed and MemLimit of the broker, MemLimit is 0 if the controller can't determine them
+	MemUsed  uint64 `json:"mem_used"`
+	MemLimit uint64 `json:"mem_limit"`
+}
+
+// AdmissionController is polled by the resource manager to decide if new requests can be accepted. Close
+// releases the connection to the broker, it is called when the controller is replaced or the daemon stops
+type AdmissionController interface {
+	Poll() (AdmissionState, error)
+	Close() error
+}
+
+// NewAdmissionController returns the implementation selected by rabbitConfig.Admission
+func NewAdmissionController(rabbitConfig *RabbitConfig) (AdmissionController, error) {
+	switch rabbitConfig.Admission {
+	case AdmissionManagementAPI, "":
+		var urlQueues []string
+		for _, queueName := range rabbitConfig.Scheduling.queueNames(rabbitConfig.APIQueueName) {
+			urlQueues = append(urlQueues, rabbitConfig.AmqpAPIURI+rabbitConfig.APIPathQueue+queueName)
+		}
+		return &managementAPIAdmission{
+			urlQueues: urlQueues,
+			urlStat:   rabbitConfig.AmqpAPIURI + rabbitConfig.APIPathStats,
+			factor:    rabbitConfig.FactorForMessageAccept,
+		}, nil
+	case AdmissionAMQP:
+		return &amqpAdmission{
+			amqpURI:    rabbitConfig.AmqpURI,
+			queueNames: rabbitConfig.Scheduling.queueNames(rabbitConfig.RoutingKey),
+			factor:     rabbitConfig.FactorForMessageAccept,
+		}, nil
+	case AdmissionInFlight:
+		if rabbitConfig.MaxInFlight == 0 {
+			return nil, fmt.Errorf("admission %q requires max_in_flight to be set", AdmissionInFlight)
+		}
+		return &inFlightAdmission{maxInFlight: rabbitConfig.MaxInFlight}, nil
+	}
+	return nil, fmt.Errorf("unknown admission controller %q, use one of %s, %s, %s",
+		rabbitConfig.Admission, AdmissionManagementAPI, AdmissionAMQP, AdmissionInFlight)
+}
+
+// managementAPIAdmission reads queue and memory stats from the RabbitMQ management plugin
+type managementAPIAdmission struct {
+	urlQueues []string
+	urlStat   string
+	factor    uint
+}
+
+func (a *managementAPIAdmission) Poll() (AdmissionState, error) {
+	var queues []OcrQueueManager
+	for _, urlQueue := range a.urlQueues {
+		jsonQueueStat, err := url2bytes(urlQueue)
+		if err != nil {
+			return AdmissionState{}, fmt.Errorf("can't get queue stats: %v", err)
+		}
+		queueManager := OcrQueueManager{}
+		if err = json.Unmarshal(jsonQueueStat, &queueManager); err != nil {
+			return AdmissionState{}, fmt.Errorf("error unmarshalling queue stats %q: %v", string(jsonQueueStat), err)
+		}
+		queues = append(queues, queueManager)
+	}
+	jsonResStat, err := url2bytes(a.urlStat)
+	if err != nil {
+		return AdmissionState{}, fmt.Errorf("can't get node stats: %v", err)
+	}
+	var nodes []ocrResManager
+	if err = json.Unmarshal(jsonResStat, &nodes); err != nil {
+		return AdmissionState{}, fmt.Errorf("error unmarshalling node stats %q: %v", string(jsonResStat), err)
+	}
+
+	state := admissionStateOfQueues(queues, a.factor)
+	for k := range nodes {
+		state.MemUsed += nodes[k].MemUsed
+		state.MemLimit += nodes[k].MemLimit
+	}
+	if state.NumConsumers == 0 {
+		return state, errNoConsumers
+	}
+	return state, nil
+}
+
+func (*managementAPIAdmission) Close() error {
+	return nil
+}
+
+// admissionStateOfQueues sums up the messages of all queues. Every worker consumes all queues,
+// so the queue with the fewest consumers determines the number of workers
+func admissionStateOfQueues(queues []OcrQueueManager, factor uint) AdmissionState {
+	state := AdmissionState{}
+	for i, queue := range queues {
+		state.NumMessages += queue.NumMessages
+		if i == 0 || queue.NumConsumers < state.NumConsumers {
+			state.NumConsumers = queue.NumConsumers
+		}
+	}
+	state.Capacity = state.NumConsumers * factor
+	return state
+}
+
+// amqpAdmission uses a passive queue declare, which works on every broker without the management plugin
+type amqpAdmission struct {
+	amqpURI    string
+	queueNames []string
+	factor     uint
+	conn       *amqp.Connection
+}
+
+func (a *amqpAdmission) Poll() (AdmissionState, error) {
+	if a.conn == nil || a.conn.IsClosed() {
+		conn, err := amqp.Dial(a.amqpURI)
+		if err != nil {
+			return AdmissionState{}, fmt.Errorf("message broker is not reachable: %v", err)
+		}
+		a.conn = conn
+	}
+	// a failed passive declare closes the channel, so use a new one for every poll
+	channel, err := a.conn.Channel()
+	if err != nil {
+		return AdmissionState{}, err
+	}
+	defer channel.Close()
+
+	var queues []OcrQueueManager
+	for _, queueName := range a.queueNames {
+		queue, err := channel.QueueDeclarePassive(
+			queueName, // name of the queue
+			true,      // durable
+			false,     // delete when unused
+			false,     // exclusive
+			false,     // noWait
+			nil,       // arguments
+		)
+		if err != nil {
+			return AdmissionState{}, fmt.Errorf("can't inspect queue %s: %v", queueName, err)
+		}
+		queues = append(queues, OcrQueueManager{NumMessages: uint(queue.Messages), NumConsumers: uint(queue.Consumers)})
+	}
+
+	state := admissionStateOfQueues(queues, a.factor)
+	if state.NumConsumers == 0 {
+		return state, errNoConsumers
+	}
+	return state, nil
+}
+
+func (a *amqpAdmission) Close() error {
+	if a.conn == nil || a.conn.IsClosed() {
+		return nil
+	}
+	err := a.conn.Close()
+	a.conn = nil
+	return err
+}
+
+// inFlightAdmission only looks at the requests of this http daemon and never contacts the broker
+type inFlightAdmission struct {
+	maxInFlight uint
+}
+
+func (a *inFlightAdmission) Poll() (AdmissionState, error) {
+	return AdmissionState{
+		NumMessages: getQueueLen(),
+		Capacity:    a.maxInFlight,
+	}, nil
+}
+
+func (*inFlightAdmission) Close() error {
+	return nil
+}
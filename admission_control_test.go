@@ -0,0 +1,114 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestNewAdmissionController(t *testing.T) {
+	rabbitConfig := DefaultTestConfig()
+
+	controller, err := NewAdmissionController(&rabbitConfig)
+	assert.True(t, err == nil)
+	_, ok := controller.(*managementAPIAdmission)
+	assert.True(t, ok)
+
+	rabbitConfig.Admission = AdmissionAMQP
+	controller, err = NewAdmissionController(&rabbitConfig)
+	assert.True(t, err == nil)
+	_, ok = controller.(*amqpAdmission)
+	assert.True(t, ok)
+	// the connection is opened by the first poll, a controller which was never polled has nothing to close
+	assert.True(t, controller.Close() == nil)
+
+	rabbitConfig.Admission = AdmissionInFlight
+	_, err = NewAdmissionController(&rabbitConfig)
+	assert.True(t, err != nil)
+
+	rabbitConfig.MaxInFlight = 10
+	controller, err = NewAdmissionController(&rabbitConfig)
+	assert.True(t, err == nil)
+	state, err := controller.Poll()
+	assert.True(t, err == nil)
+	assert.Equals(t, state.Capacity, uint(10))
+
+	rabbitConfig.Admission = "unknown"
+	_, err = NewAdmissionController(&rabbitConfig)
+	assert.True(t, err != nil)
+}
+
+func TestCheckForAcceptRequestInFlight(t *testing.T) {
+	controller := &inFlightAdmission{maxInFlight: 1}
+	assert.True(t, CheckForAcceptRequest(controller))
+	assert.False(t, TechnicalErrorResManager)
+
+	controller.maxInFlight = 0
+	assert.False(t, CheckForAcceptRequest(controller))
+}
+
+func TestClientTracker(t *testing.T) {
+	tracker := &clientTracker{inFlight: make(map[string]uint), owners: make(map[string]string)}
+	assert.True(t, tracker.acquire("10.0.0.1", "req1", 2))
+	assert.True(t, tracker.acquire("10.0.0.1", "req2", 2))
+	assert.False(t, tracker.acquire("10.0.0.1", "req3", 2))
+	assert.True(t, tracker.acquire("10.0.0.2", "req4", 2))
+
+	tracker.release("req1")
+	tracker.release("req1")
+	assert.Equals(t, tracker.count("10.0.0.1"), uint(1))
+	assert.True(t, tracker.acquire("10.0.0.1", "req3", 2))
+}
+
+func TestClientTrackerDuplicateAcquire(t *testing.T) {
+	tracker := &clientTracker{inFlight: make(map[string]uint), owners: make(map[string]string)}
+	// a retry with the same id keeps its slot instead of taking another one
+	assert.True(t, tracker.acquire("10.0.0.1", "req1", 2))
+	assert.True(t, tracker.acquire("10.0.0.1", "req1", 2))
+	assert.Equals(t, tracker.count("10.0.0.1"), uint(1))
+	// the slot of another client is not taken over
+	assert.False(t, tracker.acquire("10.0.0.2", "req1", 2))
+	assert.True(t, tracker.acquireAll("10.0.0.1", []string{"req1", "req2", "req2"}, 2))
+	assert.Equals(t, tracker.count("10.0.0.1"), uint(2))
+	assert.False(t, tracker.acquireAll("10.0.0.2", []string{"req2", "req3"}, 2))
+	assert.Equals(t, tracker.count("10.0.0.2"), uint(0))
+
+	tracker.release("req1")
+	tracker.release("req2")
+	assert.Equals(t, tracker.count("10.0.0.1"), uint(0))
+}
+
+func TestThroughputMeter(t *testing.T) {
+	meter := &throughputMeter{}
+	assert.Equals(t, meter.secondsFor(10), resManagerInterval)
+
+	now := time.Now()
+	meter.tick(now)
+	for i := 0; i < 10; i++ {
+		meter.markCompleted()
+	}
+	meter.tick(now.Add(time.Second))
+	// 30% of a sample of 10 requests per second
+	assert.Equals(t, meter.secondsFor(3), uint(1))
+	assert.Equals(t, meter.secondsFor(30), uint(10))
+}
+
+func TestWriteAdmissionError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeAdmissionError(recorder, "req1", RejectShuttingDown, "10.0.0.1")
+	assert.Equals(t, recorder.Code, 503)
+	assert.Equals(t, recorder.Header().Get("Retry-After"), "60")
+
+	body := admissionError{}
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &body) == nil)
+	assert.Equals(t, body.Reason, RejectShuttingDown)
+	assert.Equals(t, body.ID, "req1")
+
+	recorder = httptest.NewRecorder()
+	writeAdmissionError(recorder, "req2", RejectClientShareExceeded, "10.0.0.1")
+	assert.Equals(t, recorder.Code, 429)
+	assert.True(t, recorder.Header().Get("Retry-After") != "")
+}
@@ -0,0 +1,303 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// machine-readable reasons for rejecting a request, returned in the body of 503 and 429 responses
+const (
+	RejectBrokerUnreachable   = "broker_unreachable"
+	RejectNoWorkers           = "no_workers"
+	RejectQueueFull           = "queue_full"
+	RejectMemoryPressure      = "memory_pressure"
+	RejectShuttingDown        = "shutting_down"
+	RejectClientShareExceeded = "client_share_exceeded"
+)
+
+const (
+	// resManagerInterval is the time in seconds between two polls of the admission controller
+	resManagerInterval uint = 5
+	// maxRetryAfter caps the estimated Retry-After value in seconds
+	maxRetryAfter uint = 300
+	// shutdownRetryAfter is sent while the http daemon is going down, a restarted instance should be up by then
+	shutdownRetryAfter uint = 60
+	// throughputAlpha is the weight of the latest sample in the moving average of the throughput
+	throughputAlpha = 0.3
+)
+
+// admissionError is the json body of a rejected request and of all errors of the versioned api. Code and
+// Reason are the same, ID is the job and RequestID the http request
+type admissionError struct {
+	Status     string `json:"status"`
+	Code       string `json:"code"`
+	Reason     string `json:"reason"`
+	Message    string `json:"message"`
+	ID         string `json:"id"`
+	RequestID  string `json:"request_id,omitempty"`
+	RetryAfter uint   `json:"retry_after,omitempty"`
+}
+
+var rejectMessages = map[string]string{
+	RejectBrokerUnreachable:   "message broker is not reachable",
+	RejectNoWorkers:           "no workers are connected",
+	RejectQueueFull:           "no resources available to process the request",
+	RejectMemoryPressure:      "message broker is running out of memory",
+	RejectShuttingDown:        "service is going down",
+	RejectClientShareExceeded: "too many requests in flight for this client",
+}
+
+// rejectReason returns why a new request can't be accepted or an empty string if it can
+func rejectReason(serviceCanAccept, appStop bool) string {
+	if appStop {
+		return RejectShuttingDown
+	}
+	if !serviceCanAccept {
+		admissionStateMu.RLock()
+		defer admissionStateMu.RUnlock()
+		if admissionReason != "" {
+			return admissionReason
+		}
+		return RejectQueueFull
+	}
+	// the admission controller is polled only every few seconds, so check our own queue as well
+	if !schedulerByWorkerNumber() {
+		return RejectQueueFull
+	}
+	return ""
+}
+
+// retryAfter estimates in seconds when a request rejected for reason may succeed
+func retryAfter(reason, clientID string) uint {
+	var seconds uint
+	switch reason {
+	case RejectShuttingDown:
+		return shutdownRetryAfter
+	case RejectQueueFull:
+		queued := queuedRequests()
+		admissionStateMu.RLock()
+		capacity := admissionState.Capacity
+		admissionStateMu.RUnlock()
+		var backlog uint = 1
+		if queued >= capacity {
+			backlog = queued - capacity + 1
+		}
+		seconds = throughput.secondsFor(backlog)
+	case RejectClientShareExceeded:
+		seconds = throughput.secondsFor(clientShares.count(clientID))
+	default:
+		// state will be known after the next poll
+		seconds = resManagerInterval
+	}
+	if seconds < 1 {
+		seconds = 1
+	}
+	if seconds > maxRetryAfter {
+		seconds = maxRetryAfter
+	}
+	return seconds
+}
+
+// writeAdmissionError rejects the request with 429 if the client exceeded its share, otherwise with 503
+func writeAdmissionError(w http.ResponseWriter, requestID, reason, clientID string) {
+	httpStatus := http.StatusServiceUnavailable
+	if reason == RejectClientShareExceeded {
+		httpStatus = http.StatusTooManyRequests
+	}
+	seconds := retryAfter(reason, clientID)
+	log.Warn().Str("component", "OCR_HTTP").Str("RequestID", requestID).
+		Str("reason", reason).Str("ClientID", clientID).Uint("retry_after", seconds).
+		Msg("conditions for accepting new requests are not met")
+	writeRejection(w, httpStatus, requestID, reason, rejectMessages[reason]+". RequestID "+requestID, seconds)
+}
+
+// writeRejection writes the json body of a rejected request, a Retry-After header is only sent if retryAfter > 0
+func writeRejection(w http.ResponseWriter, httpStatus int, requestID, reason, message string, retryAfter uint) {
+	body := admissionError{
+		Status:     "error",
+		Code:       reason,
+		Reason:     reason,
+		Message:    message,
+		ID:         requestID,
+		RequestID:  w.Header().Get(RequestIDHeader),
+		RetryAfter: retryAfter,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatUint(uint64(retryAfter), 10))
+	}
+	w.WriteHeader(httpStatus)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Str("component", "OCR_HTTP").Str("RequestID", requestID).
+			Msg("http write() failed")
+	}
+}
+
+// throughputMeter keeps a moving average of finished requests per second
+type throughputMeter struct {
+	completed uint64
+	mu        sync.Mutex
+	last      time.Time
+	lastCount uint64
+	rate      float64
+}
+
+var throughput = &throughputMeter{}
+
+// markCompleted is called for every request a worker has answered
+func (m *throughputMeter) markCompleted() {
+	atomic.AddUint64(&m.completed, 1)
+}
+
+// tick takes a sample, it is called by the resource manager on every poll
+func (m *throughputMeter) tick(now time.Time) {
+	completed := atomic.LoadUint64(&m.completed)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.last.IsZero() {
+		if elapsed := now.Sub(m.last).Seconds(); elapsed > 0 {
+			sample := float64(completed-m.lastCount) / elapsed
+			m.rate = throughputAlpha*sample + (1-throughputAlpha)*m.rate
+		}
+	}
+	m.last = now
+	m.lastCount = completed
+}
+
+// secondsFor estimates how long it takes to finish n requests. Without any observed throughput
+// the next poll of the admission controller is the best guess
+func (m *throughputMeter) secondsFor(n uint) uint {
+	m.mu.Lock()
+	rate := m.rate
+	m.mu.Unlock()
+	if rate <= 0 {
+		return resManagerInterval
+	}
+	return uint(math.Ceil(float64(n) / rate))
+}
+
+// clientTracker counts the requests in flight per client, so a single client can't take all capacity
+type clientTracker struct {
+	mu       sync.Mutex
+	inFlight map[string]uint
+	owners   map[string]string // RequestID -> client
+	// gauge is optional and reports inFlight labeled by client
+	gauge *prometheus.GaugeVec
+}
+
+var clientShares = &clientTracker{
+	inFlight: make(map[string]uint),
+	owners:   make(map[string]string),
+}
+
+// acquire registers requestID for client if the client has less than limit requests in flight. A requestID
+// which is registered already keeps its slot and isn't counted twice
+func (c *clientTracker) acquire(client, requestID string, limit uint) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if owner, ok := c.owners[requestID]; ok {
+		return owner == client
+	}
+	if c.inFlight[client] >= limit {
+		return false
+	}
+	c.inFlight[client]++
+	c.owners[requestID] = client
+	if c.gauge != nil {
+		c.gauge.WithLabelValues(tenantLabel(client)).Inc()
+	}
+	return true
+}
+
+// acquireAll registers all requestIDs for client if they fit into limit, otherwise none of them. Like acquire
+// it counts every requestID only once
+func (c *clientTracker) acquireAll(client string, requestIDs []string, limit uint) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	added := make(map[string]bool, len(requestIDs))
+	for _, requestID := range requestIDs {
+		if owner, ok := c.owners[requestID]; ok {
+			if owner != client {
+				return false
+			}
+			continue
+		}
+		added[requestID] = true
+	}
+	if c.inFlight[client]+uint(len(added)) > limit {
+		return false
+	}
+	c.inFlight[client] += uint(len(added))
+	for requestID := range added {
+		c.owners[requestID] = client
+	}
+	if c.gauge != nil {
+		c.gauge.WithLabelValues(tenantLabel(client)).Add(float64(len(added)))
+	}
+	return true
+}
+
+// release frees the slot of requestID, it is safe to call it more than once
+func (c *clientTracker) release(requestID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	client, ok := c.owners[requestID]
+	if !ok {
+		return
+	}
+	delete(c.owners, requestID)
+	if c.gauge != nil {
+		c.gauge.WithLabelValues(tenantLabel(client)).Dec()
+	}
+	if c.inFlight[client] <= 1 {
+		delete(c.inFlight, client)
+	} else {
+		c.inFlight[client]--
+	}
+}
+
+func (c *clientTracker) count(client string) uint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inFlight[client]
+}
+
+// active returns the number of clients with requests in flight
+func (c *clientTracker) active() uint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return uint(len(c.inFlight))
+}
+
+// clientShareLimit is the number of requests a single client may have in flight, share is in percent of the capacity
+func clientShareLimit(share uint) uint {
+	admissionStateMu.RLock()
+	capacity := admissionState.Capacity
+	admissionStateMu.RUnlock()
+	limit := capacity * share / 100
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
+
+// clientIDFromRequest identifies the authenticated client, or the remote address if authentication is disabled
+func clientIDFromRequest(req *http.Request) string {
+	if principal := principalFromContext(req.Context()); principal != nil {
+		return principal.ClientID
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
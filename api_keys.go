@@ -0,0 +1,334 @@
+package ocrworker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// APIKeyHeader is the header clients have to send their key in
+const APIKeyHeader = "X-API-Key"
+
+// reasons for rejecting a request of a client, in addition to the Reject* constants of the admission control
+const (
+	RejectUnauthorized     = "unauthorized"
+	RejectForbidden        = "forbidden"
+	RejectRateLimited      = "rate_limited"
+	RejectEngineNotAllowed = "engine_not_allowed"
+	RejectFileTooLarge     = "file_too_large"
+)
+
+// APIKey describes a client and its limits
+type APIKey struct {
+	// Key is the secret in plain text, alternatively KeySHA256 holds its hex encoded sha256 sum
+	Key       string `json:"key"`
+	KeySHA256 string `json:"key_sha256"`
+	// ClientID identifies the client in logs and on the job instead of the user agent
+	ClientID string `json:"client_id"`
+	// Tenant the client belongs to
+	Tenant string `json:"tenant"`
+	// Scopes granted to the client, empty grants submit and read-status
+	Scopes []string `json:"scopes"`
+	// RateLimit is the number of requests per second, Burst the number of requests which may exceed it at once.
+	// 0 disables the rate limit
+	RateLimit float64 `json:"rate_limit"`
+	Burst     uint    `json:"burst"`
+	// MaxConcurrent limits the number of requests in flight, 0 means no limit
+	MaxConcurrent uint `json:"max_concurrent"`
+	// MaxFileSize of the image in bytes, 0 means no limit
+	MaxFileSize int64 `json:"max_file_size"`
+	// AllowedEngines restricts the engines the client may use, empty allows all engines
+	AllowedEngines []OcrEngineType `json:"allowed_engines"`
+	// DocType is used for requests without doc_type
+	DocType string `json:"doc_type"`
+	// Priority of the requests of the client instead of the priority of their doc_type, 0 keeps the priority of the doc_type
+	Priority uint8 `json:"priority"`
+	// PostbackSecret signs the results posted to reply_to, empty uses the global postback_secret
+	PostbackSecret string `json:"postback_secret"`
+}
+
+// APIKeyStore looks up clients by their key or their ClientID. Implementations have to be safe for concurrent use
+type APIKeyStore interface {
+	Lookup(key string) (*APIKey, bool)
+	LookupClient(clientID string) (*APIKey, bool)
+}
+
+// hashAPIKey returns the hex encoded sha256 sum of key, stores don't need to keep keys in plain text
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// mapAPIKeyStore keeps the keys in memory, indexed by their sha256 sum and by their ClientID
+type mapAPIKeyStore struct {
+	keys    map[string]*APIKey
+	clients map[string]*APIKey
+}
+
+func (s *mapAPIKeyStore) Lookup(key string) (*APIKey, bool) {
+	apiKey, ok := s.keys[hashAPIKey(key)]
+	return apiKey, ok
+}
+
+// LookupClient returns the last key of clientID, a client may have several keys while they are rotated
+func (s *mapAPIKeyStore) LookupClient(clientID string) (*APIKey, bool) {
+	apiKey, ok := s.clients[clientID]
+	return apiKey, ok
+}
+
+// NewAPIKeyStore builds a store from the given keys
+func NewAPIKeyStore(keys []APIKey) (APIKeyStore, error) {
+	store := &mapAPIKeyStore{keys: make(map[string]*APIKey, len(keys)), clients: make(map[string]*APIKey, len(keys))}
+	for i := range keys {
+		apiKey := keys[i]
+		hash := apiKey.KeySHA256
+		if apiKey.Key != "" {
+			hash = hashAPIKey(apiKey.Key)
+		}
+		if hash == "" {
+			return nil, fmt.Errorf("api key #%d has neither key nor key_sha256", i)
+		}
+		if apiKey.ClientID == "" {
+			return nil, fmt.Errorf("api key #%d has no client_id", i)
+		}
+		// the plain key isn't needed anymore
+		apiKey.Key = ""
+		apiKey.KeySHA256 = ""
+		store.keys[hash] = &apiKey
+		store.clients[apiKey.ClientID] = &apiKey
+	}
+	return store, nil
+}
+
+// NewFileAPIKeyStore reads a json list of APIKey from fileName
+func NewFileAPIKeyStore(fileName string) (APIKeyStore, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err = json.Unmarshal(content, &keys); err != nil {
+		return nil, fmt.Errorf("can't parse api keys file %s: %v", fileName, err)
+	}
+	return NewAPIKeyStore(keys)
+}
+
+type (
+	apiKeyContextKey    struct{}
+	rateLimitContextKey struct{}
+)
+
+// apiKeyFromContext returns the client authenticated by APIKeyAuth, nil if it wasn't authenticated by an api key
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	apiKey, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return apiKey
+}
+
+// APIKeyAuth authenticates requests by the X-API-Key header and enforces the rate limit of the key
+type APIKeyAuth struct {
+	store    APIKeyStore
+	mu       sync.Mutex
+	limiters map[string]*tokenBucket
+}
+
+func NewAPIKeyAuth(store APIKeyStore) *APIKeyAuth {
+	return &APIKeyAuth{
+		store:    store,
+		limiters: make(map[string]*tokenBucket),
+	}
+}
+
+// Wrap returns a handler which only passes authenticated requests to next
+func (a *APIKeyAuth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		a.mu.Lock()
+		store := a.store
+		a.mu.Unlock()
+		apiKey, ok := store.Lookup(req.Header.Get(APIKeyHeader))
+		if !ok {
+			log.Warn().Str("component", "OCR_AUTH").Str("RemoteAddr", req.RemoteAddr).
+				Str("path", req.URL.Path).Msg("request without valid api key")
+			writeRejection(w, http.StatusUnauthorized, "", RejectUnauthorized, "missing or invalid "+APIKeyHeader+" header", 0)
+			return
+		}
+		limiter := a.limiter(apiKey)
+		if wait := limiter.take(time.Now()); wait > 0 {
+			seconds := uint(math.Ceil(wait.Seconds()))
+			log.Warn().Str("component", "OCR_AUTH").Str("ClientID", apiKey.ClientID).
+				Uint("retry_after", seconds).Msg("rate limit of client exceeded")
+			writeRejection(w, http.StatusTooManyRequests, "", RejectRateLimited, "rate limit exceeded", seconds)
+			return
+		}
+		principal := &Principal{ClientID: apiKey.ClientID, Tenant: apiKey.Tenant, Scopes: apiKey.Scopes}
+		if len(principal.Scopes) == 0 {
+			principal.Scopes = defaultScopes
+		}
+		ctx := context.WithValue(context.WithValue(req.Context(), apiKeyContextKey{}, apiKey), rateLimitContextKey{}, limiter)
+		ctx = withPrincipal(ctx, principal)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// SetStore replaces the keys, e.g. after the api keys file was changed. Clients keep their rate limiter
+// unless their limit was changed
+func (a *APIKeyAuth) SetStore(store APIKeyStore) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.store = store
+}
+
+// PostbackSecret returns the secret signing the postbacks of clientID, empty if the client has none
+func (a *APIKeyAuth) PostbackSecret(clientID string) string {
+	a.mu.Lock()
+	store := a.store
+	a.mu.Unlock()
+	if apiKey, ok := store.LookupClient(clientID); ok {
+		return apiKey.PostbackSecret
+	}
+	return ""
+}
+
+func (a *APIKeyAuth) limiter(apiKey *APIKey) *tokenBucket {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	bucket, ok := a.limiters[apiKey.ClientID]
+	if !ok || !bucket.hasLimit(apiKey.RateLimit, apiKey.Burst) {
+		bucket = newTokenBucket(apiKey.RateLimit, apiKey.Burst)
+		a.limiters[apiKey.ClientID] = bucket
+	}
+	return bucket
+}
+
+// tokenBucket is a rate limiter refilled with rate tokens per second up to burst tokens
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst uint) *tokenBucket {
+	if burst == 0 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// hasLimit reports if the bucket was created for rate and burst
+func (b *tokenBucket) hasLimit(rate float64, burst uint) bool {
+	if burst == 0 {
+		burst = 1
+	}
+	return b.rate == rate && b.burst == float64(burst)
+}
+
+// take consumes a token and returns 0, or returns how long to wait for the next token
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	return b.takeN(now, 1)
+}
+
+// takeN consumes n tokens at once and returns 0, or returns how long to wait until n tokens are available.
+// No token is consumed if there are less than n
+func (b *tokenBucket) takeN(now time.Time, n uint) time.Duration {
+	if b.rate <= 0 || n == 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		return 0
+	}
+	return time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+}
+
+// exceedsBurst reports if n tokens can never be taken at once
+func (b *tokenBucket) exceedsBurst(n uint) bool {
+	return b.rate > 0 && float64(n) > b.burst
+}
+
+// chargeRateLimit charges a batch of requests to the rate limit of the api key of req. APIKeyAuth has taken
+// one token for the http request already, the other requests take one token each. If the tokens are not
+// available, the rejection is written to w and false is returned
+func chargeRateLimit(w http.ResponseWriter, req *http.Request, id string, requests uint) bool {
+	limiter, _ := req.Context().Value(rateLimitContextKey{}).(*tokenBucket)
+	if limiter == nil || requests <= 1 {
+		return true
+	}
+	clientID := clientIDFromRequest(req)
+	if limiter.exceedsBurst(requests - 1) {
+		log.Warn().Str("component", "OCR_AUTH").Str("ClientID", clientID).Uint("requests", requests).
+			Msg("batch exceeds the burst of the rate limit of the client")
+		writeRejection(w, http.StatusTooManyRequests, id, RejectRateLimited,
+			fmt.Sprintf("%d requests exceed the burst of the rate limit", requests), 0)
+		return false
+	}
+	if wait := limiter.takeN(time.Now(), requests-1); wait > 0 {
+		seconds := uint(math.Ceil(wait.Seconds()))
+		log.Warn().Str("component", "OCR_AUTH").Str("ClientID", clientID).Uint("requests", requests).
+			Uint("retry_after", seconds).Msg("rate limit of client exceeded")
+		writeRejection(w, http.StatusTooManyRequests, id, RejectRateLimited, "rate limit exceeded", seconds)
+		return false
+	}
+	return true
+}
+
+// applyAPIKey checks the request against the limits of the client and fills in its defaults.
+// It returns the http status and the reject reason if the request is not allowed
+func (ocrRequest *OcrRequest) applyAPIKey(apiKey *APIKey) (int, string, error) {
+	if apiKey == nil {
+		return http.StatusOK, "", nil
+	}
+	ocrRequest.ClientID = apiKey.ClientID
+	if len(apiKey.AllowedEngines) > 0 {
+		allowed := false
+		for _, engine := range apiKey.AllowedEngines {
+			allowed = allowed || engine == ocrRequest.EngineType
+		}
+		if !allowed {
+			return http.StatusForbidden, RejectEngineNotAllowed,
+				fmt.Errorf("engine %s is not allowed for this client", ocrRequest.EngineType)
+		}
+	}
+	if apiKey.MaxFileSize > 0 {
+		size := int64(len(ocrRequest.ImgBytes))
+		if ocrRequest.hasBase64() {
+			size = int64(base64.StdEncoding.DecodedLen(len(ocrRequest.ImgBase64)) - strings.Count(ocrRequest.ImgBase64, "="))
+		}
+		if ocrRequest.imgFile != "" {
+			size = ocrRequest.imgFileSize
+		}
+		if size > apiKey.MaxFileSize {
+			return http.StatusRequestEntityTooLarge, RejectFileTooLarge,
+				fmt.Errorf("image exceeds the limit of %d bytes", apiKey.MaxFileSize)
+		}
+		// the limit for img_url is enforced by whoever downloads the image
+		if ocrRequest.MaxFileSize == 0 || apiKey.MaxFileSize < ocrRequest.MaxFileSize {
+			ocrRequest.MaxFileSize = apiKey.MaxFileSize
+		}
+	}
+	if ocrRequest.DocType == "" {
+		ocrRequest.DocType = apiKey.DocType
+	}
+	ocrRequest.Priority = apiKey.Priority
+	if apiKey.PostbackSecret != "" {
+		ocrRequest.postbackClientID = apiKey.ClientID
+	}
+	return http.StatusOK, "", nil
+}
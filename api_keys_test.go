@@ -0,0 +1,118 @@
+package ocrworker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestFileAPIKeyStore(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "keys.json")
+	content := `[
+		{"key": "secret1", "client_id": "client1", "allowed_engines": ["tesseract"], "max_file_size": 4},
+		{"key_sha256": "` + hashAPIKey("secret2") + `", "client_id": "client2", "doc_type": "egvp"}
+	]`
+	assert.True(t, os.WriteFile(fileName, []byte(content), 0o600) == nil)
+
+	store, err := NewFileAPIKeyStore(fileName)
+	assert.True(t, err == nil)
+
+	apiKey, ok := store.Lookup("secret1")
+	assert.True(t, ok)
+	assert.Equals(t, apiKey.ClientID, "client1")
+	assert.Equals(t, apiKey.Key, "")
+	apiKey, ok = store.Lookup("secret2")
+	assert.True(t, ok)
+	assert.Equals(t, apiKey.ClientID, "client2")
+	_, ok = store.Lookup("secret3")
+	assert.False(t, ok)
+	apiKey, ok = store.LookupClient("client2")
+	assert.True(t, ok)
+	assert.Equals(t, apiKey.DocType, "egvp")
+
+	_, err = NewAPIKeyStore([]APIKey{{Key: "secret"}})
+	assert.True(t, err != nil)
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	store, err := NewAPIKeyStore([]APIKey{{Key: "secret", ClientID: "client", RateLimit: 0.001, Burst: 1}})
+	assert.True(t, err == nil)
+	var clientID string
+	handler := NewAPIKeyAuth(store).Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clientID = clientIDFromRequest(req)
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/ocr", nil))
+	assert.Equals(t, recorder.Code, http.StatusUnauthorized)
+
+	req := httptest.NewRequest("POST", "/ocr", nil)
+	req.Header.Set(APIKeyHeader, "secret")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equals(t, recorder.Code, http.StatusOK)
+	assert.Equals(t, clientID, "client")
+
+	// burst is used up
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equals(t, recorder.Code, http.StatusTooManyRequests)
+	assert.True(t, recorder.Header().Get("Retry-After") != "")
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(2, 2)
+	now := time.Now()
+	assert.Equals(t, bucket.take(now), time.Duration(0))
+	assert.Equals(t, bucket.take(now), time.Duration(0))
+	assert.Equals(t, bucket.take(now), 500*time.Millisecond)
+	assert.Equals(t, bucket.take(now.Add(500*time.Millisecond)), time.Duration(0))
+
+	// n tokens are taken at once or not at all
+	bucket = newTokenBucket(2, 3)
+	assert.Equals(t, bucket.takeN(now, 2), time.Duration(0))
+	assert.Equals(t, bucket.takeN(now, 2), 500*time.Millisecond)
+	assert.Equals(t, bucket.takeN(now, 1), time.Duration(0))
+	assert.True(t, bucket.exceedsBurst(4))
+	assert.False(t, bucket.exceedsBurst(3))
+
+	unlimited := newTokenBucket(0, 0)
+	assert.Equals(t, unlimited.take(now), time.Duration(0))
+}
+
+func TestApplyAPIKey(t *testing.T) {
+	apiKey := &APIKey{
+		ClientID:       "client",
+		AllowedEngines: []OcrEngineType{EngineTesseract},
+		MaxFileSize:    4,
+		DocType:        "egvp",
+		Priority:       5,
+	}
+
+	ocrRequest := OcrRequest{EngineType: EngineSandwichTesseract}
+	httpStatus, reason, err := ocrRequest.applyAPIKey(apiKey)
+	assert.True(t, err != nil)
+	assert.Equals(t, httpStatus, http.StatusForbidden)
+	assert.Equals(t, reason, RejectEngineNotAllowed)
+
+	// "hello" is 5 bytes
+	ocrRequest = OcrRequest{EngineType: EngineTesseract, ImgBase64: "aGVsbG8="}
+	httpStatus, _, err = ocrRequest.applyAPIKey(apiKey)
+	assert.True(t, err != nil)
+	assert.Equals(t, httpStatus, http.StatusRequestEntityTooLarge)
+
+	// "hell" is 4 bytes
+	ocrRequest = OcrRequest{EngineType: EngineTesseract, ImgBase64: "aGVsbA=="}
+	_, _, err = ocrRequest.applyAPIKey(apiKey)
+	assert.True(t, err == nil)
+	assert.Equals(t, ocrRequest.ClientID, "client")
+	assert.Equals(t, ocrRequest.DocType, "egvp")
+	assert.Equals(t, ocrRequest.Priority, uint8(5))
+	assert.Equals(t, ocrRequest.MaxFileSize, int64(4))
+	assert.Equals(t, ocrRequest.imgURLFetchConfig(&ImgURLFetchConfig{MaxSize: 100}).MaxSize, int64(4))
+}
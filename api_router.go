@@ -0,0 +1,155 @@
+package ocrworker
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	// APIPrefix is the path of the current version of the api
+	APIPrefix = "/v1"
+	// RequestIDHeader identifies an http request. It is taken from the request if the client or a proxy has set it
+	// and sent back in the response and in error bodies
+	RequestIDHeader    = "X-Request-ID"
+	maxRequestIDLength = 128
+)
+
+// errorCodes are the codes of the json error body for errors without a more specific reason
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_request",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusServiceUnavailable:    "service_unavailable",
+	http.StatusRequestEntityTooLarge: RejectRequestTooLarge,
+}
+
+type requestIDContextKey struct{}
+
+type apiErrorContextKey struct{}
+
+// WithRequestID passes the X-Request-ID header of a request on to the response, a request without a valid one
+// gets a new id
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = ksuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIDContextKey{}, requestID)))
+	})
+}
+
+// validRequestID accepts printable ascii without spaces, so the id can be logged and sent back as it is
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] <= ' ' || requestID[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFromContext returns the X-Request-ID of the http request, empty without WithRequestID
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// APIRouter serves the api under APIPrefix. Its routes are restricted to a method and all errors, including
+// unknown paths and methods, have a json body. The paths used before the api was versioned are kept as deprecated
+// aliases with their old error bodies
+type APIRouter struct {
+	mux      *http.ServeMux
+	versions *http.ServeMux
+}
+
+// NewAPIRouter creates the router and registers it for APIPrefix on mux, the aliases are added to mux as well
+func NewAPIRouter(mux *http.ServeMux) *APIRouter {
+	router := &APIRouter{mux: mux, versions: http.NewServeMux()}
+	mux.Handle(APIPrefix+"/", router)
+	return router
+}
+
+// Handle registers handler for pattern, e.g. "POST /ocr", below APIPrefix. aliases are the patterns the route had
+// before the api was versioned, they answer with a Deprecation header and a link to the versioned path. Routes
+// added since then have no aliases
+func (r *APIRouter) Handle(pattern string, handler http.Handler, aliases ...string) {
+	method, path, _ := strings.Cut(pattern, " ")
+	r.versions.Handle(method+" "+APIPrefix+path, handler)
+	for _, alias := range aliases {
+		r.mux.Handle(alias, deprecated(APIPrefix+path, handler))
+	}
+}
+
+func (r *APIRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req = req.WithContext(context.WithValue(req.Context(), apiErrorContextKey{}, true))
+	handler, pattern := r.versions.Handler(req)
+	if pattern == "" {
+		// the mux answers unknown paths and methods in plain text
+		recorder := &routeRecorder{header: make(http.Header)}
+		handler.ServeHTTP(recorder, req)
+		if recorder.status == http.StatusNotFound || recorder.status == http.StatusMethodNotAllowed {
+			if allow := recorder.header.Get("Allow"); allow != "" {
+				w.Header().Set("Allow", allow)
+			}
+			writeAPIError(w, req, recorder.status, "", http.StatusText(recorder.status)+": "+req.Method+" "+req.URL.Path)
+			return
+		}
+	} else {
+		setHTTPRoute(req.Context(), req.Method, pattern)
+	}
+	r.versions.ServeHTTP(w, req)
+}
+
+// deprecated marks the response of an alias, see RFC 9745
+func deprecated(successor string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// routeRecorder keeps the status and the headers the mux sets for a request it has no route for
+type routeRecorder struct {
+	header http.Header
+	status int
+}
+
+func (r *routeRecorder) Header() http.Header { return r.header }
+
+func (r *routeRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (r *routeRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// writeAPIError writes an error of a handler. Requests to the versioned api get the json error body of
+// writeRejection, requests to the deprecated paths the plain text they always got
+func writeAPIError(w http.ResponseWriter, req *http.Request, httpStatus int, id, message string) {
+	if envelope, _ := req.Context().Value(apiErrorContextKey{}).(bool); !envelope {
+		http.Error(w, message, httpStatus)
+		return
+	}
+	code, ok := errorCodes[httpStatus]
+	if !ok {
+		code = errorCodes[http.StatusInternalServerError]
+	}
+	writeRejection(w, httpStatus, id, code, message, 0)
+}
@@ -0,0 +1,91 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func newTestAPI() http.Handler {
+	config := DefaultTestConfig()
+	batchHandler := NewOcrHttpBatchHandler(&config)
+	mux := http.NewServeMux()
+	api := NewAPIRouter(mux)
+	api.Handle("GET /batches/{id}/results", http.HandlerFunc(batchHandler.Results))
+	api.Handle("POST /batches", http.HandlerFunc(batchHandler.Submit))
+	api.Handle("POST /ocr", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeAPIError(w, req, http.StatusBadRequest, "", "invalid request")
+	}), "/ocr")
+	return WithRequestID(mux)
+}
+
+func decodeAPIError(t *testing.T, recorder *httptest.ResponseRecorder) admissionError {
+	var body admissionError
+	assert.Equals(t, recorder.Header().Get("Content-Type"), "application/json")
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &body) == nil)
+	return body
+}
+
+func TestRequestID(t *testing.T) {
+	api := newTestAPI()
+	request := httptest.NewRequest(http.MethodGet, "/v1/unknown", nil)
+	request.Header.Set(RequestIDHeader, "trace-4711")
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	assert.Equals(t, recorder.Header().Get(RequestIDHeader), "trace-4711")
+	assert.Equals(t, decodeAPIError(t, recorder).RequestID, "trace-4711")
+
+	// ids which can't be logged or sent back as they are get replaced
+	for _, requestID := range []string{"", "with space", "new\nline", strings.Repeat("x", maxRequestIDLength+1)} {
+		request = httptest.NewRequest(http.MethodGet, "/v1/unknown", nil)
+		request.Header.Set(RequestIDHeader, requestID)
+		recorder = httptest.NewRecorder()
+		api.ServeHTTP(recorder, request)
+		generated := recorder.Header().Get(RequestIDHeader)
+		assert.True(t, generated != "" && generated != requestID)
+	}
+}
+
+func TestAPIRouterErrors(t *testing.T) {
+	api := newTestAPI()
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/unknown", nil))
+	assert.Equals(t, recorder.Code, http.StatusNotFound)
+	assert.Equals(t, decodeAPIError(t, recorder).Code, "not_found")
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/batches", nil))
+	assert.Equals(t, recorder.Code, http.StatusMethodNotAllowed)
+	assert.Equals(t, recorder.Header().Get("Allow"), "POST")
+	assert.Equals(t, decodeAPIError(t, recorder).Code, "method_not_allowed")
+
+	// errors of the handlers have the same body
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/batches/a/results?format=pdf", nil))
+	assert.Equals(t, recorder.Code, http.StatusBadRequest)
+	body := decodeAPIError(t, recorder)
+	assert.Equals(t, body.Code, "invalid_request")
+	assert.Equals(t, body.Message, "format has to be jsonl or zip")
+	assert.True(t, body.RequestID != "")
+	assert.Equals(t, recorder.Header().Get("Deprecation"), "")
+}
+
+func TestAPIRouterAlias(t *testing.T) {
+	api := newTestAPI()
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/ocr", nil))
+	assert.Equals(t, recorder.Code, http.StatusBadRequest)
+	assert.Equals(t, recorder.Header().Get("Deprecation"), "true")
+	assert.Equals(t, recorder.Header().Get("Link"), `</v1/ocr>; rel="successor-version"`)
+	// the deprecated paths keep their plain text errors
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain"))
+
+	// routes added after the api was versioned have no alias
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/batches/a/results?format=jsonl", nil))
+	assert.Equals(t, recorder.Code, http.StatusNotFound)
+}
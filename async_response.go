@@ -0,0 +1,88 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// PreferHeader with respond-async makes /ocr answer with 202 instead of waiting for the result, see RFC 7240
+	PreferHeader            = "Prefer"
+	PreferenceAppliedHeader = "Preference-Applied"
+	preferRespondAsync      = "respond-async"
+	// EstimatedCompletionHeader is the time a job answered with 202 is expected to be finished
+	EstimatedCompletionHeader = "Estimated-Completion"
+)
+
+// prefersAsync reports if req has the preference respond-async
+func prefersAsync(req *http.Request) bool {
+	for _, header := range req.Header.Values(PreferHeader) {
+		for _, preference := range strings.Split(header, ",") {
+			// preferences may have parameters, e.g. "respond-async; wait=10"
+			token, _, _ := strings.Cut(preference, ";")
+			if strings.EqualFold(strings.TrimSpace(token), preferRespondAsync) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jobStatusPath is the status url of a job, it is sent in the Location header of a 202
+func jobStatusPath(requestID string) string {
+	return APIPrefix + "/jobs/" + url.PathEscape(requestID)
+}
+
+// queuedRequests is the number of requests waiting for a worker as seen by the broker or by this daemon
+func queuedRequests() uint {
+	admissionStateMu.RLock()
+	queued := admissionState.NumMessages
+	admissionStateMu.RUnlock()
+	if inFlight := getQueueLen(); inFlight > queued {
+		queued = inFlight
+	}
+	return queued
+}
+
+// completionEstimate is the time in seconds until the queued requests are processed at the current throughput
+func completionEstimate() uint {
+	seconds := throughput.secondsFor(queuedRequests())
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// writeOcrResult writes the result of /ocr. A job which is still processing is answered with 202, a Location header
+// pointing at its status and the estimated completion, the body stays the same for older clients
+func writeOcrResult(w http.ResponseWriter, req *http.Request, ocrResult *OcrResult) {
+	requestID := ocrResult.ID
+	js, err := json.Marshal(ocrResult)
+	if err != nil {
+		writeAPIError(w, req, http.StatusInternalServerError, requestID, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	httpStatus := http.StatusOK
+	if ocrResult.Status == "processing" {
+		seconds := completionEstimate()
+		w.Header().Set("Location", jobStatusPath(ocrResult.ID))
+		w.Header().Set(EstimatedCompletionHeader, time.Now().Add(time.Duration(seconds)*time.Second).UTC().Format(http.TimeFormat))
+		if seconds > maxRetryAfter {
+			seconds = maxRetryAfter
+		}
+		w.Header().Set("Retry-After", strconv.FormatUint(uint64(seconds), 10))
+		httpStatus = http.StatusAccepted
+	}
+	w.WriteHeader(httpStatus)
+	if _, err = w.Write(js); err != nil {
+		log.Error().Err(err).Str("component", "OCR_HTTP").Str("RequestID", requestID).
+			Msg("http write() failed")
+	}
+}
@@ -0,0 +1,73 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestPrefersAsync(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                               false,
+		"respond-async":                  true,
+		"Respond-Async":                  true,
+		"wait=10, respond-async":         true,
+		"respond-async; wait=10":         true,
+		"return=minimal":                 false,
+		"respond-asynchronously, wait=5": false,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/ocr", nil)
+		if header != "" {
+			req.Header.Set(PreferHeader, header)
+		}
+		assert.Equals(t, prefersAsync(req), expected)
+	}
+}
+
+func TestWriteOcrResultProcessingIsAccepted(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeOcrResult(recorder, httptest.NewRequest(http.MethodPost, "/ocr", nil), &OcrResult{ID: "job-a", Status: "processing"})
+	assert.Equals(t, recorder.Code, http.StatusAccepted)
+	assert.Equals(t, recorder.Header().Get("Location"), "/v1/jobs/job-a")
+	assert.True(t, recorder.Header().Get("Retry-After") != "")
+	estimate, err := http.ParseTime(recorder.Header().Get(EstimatedCompletionHeader))
+	assert.True(t, err == nil)
+	assert.True(t, estimate.After(time.Now()))
+	// the body is the same as before
+	var ocrResult OcrResult
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &ocrResult) == nil)
+	assert.Equals(t, ocrResult.Status, "processing")
+	assert.Equals(t, ocrResult.ID, "job-a")
+
+	recorder = httptest.NewRecorder()
+	writeOcrResult(recorder, httptest.NewRequest(http.MethodPost, "/ocr", nil), &OcrResult{ID: "job-b", Status: "done", Text: "text"})
+	assert.Equals(t, recorder.Code, http.StatusOK)
+	assert.Equals(t, recorder.Header().Get("Location"), "")
+}
+
+func TestJobStatus(t *testing.T) {
+	rpcResponseChan := make(chan OcrResult, 1)
+	addNewOcrResultToQueue("job-status", "a", rpcResponseChan)
+	defer deleteRequestFromQueue("job-status")
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /jobs/{id}", NewOcrHttpStatusHandler().Job)
+	get := func(tenant string) OcrResult {
+		request := httptest.NewRequest(http.MethodGet, "/jobs/job-status", nil)
+		request = request.WithContext(withPrincipal(request.Context(), &Principal{Tenant: tenant}))
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		var ocrResult OcrResult
+		assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &ocrResult) == nil)
+		return ocrResult
+	}
+
+	assert.Equals(t, get("a").Status, "processing")
+	// jobs of other tenants are not found
+	assert.Equals(t, get("b").Status, "not found")
+	rpcResponseChan <- OcrResult{ID: "job-status", Status: "done", Text: "text"}
+	assert.Equals(t, get("a").Text, "text")
+}
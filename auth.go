@@ -0,0 +1,99 @@
+package ocrworker
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// scopes a client needs for the api end points
+const (
+	ScopeSubmit     = "submit"
+	ScopeReadStatus = "read-status"
+	ScopeAdmin      = "admin"
+)
+
+// defaultScopes are granted to api keys without explicit scopes
+var defaultScopes = []string{ScopeSubmit, ScopeReadStatus}
+
+// Principal is the authenticated client of a request, regardless of how it was authenticated
+type Principal struct {
+	ClientID string
+	Tenant   string
+	Scopes   []string
+}
+
+// HasScope reports whether the principal was granted scope, admin implies all scopes
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type principalContextKey struct{}
+
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// principalFromContext returns the authenticated client, nil if authentication is disabled
+func principalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalContextKey{}).(*Principal)
+	return principal
+}
+
+// RequireScope only passes requests to next if the principal has scope. Without authentication every
+// request is passed
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		principal := principalFromContext(req.Context())
+		if principal != nil && !principal.HasScope(scope) {
+			log.Warn().Str("component", "OCR_AUTH").Str("ClientID", principal.ClientID).
+				Str("scope", scope).Str("path", req.URL.Path).Msg("client lacks the required scope")
+			writeRejection(w, http.StatusForbidden, "", RejectForbidden, "scope "+scope+" is required", 0)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// NewAuthChain returns a middleware which authenticates requests with a bearer token by jwtAuth and all
+// other requests by apiKeyAuth. Both may be nil, if both are nil authentication is disabled
+func NewAuthChain(apiKeyAuth *APIKeyAuth, jwtAuth *JWTAuth) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if apiKeyAuth == nil && jwtAuth == nil {
+			return next
+		}
+		var byAPIKey, byJWT http.Handler
+		if apiKeyAuth != nil {
+			byAPIKey = apiKeyAuth.Wrap(next)
+		}
+		if jwtAuth != nil {
+			byJWT = jwtAuth.Wrap(next)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, hasBearer := bearerToken(req)
+			switch {
+			case byJWT != nil && (hasBearer || byAPIKey == nil):
+				byJWT.ServeHTTP(w, req)
+			default:
+				byAPIKey.ServeHTTP(w, req)
+			}
+		})
+	}
+}
+
+// bearerToken extracts the token of an "Authorization: Bearer" header
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
@@ -0,0 +1,199 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// states of a batch
+const (
+	BatchProcessing = "processing"
+	BatchDone       = "done"
+)
+
+const (
+	// batchRetention is the time the results of a finished batch can be downloaded
+	batchRetention = time.Hour
+	// batchPublishers is the number of requests of a batch published at once
+	batchPublishers = 8
+	// defaultMaxBatchSize is the default of the flag max_batch_size
+	defaultMaxBatchSize = 1000
+)
+
+// BatchRequest is the body of POST /batches
+type BatchRequest struct {
+	Requests []OcrRequest `json:"requests"`
+	// ReplyTo receives a single BatchResult once all requests are finished
+	ReplyTo string `json:"reply_to"`
+}
+
+// BatchItem maps a request of the batch to its RequestID
+type BatchItem struct {
+	Index       int    `json:"index"`
+	ID          string `json:"id"`
+	ReferenceID string `json:"reference_id,omitempty"`
+	State       string `json:"state"`
+}
+
+// BatchStatus is returned by GET /batches/{id}, Counts holds the number of requests per job state
+type BatchStatus struct {
+	ID       string         `json:"id"`
+	Status   string         `json:"status"`
+	Total    int            `json:"total"`
+	Counts   map[string]int `json:"counts"`
+	Created  time.Time      `json:"created"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	Items    []BatchItem    `json:"items"`
+}
+
+// BatchResultLine is a line of the combined results, ordered like the requests of the batch
+type BatchResultLine struct {
+	Index       int    `json:"index"`
+	ReferenceID string `json:"reference_id,omitempty"`
+	OcrResult
+}
+
+// BatchResult is posted to the reply_to of the batch once all requests are finished
+type BatchResult struct {
+	BatchStatus
+	Results []BatchResultLine `json:"results"`
+}
+
+type batch struct {
+	id               string
+	tenant           string
+	replyTo          string
+	postbackClientID string
+	created          time.Time
+	finished         time.Time
+	items            []BatchItem
+	results          []*OcrResult
+	pending          int
+	// traceParent is the span of the http request which submitted the batch
+	traceParent trace.SpanContext
+}
+
+// batchStore keeps the batches of this http daemon until batchRetention after they are finished
+type batchStore struct {
+	mu      sync.Mutex
+	batches map[string]*batch
+	now     func() time.Time
+}
+
+var batches = &batchStore{batches: make(map[string]*batch), now: time.Now}
+
+func (s *batchStore) add(b *batch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	b.created = s.now()
+	b.pending = len(b.items)
+	b.results = make([]*OcrResult, len(b.items))
+	s.batches[b.id] = b
+}
+
+// status returns the status of the batch and its tenant
+func (s *batchStore) status(batchID string) (BatchStatus, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.batches[batchID]
+	if !ok {
+		return BatchStatus{}, "", false
+	}
+	return b.status(), b.tenant, true
+}
+
+// results returns the results finished so far, ordered by the index of the request
+func (s *batchStore) results(batchID string) ([]BatchResultLine, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.batches[batchID]
+	if !ok {
+		return nil, "", false
+	}
+	return b.resultLines(), b.tenant, true
+}
+
+// complete stores the result of the request at index. The last result finishes the batch and sends
+// it to the reply_to of the batch
+func (s *batchStore) complete(batchID string, index int, ocrResult OcrResult, rabbitConfig *RabbitConfig) {
+	s.mu.Lock()
+	b, ok := s.batches[batchID]
+	if !ok || b.results[index] != nil {
+		s.mu.Unlock()
+		return
+	}
+	b.results[index] = &ocrResult
+	b.items[index].State = resultEvent(&ocrResult).State
+	b.pending--
+	if b.pending > 0 {
+		s.mu.Unlock()
+		return
+	}
+	b.finished = s.now()
+	batchResult := BatchResult{BatchStatus: b.status(), Results: b.resultLines()}
+	s.mu.Unlock()
+
+	log.Info().Str("component", "OCR_BATCH").Str("BatchID", batchID).Int("total", len(b.items)).
+		Msg("all requests of the batch are finished")
+	if b.replyTo == "" {
+		return
+	}
+	body, err := json.Marshal(batchResult)
+	if err != nil {
+		log.Error().Err(err).Str("component", "OCR_BATCH").Str("BatchID", batchID).Msg("batch result can't be delivered")
+		return
+	}
+	currentOutbox(rabbitConfig).enqueue(contextWithTraceParent(b.traceParent), batchID, body, b.replyTo, b.tenant, b.postbackClientID)
+}
+
+// prune removes batches finished longer than batchRetention ago, it has to be called with s.mu held
+func (s *batchStore) prune() {
+	horizon := s.now().Add(-batchRetention)
+	for batchID, b := range s.batches {
+		if !b.finished.IsZero() && b.finished.Before(horizon) {
+			delete(s.batches, batchID)
+		}
+	}
+}
+
+func (b *batch) status() BatchStatus {
+	status := BatchStatus{
+		ID:      b.id,
+		Status:  BatchProcessing,
+		Total:   len(b.items),
+		Counts:  make(map[string]int),
+		Created: b.created,
+		Items:   make([]BatchItem, len(b.items)),
+	}
+	for i, item := range b.items {
+		// requests in flight report the state of their job
+		if b.results[i] == nil {
+			if state, ok := jobEvents.lastState(item.ID); ok {
+				item.State = state
+			}
+		}
+		status.Items[i] = item
+		status.Counts[item.State]++
+	}
+	if !b.finished.IsZero() {
+		finished := b.finished
+		status.Status = BatchDone
+		status.Finished = &finished
+	}
+	return status
+}
+
+func (b *batch) resultLines() []BatchResultLine {
+	lines := make([]BatchResultLine, 0, len(b.items))
+	for i, result := range b.results {
+		if result != nil {
+			lines = append(lines, BatchResultLine{Index: i, ReferenceID: b.items[i].ReferenceID, OcrResult: *result})
+		}
+	}
+	return lines
+}
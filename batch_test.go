@@ -0,0 +1,237 @@
+package ocrworker
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func addTestBatch(batchID, tenant, replyTo string, total int) {
+	b := &batch{id: batchID, tenant: tenant, replyTo: replyTo, items: make([]BatchItem, total)}
+	for i := range b.items {
+		b.items[i] = BatchItem{Index: i, ID: batchID + "-" + string(rune('a'+i)), State: JobQueued}
+	}
+	batches.add(b)
+}
+
+func TestReserveSlotsIsAllOrNothing(t *testing.T) {
+	admissionStateMu.Lock()
+	previous := admissionState
+	admissionState.Capacity = 10
+	admissionStateMu.Unlock()
+	defer func() {
+		admissionStateMu.Lock()
+		admissionState = previous
+		admissionStateMu.Unlock()
+	}()
+
+	assert.True(t, reserveSlots(8))
+	assert.False(t, reserveSlots(3))
+	assert.True(t, schedulerByWorkerNumber())
+	assert.True(t, reserveSlots(2))
+	assert.False(t, schedulerByWorkerNumber())
+	releaseSlots(10)
+	assert.True(t, schedulerByWorkerNumber())
+	releaseSlots(1)
+	assert.True(t, reserveSlots(10))
+	releaseSlots(10)
+}
+
+func TestClientTrackerAcquireAll(t *testing.T) {
+	tracker := &clientTracker{inFlight: make(map[string]uint), owners: make(map[string]string)}
+	assert.True(t, tracker.acquire("client", "1", 5))
+	assert.False(t, tracker.acquireAll("client", []string{"2", "3", "4", "5", "6"}, 5))
+	assert.Equals(t, tracker.count("client"), uint(1))
+	assert.True(t, tracker.acquireAll("client", []string{"2", "3", "4", "5"}, 5))
+	assert.Equals(t, tracker.count("client"), uint(5))
+	tracker.release("3")
+	assert.Equals(t, tracker.count("client"), uint(4))
+}
+
+func TestBatchCompletes(t *testing.T) {
+	addTestBatch("batch-complete", "a", "", 3)
+	config := DefaultTestConfig()
+	batches.complete("batch-complete", 2, OcrResult{ID: "batch-complete-c", Status: "done", Text: "third"}, &config)
+	batches.complete("batch-complete", 0, OcrResult{ID: "batch-complete-a", Status: "error", Text: "broken"}, &config)
+
+	status, tenant, ok := batches.status("batch-complete")
+	assert.True(t, ok)
+	assert.Equals(t, tenant, "a")
+	assert.Equals(t, status.Status, BatchProcessing)
+	assert.Equals(t, status.Counts[JobCompleted], 1)
+	assert.Equals(t, status.Counts[JobFailed], 1)
+	assert.Equals(t, status.Counts[JobQueued], 1)
+
+	lines, _, _ := batches.results("batch-complete")
+	assert.Equals(t, len(lines), 2)
+	assert.Equals(t, lines[0].Index, 0)
+	assert.Equals(t, lines[1].Text, "third")
+
+	// a result is only counted once
+	batches.complete("batch-complete", 2, OcrResult{ID: "batch-complete-c", Status: "done"}, &config)
+	status, _, _ = batches.status("batch-complete")
+	assert.Equals(t, status.Status, BatchProcessing)
+
+	batches.complete("batch-complete", 1, OcrResult{ID: "batch-complete-b", Status: "done"}, &config)
+	status, _, _ = batches.status("batch-complete")
+	assert.Equals(t, status.Status, BatchDone)
+	assert.True(t, status.Finished != nil)
+	assert.Equals(t, status.Counts[JobCompleted], 2)
+}
+
+func TestBatchPostsOnceWhenFinished(t *testing.T) {
+	outbox := newTestOutbox(t, "")
+	bodies := make(chan []byte, 2)
+	outbox.post = func(entry *outboxEntry, secret string, attempt uint) (int, error) {
+		bodies <- entry.Body
+		return 200, nil
+	}
+	postbackOutboxMu.Lock()
+	previous := postbackOutbox
+	postbackOutbox = outbox
+	postbackOutboxMu.Unlock()
+	defer func() {
+		postbackOutboxMu.Lock()
+		postbackOutbox = previous
+		postbackOutboxMu.Unlock()
+	}()
+
+	addTestBatch("batch-postback", "", "http://localhost/postback", 2)
+	config := DefaultTestConfig()
+	batches.complete("batch-postback", 1, OcrResult{ID: "batch-postback-b", Status: "done", Text: "second"}, &config)
+	select {
+	case <-bodies:
+		t.Fatal("batch was posted before all requests finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	batches.complete("batch-postback", 0, OcrResult{ID: "batch-postback-a", Status: "done", Text: "first"}, &config)
+
+	select {
+	case body := <-bodies:
+		var batchResult BatchResult
+		assert.True(t, json.Unmarshal(body, &batchResult) == nil)
+		assert.Equals(t, batchResult.ID, "batch-postback")
+		assert.Equals(t, batchResult.Status, BatchDone)
+		assert.Equals(t, len(batchResult.Results), 2)
+		assert.Equals(t, batchResult.Results[0].Text, "first")
+		assert.Equals(t, batchResult.Results[1].Text, "second")
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch result was not posted")
+	}
+}
+
+func TestBatchResultsDownload(t *testing.T) {
+	addTestBatch("batch-download", "a", "", 2)
+	config := DefaultTestConfig()
+	batches.complete("batch-download", 0, OcrResult{ID: "batch-download-a", Status: "done", Text: "first"}, &config)
+	batches.complete("batch-download", 1, OcrResult{ID: "batch-download-b", Status: "done", Text: "second"}, &config)
+	handler := NewOcrHttpBatchHandler(&config)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /batches/{id}", handler.Status)
+	mux.HandleFunc("GET /batches/{id}/results", handler.Results)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/batches/batch-download/results", nil))
+	assert.Equals(t, recorder.Code, http.StatusOK)
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	assert.Equals(t, len(lines), 2)
+	var line BatchResultLine
+	assert.True(t, json.Unmarshal([]byte(lines[1]), &line) == nil)
+	assert.Equals(t, line.Index, 1)
+	assert.Equals(t, line.Text, "second")
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/batches/batch-download/results?format=zip", nil))
+	assert.Equals(t, recorder.Code, http.StatusOK)
+	archive, err := zip.NewReader(bytes.NewReader(recorder.Body.Bytes()), int64(recorder.Body.Len()))
+	assert.True(t, err == nil)
+	assert.Equals(t, len(archive.File), 2)
+	assert.Equals(t, archive.File[0].Name, "0000-batch-download-a.json")
+	file, err := archive.File[1].Open()
+	assert.True(t, err == nil)
+	content, _ := io.ReadAll(file)
+	assert.True(t, strings.Contains(string(content), `"second"`))
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/batches/batch-download/results?format=pdf", nil))
+	assert.Equals(t, recorder.Code, http.StatusBadRequest)
+
+	// batches of other tenants are not found
+	request := httptest.NewRequest(http.MethodGet, "/batches/batch-download", nil)
+	request = request.WithContext(withPrincipal(request.Context(), &Principal{Tenant: "b"}))
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	assert.Equals(t, recorder.Code, http.StatusNotFound)
+}
+
+func TestBatchSubmitRejectsTooLargeBatch(t *testing.T) {
+	ServiceCanAcceptMu.Lock()
+	ServiceCanAccept = true
+	ServiceCanAcceptMu.Unlock()
+	admissionStateMu.Lock()
+	previous := admissionState
+	admissionState.Capacity = 100
+	admissionStateMu.Unlock()
+	defer func() {
+		ServiceCanAcceptMu.Lock()
+		ServiceCanAccept = false
+		ServiceCanAcceptMu.Unlock()
+		admissionStateMu.Lock()
+		admissionState = previous
+		admissionStateMu.Unlock()
+	}()
+
+	config := DefaultTestConfig()
+	config.MaxBatchSize = 2
+	handler := NewOcrHttpBatchHandler(&config)
+	body := `{"requests":[{"img_url":"http://example.com/1.png"},{"img_url":"http://example.com/2.png"},{"img_url":"http://example.com/3.png"}]}`
+	recorder := httptest.NewRecorder()
+	handler.Submit(recorder, httptest.NewRequest(http.MethodPost, "/batches", strings.NewReader(body)))
+	assert.Equals(t, recorder.Code, http.StatusRequestEntityTooLarge)
+
+	recorder = httptest.NewRecorder()
+	handler.Submit(recorder, httptest.NewRequest(http.MethodPost, "/batches", strings.NewReader(`{"requests":[]}`)))
+	assert.Equals(t, recorder.Code, http.StatusBadRequest)
+}
+
+func TestBatchIsChargedPerRequest(t *testing.T) {
+	defer acceptRequests(2)()
+	apiKeyStore, err := NewAPIKeyStore([]APIKey{
+		{Key: "key1", ClientID: "client1", RateLimit: 0.001, Burst: 3},
+		{Key: "key2", ClientID: "client2", RateLimit: 0.001, Burst: 3},
+	})
+	assert.True(t, err == nil)
+	config := DefaultTestConfig()
+	handler := NewAPIKeyAuth(apiKeyStore).Wrap(http.HandlerFunc(NewOcrHttpBatchHandler(&config).Submit))
+	submit := func(key string, total int) (int, string) {
+		body := `{"requests":[` + strings.Repeat(`{"img_url":"http://example.com/1.png"},`, total-1) +
+			`{"img_url":"http://example.com/1.png"}]}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/batches", strings.NewReader(body))
+		req.Header.Set(APIKeyHeader, key)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		var rejection admissionError
+		_ = json.Unmarshal(recorder.Body.Bytes(), &rejection)
+		return recorder.Code, rejection.Reason
+	}
+
+	// the batch passes the rate limit and takes all tokens, it is rejected because the capacity is 2
+	_, reason := submit("key1", 3)
+	assert.Equals(t, reason, RejectQueueFull)
+	code, reason := submit("key1", 2)
+	assert.Equals(t, code, http.StatusTooManyRequests)
+	assert.Equals(t, reason, RejectRateLimited)
+
+	// more requests than the burst are never accepted
+	code, reason = submit("key2", 4)
+	assert.Equals(t, code, http.StatusTooManyRequests)
+	assert.Equals(t, reason, RejectRateLimited)
+}
@@ -43,33 +43,78 @@ func handleIndex(writer http.ResponseWriter, _ *http.Request) {
 	_, _ = fmt.Fprint(writer, text)
 }
 
-func makeServerFromMux(mux *http.ServeMux) *http.Server {
+func makeServerFromMux(handler http.Handler) *http.Server {
 	return &http.Server{
 		ReadTimeout:       60 * time.Second,
 		ReadHeaderTimeout: 60 * time.Second,
 		WriteTimeout:      60 * time.Second,
 		IdleTimeout:       120 * time.Second,
-		Handler:           mux,
+		Handler:           ocrworker.WithRequestID(handler),
 	}
 }
 
-func makeHTTPServer(rabbitConfig *ocrworker.RabbitConfig, ocrChain http.Handler) *http.Server {
-	mux := &http.ServeMux{}
-	mux.HandleFunc("/", handleIndex)
-	mux.Handle("/ocr", ocrChain)
-	mux.Handle("/ocr-file-upload", ocrworker.NewOcrHttpMultipartHandler(rabbitConfig))
-	// api end point for getting orc request status
-	mux.Handle("/ocr-status", ocrworker.NewOcrHttpStatusHandler())
+// addAdminHandlers adds the end points for operators, they are not meant to be reachable by clients of the api.
+// protect wraps metrics and pprof, the probes are never protected
+func addAdminHandlers(mux *http.ServeMux, protect func(http.Handler) http.Handler) {
+	// probes, /readyz fails if the broker or the workers are gone, the queue is full or the daemon is draining
+	mux.HandleFunc("GET /healthz", ocrworker.HealthzHandler)
+	mux.HandleFunc("GET /readyz", ocrworker.ReadyzHandler)
 	// expose metrics for prometheus
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/metrics", protect(promhttp.Handler()))
+
+	mux.Handle("/debug/pprof/", protect(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", protect(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", protect(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", protect(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", protect(http.HandlerFunc(pprof.Trace)))
+}
+
+// makeAdminServer builds the server of the admin listener, it is the only one serving /admin/reload
+func makeAdminServer(adminAddr string, reloader *ocrworker.ConfigReloader) *http.Server {
+	mux := &http.ServeMux{}
+	addAdminHandlers(mux, func(handler http.Handler) http.Handler { return handler })
+	// reloads the config file, the environment and the api keys like SIGHUP
+	mux.Handle("POST /admin/reload", reloader)
+	adminSrv := makeServerFromMux(mux)
+	adminSrv.Addr = adminAddr
+	return adminSrv
+}
 
-	mux.HandleFunc("/debug/pprof/", pprof.Index)
-	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+// makeHTTPServer builds the server, authenticate wraps the api end points. Without an admin listener metrics,
+// pprof and the probes are served as well, metrics and pprof require the admin scope then
+func makeHTTPServer(rabbitConfig *ocrworker.RabbitConfig, ocrChain http.Handler, authenticate func(http.Handler) http.Handler, withAdmin bool) *http.Server {
+	protect := func(scope string, handler http.Handler) http.Handler {
+		return authenticate(ocrworker.RequireScope(scope, handler))
+	}
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/", handleIndex)
+	// the api is served below /v1, the paths it had before it was versioned are deprecated aliases
+	api := ocrworker.NewAPIRouter(mux)
+	api.Handle("POST /ocr", protect(ocrworker.ScopeSubmit, ocrChain), "/ocr")
+	api.Handle("POST /ocr/upload", protect(ocrworker.ScopeSubmit, ocrworker.NewOcrHttpMultipartHandler(rabbitConfig)), "/ocr-file-upload")
+	// status of a job, the Location of a request accepted with 202. /ocr-status takes the id in the body
+	statusHandler := ocrworker.NewOcrHttpStatusHandler()
+	api.Handle("GET /jobs/{id}", protect(ocrworker.ScopeReadStatus, http.HandlerFunc(statusHandler.Job)))
+	mux.Handle("/ocr-status", protect(ocrworker.ScopeReadStatus, statusHandler))
+	// server-sent events with the state changes of a job
+	api.Handle("GET /jobs/{id}/events", protect(ocrworker.ScopeReadStatus, ocrworker.NewJobEventsHandler()))
+	// api end points for submitting many requests at once and collecting their results
+	batchHandler := ocrworker.NewOcrHttpBatchHandler(rabbitConfig)
+	api.Handle("POST /batches", protect(ocrworker.ScopeSubmit, http.HandlerFunc(batchHandler.Submit)))
+	api.Handle("GET /batches/{id}", protect(ocrworker.ScopeReadStatus, http.HandlerFunc(batchHandler.Status)))
+	api.Handle("GET /batches/{id}/results", protect(ocrworker.ScopeReadStatus, http.HandlerFunc(batchHandler.Results)))
+	// api end point for listing and repeating the delivery of results to reply_to
+	deliveriesHandler := protect(ocrworker.ScopeReadStatus, ocrworker.NewOcrHttpDeliveriesHandler(rabbitConfig))
+	api.Handle("GET /deliveries", deliveriesHandler)
+	api.Handle("POST /deliveries", deliveriesHandler)
+	if withAdmin {
+		addAdminHandlers(mux, func(handler http.Handler) http.Handler {
+			return protect(ocrworker.ScopeAdmin, handler)
+		})
+	}
 
-	return makeServerFromMux(mux)
+	// every request to the api gets a span, the trace is continued by the preprocessors and workers
+	return makeServerFromMux(ocrworker.WithTracing(mux))
 }
 
 func main() {
@@ -95,6 +140,7 @@ func main() {
 					log.Info().Str("component", "OCR_HTTP").Str("signal", sig.String()).
 						Msg("ocr queue is now empty. open-ocr http daemon will now exit. You may stop workers now")
 					time.Sleep(20 * time.Second) // delay puffer for sending all requests back
+					ocrworker.StopTracing()
 					break
 				}
 				ocrworker.RequestsTrack.Range(func(key, value interface{}) bool {
@@ -115,6 +161,7 @@ func main() {
 	var useHttps bool
 	var keyFile string
 	var certFile string
+	var adminAddr string
 	flagFunc := func() {
 		flag.UintVar(
 			&httpPort,
@@ -152,6 +199,12 @@ func main() {
 			"",
 			"path to certificate file",
 		)
+		flag.StringVar(
+			&adminAddr,
+			"admin_addr",
+			"",
+			"address of the listener for metrics, pprof, the health probes and /admin/reload, e.g. localhost:9090. If empty all but /admin/reload are served on http_port",
+		)
 	}
 
 	rabbitConfig := ocrworker.DefaultConfigFlagsOverride(flagFunc)
@@ -167,9 +220,50 @@ func main() {
 	rabbitConfigTemp.AmqpAPIURI = ocrworker.StripPasswordFromUrl(urlTmp)
 	urlTmp, _ = url.Parse(rabbitConfigTemp.AmqpURI)
 	rabbitConfigTemp.AmqpURI = ocrworker.StripPasswordFromUrl(urlTmp)
+	if rabbitConfigTemp.PostbackSecret != "" {
+		rabbitConfigTemp.PostbackSecret = "***"
+	}
 	log.Info().Interface("parameters", rabbitConfigTemp).Msg("trying to start with parameters")
+	if err := ocrworker.StartTracing(rabbitConfig.Tracing, "open-ocr-httpd"); err != nil {
+		log.Fatal().Err(err).Str("component", "CLI_HTTP").Msg("can't start tracing")
+	}
 
 	ocrChain := ocrworker.InstrumentHttpStatusHandler(ocrworker.NewOcrHttpHandler(&rabbitConfig))
+	var apiKeyAuth *ocrworker.APIKeyAuth
+	if rabbitConfig.APIKeysFile != "" {
+		apiKeyStore, err := ocrworker.NewFileAPIKeyStore(rabbitConfig.APIKeysFile)
+		if err != nil {
+			log.Fatal().Err(err).Str("component", "CLI_HTTP").Msg("can't load api keys")
+		}
+		apiKeyAuth = ocrworker.NewAPIKeyAuth(apiKeyStore)
+		log.Info().Str("component", "CLI_HTTP").Msg("api key authentication is enabled")
+	}
+	var jwtAuth *ocrworker.JWTAuth
+	if rabbitConfig.JWT.Enabled() {
+		var err error
+		jwtAuth, err = ocrworker.NewJWTAuth(rabbitConfig.JWT)
+		if err != nil {
+			log.Fatal().Err(err).Str("component", "CLI_HTTP").Msg("can't load JWKS for bearer token authentication")
+		}
+		log.Info().Str("component", "CLI_HTTP").Msg("bearer token authentication is enabled")
+	}
+	authenticate := ocrworker.NewAuthChain(apiKeyAuth, jwtAuth)
+	reloader := ocrworker.NewConfigReloader(&rabbitConfig, apiKeyAuth)
+	go func() {
+		reloadSignals := make(chan os.Signal, 1)
+		signal.Notify(reloadSignals, syscall.SIGHUP)
+		for range reloadSignals {
+			log.Info().Str("component", "CLI_HTTP").Msg("Caught SIGHUP, reloading the configuration")
+			_, _ = reloader.Reload()
+		}
+	}()
+	outbox, err := ocrworker.StartOutbox(&rabbitConfig)
+	if err != nil {
+		log.Fatal().Err(err).Str("component", "CLI_HTTP").Msg("can't open the outbox for postbacks")
+	}
+	if apiKeyAuth != nil {
+		outbox.SetClientSecrets(apiKeyAuth.PostbackSecret)
+	}
 	listenAddr := fmt.Sprintf(":%d", httpPort)
 
 	// start a goroutine which will run forever and decide if we have resources for incoming requests
@@ -177,12 +271,24 @@ func main() {
 		ocrworker.SetResManagerState(&rabbitConfig)
 	}()
 	log.Info().Str("component", "OCR_HTTP").Str("listenAddr", listenAddr).Msg("Starting listener...")
+	if adminAddr != "" {
+		adminSrv := makeAdminServer(adminAddr, reloader)
+		log.Info().Str("component", "OCR_HTTP").Str("adminAddr", adminAddr).Msg("Starting admin listener...")
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil {
+				log.Fatal().Err(err).Str("component", "CLI_HTTP").Caller().Msg("admin listener has failed to start")
+			}
+		}()
+	} else {
+		log.Warn().Str("component", "OCR_HTTP").
+			Msg("metrics and pprof are served on the public port and /admin/reload is disabled, use admin_addr to move them to a separate listener")
+	}
 
 	if useHttps {
 		if certFile == "" || keyFile == "" {
 			log.Fatal().Msg("usehttps flag only makes sense if both the private key and a certificate are available")
 		}
-		httpsSrv := makeHTTPServer(&rabbitConfig, ocrChain)
+		httpsSrv := makeHTTPServer(&rabbitConfig, ocrChain, authenticate, adminAddr == "")
 		httpsSrv.Addr = listenAddr
 
 		// crypto settings
@@ -203,7 +309,7 @@ func main() {
 			log.Fatal().Err(err).Str("component", "CLI_HTTP").Caller().Msg("cli_https has failed to start")
 		}
 	} else {
-		httpSrv := makeHTTPServer(&rabbitConfig, ocrChain)
+		httpSrv := makeHTTPServer(&rabbitConfig, ocrChain, authenticate, adminAddr == "")
 		httpSrv.Addr = listenAddr
 		if err := httpSrv.ListenAndServe(); err != nil {
 			log.Fatal().Err(err).Str("component", "CLI_HTTP").Caller().Msg("cli_http has failed to start")
@@ -2,6 +2,10 @@ package main
 
 import (
 	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -19,6 +23,7 @@ func init() {
 
 func main() {
 	var preprocessor string
+	var statusAddr string
 	flagFunc := func() {
 		flag.StringVar(
 			&preprocessor,
@@ -26,9 +31,34 @@ func main() {
 			"identity",
 			"The preprocessor to use, eg, stroke-width-transform",
 		)
+		flag.StringVar(
+			&statusAddr,
+			"status_addr",
+			"",
+			"listen address of the http server exposing /healthz and /readyz e.g. :9092, empty disables the server",
+		)
 	}
 
 	rabbitConfig := ocrworker.DefaultConfigFlagsOverride(flagFunc)
+	if err := ocrworker.StartTracing(rabbitConfig.Tracing, "open-ocr-preprocessor"); err != nil {
+		log.Panic().Err(err).Str("component", "MAIN_PREPROSSOR").Msg("could not start tracing")
+	}
+
+	if statusAddr != "" {
+		mux := http.NewServeMux()
+		ocrworker.AddWorkerHealthHandlers(mux)
+		statusServer := &http.Server{Addr: statusAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			log.Info().Str("component", "MAIN_PREPROSSOR").Str("listenAddr", statusAddr).
+				Msg("Starting status listener...")
+			if err := statusServer.ListenAndServe(); err != nil {
+				log.Error().Str("component", "MAIN_PREPROSSOR").Err(err).Msg("status server has failed")
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 
 	// inifinite loop, since sometimes worker <-> rabbitmq connection
 	// gets broken.  see https://github.com/tleyden/open-ocr/issues/4
@@ -46,8 +76,21 @@ func main() {
 			log.Error().Err(err).Str("component", "MAIN_PREPROSSOR").Msg("preprocessor worker failed")
 		}
 
+		select {
 		// this happens when connection is closed
-		err = <-preprocessorWorker.Done
-		log.Error().Err(err).Str("component", "MAIN_PREPROSSOR").Msg("preprocessor worker failed")
+		case err = <-preprocessorWorker.Done:
+			log.Error().Err(err).Str("component", "MAIN_PREPROSSOR").Msg("preprocessor worker failed")
+		case sig := <-signals:
+			log.Info().Str("component", "MAIN_PREPROSSOR").Str("signal", sig.String()).
+				Uint("shutdown_grace", rabbitConfig.ShutdownGrace).
+				Msg("Caught signal to terminate, finishing current job before exit")
+			err = preprocessorWorker.Shutdown()
+			ocrworker.StopTracing()
+			if err != nil {
+				log.Error().Err(err).Str("component", "MAIN_PREPROSSOR").Msg("preprocessor worker shutdown failed")
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
 	}
 }
@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 
 	// _ "net/http/pprof"
 	"time"
@@ -57,6 +60,26 @@ func main() {
 	}
 
 	log.Info().Interface("workerConfig", workerConfigToLog).Msg("worker started with this parameters")
+	if err := ocrworker.StartTracing(workerConfig.Tracing, "open-ocr-worker"); err != nil {
+		log.Panic().Str("component", "OCR_WORKER").Err(err).Msg("could not start tracing")
+	}
+
+	if workerConfig.StatusAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", ocrworker.WorkerMetricsHandler())
+		ocrworker.AddWorkerHealthHandlers(mux)
+		statusServer := &http.Server{Addr: workerConfig.StatusAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			log.Info().Str("component", "OCR_WORKER").Str("listenAddr", workerConfig.StatusAddr).
+				Msg("Starting status listener...")
+			if err := statusServer.ListenAndServe(); err != nil {
+				log.Error().Str("component", "OCR_WORKER").Err(err).Msg("status server has failed")
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 
 	// infinite loop, since sometimes worker <-> rabbitmq connection
 	// gets broken.  see https://github.com/tleyden/open-ocr/issues/4
@@ -76,10 +99,23 @@ func main() {
 				Msgf("Error running worker: %v", err)
 		}
 
+		select {
 		// this happens when connection is closed
-		err = <-ocrWorker.Done
-		log.Error().
-			Str("component", "OCR_WORKER").Err(err).
-			Msg("OCR Worker failed with error")
+		case err = <-ocrWorker.Done:
+			log.Error().
+				Str("component", "OCR_WORKER").Err(err).
+				Msg("OCR Worker failed with error")
+		case sig := <-signals:
+			log.Info().Str("component", "OCR_WORKER").Str("signal", sig.String()).
+				Uint("shutdown_grace", workerConfig.ShutdownGrace).
+				Msg("Caught signal to terminate, finishing current job before exit")
+			err = ocrWorker.Shutdown()
+			ocrworker.StopTracing()
+			if err != nil {
+				log.Error().Str("component", "OCR_WORKER").Err(err).Msg("OCR Worker shutdown failed")
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
 	}
 }
@@ -0,0 +1,214 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ConfigEnvPrefix is the prefix of the environment variables overriding the config file, e.g. OPENOCR_AMQP_URI
+	ConfigEnvPrefix = "OPENOCR_"
+	redacted        = "***"
+)
+
+// secretFlags are replaced by -print-config, the passwords of urlFlags are removed. commandLineFlags are
+// neither read from the environment or the config file nor printed
+var (
+	commandLineFlags = map[string]bool{"config": true, "print-config": true, "version": true}
+	secretFlags      = map[string]bool{"postback_secret": true}
+	urlFlags         = map[string]bool{"amqp_uri": true, "amqpapi_uri": true, "jwt_jwks_url": true}
+)
+
+// configSources are the config file and the flags given on the command line of the process, a reload of the
+// configuration reads the file and the environment again
+var configSources struct {
+	path          string
+	onCommandLine map[string]string
+}
+
+// addConfigFileFlags registers -config and -print-config. The returned function has to be called after
+// flag.Parse(), it sets all flags which were not given on the command line from the OPENOCR_* environment
+// variables or the config file and reports if the effective config should be printed
+func addConfigFileFlags() func() (bool, error) {
+	var (
+		configFile  string
+		printConfig bool
+	)
+	flag.StringVar(
+		&configFile,
+		"config",
+		"",
+		"Path to a YAML or TOML config file, the keys are the names of the flags. "+
+			"Environment variables "+ConfigEnvPrefix+"<FLAG> override the file, flags override both",
+	)
+	flag.BoolVar(
+		&printConfig,
+		"print-config",
+		false,
+		"print the effective config with secrets redacted and exit",
+	)
+	return func() (bool, error) {
+		if configFile == "" {
+			configFile = os.Getenv(ConfigEnvPrefix + "CONFIG")
+		}
+		configSources.path = configFile
+		configSources.onCommandLine = make(map[string]string)
+		flag.Visit(func(f *flag.Flag) { configSources.onCommandLine[f.Name] = f.Value.String() })
+		return printConfig, applyConfigSources(flag.CommandLine, configFile, os.LookupEnv)
+	}
+}
+
+// configEnvName is the environment variable of a flag, e.g. OPENOCR_AMQP_URI for amqp_uri
+func configEnvName(name string) string {
+	return ConfigEnvPrefix + strings.ToUpper(name)
+}
+
+// applyConfigSources sets the flags of flagSet which were not set on the command line from the environment or,
+// if configFile is not empty, from the file. All invalid values are reported at once
+func applyConfigSources(flagSet *flag.FlagSet, configFile string, lookupEnv func(string) (string, bool)) error {
+	var fileValues map[string]string
+	var errs []error
+	if configFile != "" {
+		var err error
+		if fileValues, err = readConfigFile(configFile, flagSet); err != nil {
+			return err
+		}
+	}
+	onCommandLine := make(map[string]bool)
+	flagSet.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if onCommandLine[f.Name] || commandLineFlags[f.Name] {
+			return
+		}
+		if value, ok := lookupEnv(configEnvName(f.Name)); ok {
+			if err := flagSet.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid value %q: %v", configEnvName(f.Name), value, err))
+			}
+			return
+		}
+		if value, ok := fileValues[f.Name]; ok {
+			if err := flagSet.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: invalid value %q: %v", configFile, f.Name, value, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// readConfigFile reads a .toml file or a .yaml/.yml file into flag values. Nested tables are joined with "_",
+// so "jwt: {issuer: x}" sets jwt_issuer, lists become comma separated and the tables of flags taking JSON,
+// e.g. queue_prio, are passed as JSON. Keys which are not flags of flagSet are used by the other binaries
+// sharing the file and are ignored
+func readConfigFile(configFile string, flagSet *flag.FlagSet) (map[string]string, error) {
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read config file: %w", err)
+	}
+	tree := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".toml":
+		err = toml.Unmarshal(content, &tree)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &tree)
+	default:
+		return nil, fmt.Errorf("config file %s has to end with .yaml, .yml or .toml", configFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't parse config file %s: %w", configFile, err)
+	}
+	values := make(map[string]string)
+	var errs []error
+	flattenConfig("", tree, flagSet, values, &errs)
+	return values, errors.Join(errs...)
+}
+
+func flattenConfig(prefix string, tree map[string]interface{}, flagSet *flag.FlagSet, values map[string]string, errs *[]error) {
+	for key, value := range tree {
+		name := prefix + key
+		table, isTable := value.(map[string]interface{})
+		if isTable && flagSet.Lookup(name) == nil {
+			flattenConfig(name+"_", table, flagSet, values, errs)
+			continue
+		}
+		if flagSet.Lookup(name) == nil {
+			log.Debug().Str("component", "OCR_CONFIG").Str("key", name).Msg("config file key is not a flag of this binary")
+			continue
+		}
+		flagValue, err := configValue(value)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%s: %v", name, err))
+			continue
+		}
+		values[name] = flagValue
+	}
+}
+
+// configValue converts a value of the config file to the string accepted by the flag
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", nil
+	case map[string]interface{}:
+		js, err := json.Marshal(v)
+		return string(js), err
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			itemValue, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, itemValue)
+		}
+		return strings.Join(items, ","), nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// printEffectiveConfig writes the flags of flagSet in the format of a YAML config file. Secrets are
+// replaced and passwords removed from urls
+func printEffectiveConfig(w io.Writer, flagSet *flag.FlagSet) error {
+	config := make(map[string]interface{})
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if commandLineFlags[f.Name] {
+			return
+		}
+		var value interface{} = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			value = getter.Get()
+		}
+		switch {
+		case secretFlags[f.Name] && f.Value.String() != "":
+			value = redacted
+		case urlFlags[f.Name] && f.Value.String() != "":
+			if parsed, err := url.Parse(f.Value.String()); err == nil {
+				value = StripPasswordFromUrl(parsed)
+			} else {
+				value = redacted
+			}
+		}
+		config[f.Name] = value
+	})
+	// the keys of the map are sorted by the encoder
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
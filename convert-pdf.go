@@ -10,17 +10,17 @@ package ocrworker
 */
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 
 	"github.com/rs/zerolog/log"
 )
 
 type ConvertPdf struct{}
 
-func (ConvertPdf) preprocess(ocrRequest *OcrRequest) error {
-	tmpFileNameInput, err := createTempFileName("")
+func (ConvertPdf) preprocess(ctx context.Context, ocrRequest *OcrRequest) error {
+	tmpFileNameInput, err := createTempFileName(ctx, "")
 	tmpFileNameInput = fmt.Sprintf("%s.pdf", tmpFileNameInput)
 	if err != nil {
 		return err
@@ -32,7 +32,7 @@ func (ConvertPdf) preprocess(ocrRequest *OcrRequest) error {
 		}
 	}(tmpFileNameInput)
 
-	tmpFileNameOutput, err := createTempFileName("")
+	tmpFileNameOutput, err := createTempFileName(ctx, "")
 	tmpFileNameOutput = fmt.Sprintf("%s.tif", tmpFileNameOutput)
 	if err != nil {
 		return err
@@ -63,7 +63,10 @@ func (ConvertPdf) preprocess(ocrRequest *OcrRequest) error {
 	)
 	log.Info().Str("component", "PREPROCESSOR_WORKER").Interface("gsArgs", gsArgs)
 
-	out, err := exec.Command("gs", gsArgs...).CombinedOutput()
+	out, err := combinedOutput(ctx, "gs", gsArgs...)
+	if ctx.Err() != nil {
+		return fmt.Errorf("gs was terminated: %v", ctx.Err())
+	}
 	if err != nil {
 		log.Error().Err(err).Str("component", "PREPROCESSOR_CONVERTPDF").Msg(string(out))
 	}
@@ -0,0 +1,203 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+// HealthComponent is the state of one of the dependencies checked by /readyz
+type HealthComponent struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// HealthReport is the body of /healthz and /readyz of the http daemon
+type HealthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]HealthComponent `json:"components,omitempty"`
+	// Admission is the last snapshot of the admission controller
+	Admission  *AdmissionState `json:"admission,omitempty"`
+	LastPolled *time.Time      `json:"last_polled,omitempty"`
+}
+
+// HealthzHandler reports that the process is alive
+func HealthzHandler(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, http.StatusOK, HealthReport{Status: HealthOK})
+}
+
+// ReadyzHandler reports if the http daemon can accept requests: the broker is reachable, at least one worker
+// is consuming, the admission controller accepts requests and the daemon is not draining
+func ReadyzHandler(w http.ResponseWriter, _ *http.Request) {
+	report := readiness()
+	httpStatus := http.StatusOK
+	if report.Status != HealthOK {
+		httpStatus = http.StatusServiceUnavailable
+	}
+	writeHealth(w, httpStatus, report)
+}
+
+func readiness() HealthReport {
+	ServiceCanAcceptMu.RLock()
+	serviceCanAccept := ServiceCanAccept
+	appStop := AppStop
+	ServiceCanAcceptMu.RUnlock()
+	admissionStateMu.RLock()
+	state := admissionState
+	reason := admissionReason
+	polled := admissionPolled
+	admissionStateMu.RUnlock()
+
+	check := func(ok bool, message string) HealthComponent {
+		if ok {
+			return HealthComponent{Status: HealthOK}
+		}
+		return HealthComponent{Status: HealthFail, Message: message}
+	}
+	report := HealthReport{Status: HealthOK, Components: make(map[string]HealthComponent)}
+	if polled.IsZero() {
+		report.Components["broker"] = check(false, "admission controller was not polled yet")
+		report.Components["workers"] = check(false, "admission controller was not polled yet")
+	} else {
+		report.Components["broker"] = check(reason != RejectBrokerUnreachable, rejectMessages[RejectBrokerUnreachable])
+		report.Components["workers"] = check(reason != RejectNoWorkers, rejectMessages[RejectNoWorkers])
+		report.Admission = &state
+		report.LastPolled = &polled
+	}
+	admissionMessage := rejectMessages[reason]
+	if admissionMessage == "" {
+		admissionMessage = "not accepting requests"
+	}
+	report.Components["admission"] = check(serviceCanAccept, admissionMessage)
+	report.Components["draining"] = check(!appStop, rejectMessages[RejectShuttingDown])
+	for _, component := range report.Components {
+		if component.Status != HealthOK {
+			report.Status = HealthFail
+		}
+	}
+	return report
+}
+
+// CurrentJob is a job a worker is processing
+type CurrentJob struct {
+	ID      string    `json:"id"`
+	Started time.Time `json:"started"`
+}
+
+// WorkerHealthReport is the body of /healthz and /readyz of workers and preprocessors
+type WorkerHealthReport struct {
+	Status      string       `json:"status"`
+	Connected   bool         `json:"connected"`
+	Draining    bool         `json:"draining"`
+	CurrentJobs []CurrentJob `json:"current_jobs"`
+	LastSuccess *time.Time   `json:"last_success,omitempty"`
+	LastFailure *time.Time   `json:"last_failure,omitempty"`
+}
+
+// workerHealth is updated by the worker or preprocessor of the process
+type workerHealth struct {
+	mu          sync.Mutex
+	connected   bool
+	draining    bool
+	jobs        map[string]time.Time
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+var processHealth = &workerHealth{jobs: make(map[string]time.Time)}
+
+func (h *workerHealth) setConnected(connected bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connected = connected
+}
+
+func (h *workerHealth) setDraining() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.draining = true
+}
+
+func (h *workerHealth) jobStarted(requestID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.jobs[requestID] = time.Now()
+}
+
+// jobFinished removes the job, a requeued job is neither a success nor a failure
+func (h *workerHealth) jobFinished(requestID string, success, requeued bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.jobs, requestID)
+	switch {
+	case requeued:
+	case success:
+		h.lastSuccess = time.Now()
+	default:
+		h.lastFailure = time.Now()
+	}
+}
+
+// report is ready if the worker is connected to the broker and not draining
+func (h *workerHealth) report() WorkerHealthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	report := WorkerHealthReport{
+		Status:      HealthOK,
+		Connected:   h.connected,
+		Draining:    h.draining,
+		CurrentJobs: make([]CurrentJob, 0, len(h.jobs)),
+	}
+	if !h.connected || h.draining {
+		report.Status = HealthFail
+	}
+	for id, started := range h.jobs {
+		report.CurrentJobs = append(report.CurrentJobs, CurrentJob{ID: id, Started: started})
+	}
+	sort.Slice(report.CurrentJobs, func(i, j int) bool { return report.CurrentJobs[i].Started.Before(report.CurrentJobs[j].Started) })
+	if !h.lastSuccess.IsZero() {
+		lastSuccess := h.lastSuccess
+		report.LastSuccess = &lastSuccess
+	}
+	if !h.lastFailure.IsZero() {
+		lastFailure := h.lastFailure
+		report.LastFailure = &lastFailure
+	}
+	return report
+}
+
+// AddWorkerHealthHandlers adds /healthz and /readyz of a worker or preprocessor to mux. Both report the
+// connection, the current jobs and the time of the last successful job, /healthz always with 200
+func AddWorkerHealthHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		report := processHealth.report()
+		report.Status = HealthOK
+		writeHealth(w, http.StatusOK, report)
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, _ *http.Request) {
+		report := processHealth.report()
+		httpStatus := http.StatusOK
+		if report.Status != HealthOK {
+			httpStatus = http.StatusServiceUnavailable
+		}
+		writeHealth(w, httpStatus, report)
+	})
+}
+
+func writeHealth(w http.ResponseWriter, httpStatus int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(httpStatus)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Str("component", "OCR_HEALTH").Msg("http write() failed")
+	}
+}
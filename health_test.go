@@ -0,0 +1,115 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func setReadinessState(t *testing.T, canAccept bool, reason string, polled time.Time) {
+	ServiceCanAcceptMu.Lock()
+	previousCanAccept := ServiceCanAccept
+	ServiceCanAccept = canAccept
+	ServiceCanAcceptMu.Unlock()
+	admissionStateMu.Lock()
+	previousReason, previousPolled := admissionReason, admissionPolled
+	admissionReason, admissionPolled = reason, polled
+	admissionStateMu.Unlock()
+	t.Cleanup(func() {
+		ServiceCanAcceptMu.Lock()
+		ServiceCanAccept = previousCanAccept
+		ServiceCanAcceptMu.Unlock()
+		admissionStateMu.Lock()
+		admissionReason, admissionPolled = previousReason, previousPolled
+		admissionStateMu.Unlock()
+	})
+}
+
+func getReadyz(t *testing.T) (int, HealthReport) {
+	recorder := httptest.NewRecorder()
+	ReadyzHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report HealthReport
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &report) == nil)
+	return recorder.Code, report
+}
+
+func TestReadyz(t *testing.T) {
+	// not ready before the first poll of the admission controller
+	setReadinessState(t, false, "", time.Time{})
+	code, report := getReadyz(t)
+	assert.Equals(t, code, http.StatusServiceUnavailable)
+	assert.Equals(t, report.Components["broker"].Status, HealthFail)
+
+	setReadinessState(t, true, "", time.Now())
+	code, report = getReadyz(t)
+	assert.Equals(t, code, http.StatusOK)
+	assert.Equals(t, report.Status, HealthOK)
+	assert.Equals(t, len(report.Components), 4)
+	assert.True(t, report.LastPolled != nil)
+
+	setReadinessState(t, false, RejectNoWorkers, time.Now())
+	code, report = getReadyz(t)
+	assert.Equals(t, code, http.StatusServiceUnavailable)
+	assert.Equals(t, report.Components["broker"].Status, HealthOK)
+	assert.Equals(t, report.Components["workers"].Status, HealthFail)
+	assert.Equals(t, report.Components["admission"].Message, rejectMessages[RejectNoWorkers])
+
+	setReadinessState(t, false, RejectBrokerUnreachable, time.Now())
+	_, report = getReadyz(t)
+	assert.Equals(t, report.Components["broker"].Status, HealthFail)
+	assert.Equals(t, report.Components["workers"].Status, HealthOK)
+}
+
+func TestHealthz(t *testing.T) {
+	setReadinessState(t, false, RejectBrokerUnreachable, time.Now())
+	recorder := httptest.NewRecorder()
+	HealthzHandler(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equals(t, recorder.Code, http.StatusOK)
+}
+
+func TestWorkerHealth(t *testing.T) {
+	health := &workerHealth{jobs: make(map[string]time.Time)}
+	report := health.report()
+	assert.Equals(t, report.Status, HealthFail)
+	assert.Equals(t, len(report.CurrentJobs), 0)
+	assert.True(t, report.LastSuccess == nil)
+
+	health.setConnected(true)
+	health.jobStarted("a")
+	health.jobStarted("b")
+	report = health.report()
+	assert.Equals(t, report.Status, HealthOK)
+	assert.Equals(t, len(report.CurrentJobs), 2)
+
+	health.jobFinished("a", true, false)
+	health.jobFinished("b", false, true)
+	report = health.report()
+	assert.Equals(t, len(report.CurrentJobs), 0)
+	assert.True(t, report.LastSuccess != nil)
+	// a requeued job is not a failure
+	assert.True(t, report.LastFailure == nil)
+
+	health.setDraining()
+	assert.Equals(t, health.report().Status, HealthFail)
+}
+
+func TestWorkerHealthHandlers(t *testing.T) {
+	mux := http.NewServeMux()
+	AddWorkerHealthHandlers(mux)
+	processHealth.setConnected(false)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equals(t, recorder.Code, http.StatusOK)
+	var report WorkerHealthReport
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &report) == nil)
+	assert.Equals(t, report.Connected, false)
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equals(t, recorder.Code, http.StatusServiceUnavailable)
+}
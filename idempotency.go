@@ -0,0 +1,167 @@
+package ocrworker
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// IdempotencyKeyHeader makes a repeated request return the job of the first request with the same key
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses to repeated requests
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	// RejectIdempotencyConflict is returned if the first request with the key failed before it was accepted
+	RejectIdempotencyConflict = "idempotency_conflict"
+	// RejectInvalidIdempotencyKey is returned for keys longer than maxIdempotencyKeyLength
+	RejectInvalidIdempotencyKey = "invalid_idempotency_key"
+
+	defaultIdempotencyTTL   = 86400
+	maxIdempotencyKeyLength = 255
+)
+
+var idempotentReplays = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ocr_idempotent_replays_total",
+	Help: "Requests answered with the job of an earlier request with the same Idempotency-Key.",
+})
+
+// idempotentRequest is the first request with an Idempotency-Key. done is closed once its response is known,
+// result or batchID, if the request was a batch, are only valid if accepted is true
+type idempotentRequest struct {
+	store    *idempotencyStore
+	key      string
+	done     chan struct{}
+	result   OcrResult
+	batchID  string
+	accepted bool
+	expires  time.Time
+}
+
+// idempotencyStore keeps the requests by client and Idempotency-Key until their ttl expires
+type idempotencyStore struct {
+	mu        sync.Mutex
+	requests  map[string]*idempotentRequest
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+var idempotencyKeys = &idempotencyStore{requests: make(map[string]*idempotentRequest), now: time.Now}
+
+// claim returns the request registered for key. If there is none, a new one is registered and first is true
+func (s *idempotencyStore) claim(key string, ttl time.Duration) (*idempotentRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if now.Sub(s.lastPrune) > time.Minute {
+		for k, request := range s.requests {
+			if now.After(request.expires) {
+				delete(s.requests, k)
+			}
+		}
+		s.lastPrune = now
+	}
+	if request, ok := s.requests[key]; ok && !now.After(request.expires) {
+		return request, false
+	}
+	request := &idempotentRequest{store: s, key: key, done: make(chan struct{}), expires: now.Add(ttl)}
+	s.requests[key] = request
+	return request, true
+}
+
+// accept stores the response of the first request, later requests with the key get the same response
+func (r *idempotentRequest) accept(ocrResult OcrResult) {
+	r.finish(ocrResult, "")
+}
+
+// acceptBatch stores the batch accepted for the first request, later requests with the key get its status
+func (r *idempotentRequest) acceptBatch(batchID string) {
+	r.finish(OcrResult{}, batchID)
+}
+
+func (r *idempotentRequest) finish(ocrResult OcrResult, batchID string) {
+	if r == nil {
+		return
+	}
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+	r.result = ocrResult
+	r.batchID = batchID
+	r.accepted = true
+	close(r.done)
+}
+
+// abandon releases the key of a request which wasn't accepted, so it can be sent again. It does nothing after accept
+func (r *idempotentRequest) abandon() {
+	if r == nil {
+		return
+	}
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+	if r.store.requests[r.key] == r {
+		delete(r.store.requests, r.key)
+	}
+	close(r.done)
+}
+
+// beginIdempotentRequest handles the Idempotency-Key header of req. A repeated request waits for the first one and
+// gets its response written to w, then replayed is true. Otherwise the returned request, nil without a key, has to be
+// accepted once the response is known or abandoned
+func beginIdempotentRequest(w http.ResponseWriter, req *http.Request, requestID string, rabbitConfig *RabbitConfig) (*idempotentRequest, bool) {
+	key := req.Header.Get(IdempotencyKeyHeader)
+	if key == "" || rabbitConfig.IdempotencyTTL == 0 {
+		return nil, false
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		writeRejection(w, http.StatusBadRequest, requestID, RejectInvalidIdempotencyKey, "Idempotency-Key is too long. RequestID "+requestID, 0)
+		return nil, true
+	}
+	// keys of different clients never collide
+	scopedKey := tenantFromPrincipal(principalFromContext(req.Context())) + "\x00" + clientIDFromRequest(req) + "\x00" + key
+	request, first := idempotencyKeys.claim(scopedKey, time.Duration(rabbitConfig.IdempotencyTTL)*time.Second)
+	if first {
+		return request, false
+	}
+
+	select {
+	case <-request.done:
+	case <-req.Context().Done():
+		return nil, true
+	}
+	if !request.accepted {
+		writeRejection(w, http.StatusConflict, requestID, RejectIdempotencyConflict,
+			"the first request with this Idempotency-Key failed, it can be sent again", 0)
+		return nil, true
+	}
+	idempotentReplays.Inc()
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	if request.batchID != "" {
+		log.Info().Str("component", "OCR_HTTP").Str("BatchID", request.batchID).
+			Msg("repeated request with the same Idempotency-Key, returning the batch of the first request")
+		status, _, ok := batches.status(request.batchID)
+		if !ok {
+			writeRejection(w, http.StatusNotFound, request.batchID, RejectBatchNotFound, "no such batch, it may have finished a while ago", 0)
+			return nil, true
+		}
+		w.Header().Set("Location", APIPrefix+"/batches/"+url.PathEscape(request.batchID))
+		writeBatch(w, http.StatusAccepted, status)
+		return nil, true
+	}
+	log.Info().Str("component", "OCR_HTTP").Str("RequestID", request.result.ID).
+		Msg("repeated request with the same Idempotency-Key, returning the job of the first request")
+	writeOcrResult(w, req, &request.result)
+	return nil, true
+}
@@ -0,0 +1,137 @@
+package ocrworker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func newIdempotentTestRequest(key, clientAddr string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/ocr", nil)
+	req.Header.Set(IdempotencyKeyHeader, key)
+	req.RemoteAddr = clientAddr + ":1234"
+	return req
+}
+
+func TestIdempotentRequestIsReplayed(t *testing.T) {
+	config := DefaultTestConfig()
+	first, replayed := beginIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest("replay", "10.0.0.1"), "1", &config)
+	assert.False(t, replayed)
+	assert.True(t, first != nil)
+
+	// the repeated request waits for the first one
+	recorder := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		_, replayed := beginIdempotentRequest(recorder, newIdempotentTestRequest("replay", "10.0.0.1"), "2", &config)
+		done <- replayed
+	}()
+	select {
+	case <-done:
+		t.Fatal("repeated request didn't wait for the first one")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.accept(OcrResult{ID: "1", Status: "processing"})
+	assert.True(t, <-done)
+	assert.Equals(t, recorder.Header().Get(IdempotentReplayedHeader), "true")
+	var ocrResult OcrResult
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &ocrResult) == nil)
+	assert.Equals(t, ocrResult.ID, "1")
+	first.abandon()
+
+	// the key of another client is a different key
+	other, replayed := beginIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest("replay", "10.0.0.2"), "3", &config)
+	assert.False(t, replayed)
+	assert.True(t, other != nil)
+	other.abandon()
+}
+
+func TestIdempotentRequestCanBeRetriedAfterFailure(t *testing.T) {
+	config := DefaultTestConfig()
+	first, _ := beginIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest("failure", "10.0.0.1"), "1", &config)
+	recorder := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		_, replayed := beginIdempotentRequest(recorder, newIdempotentTestRequest("failure", "10.0.0.1"), "2", &config)
+		done <- replayed
+	}()
+	time.Sleep(20 * time.Millisecond)
+	first.abandon()
+	assert.True(t, <-done)
+	assert.Equals(t, recorder.Code, http.StatusConflict)
+
+	retry, replayed := beginIdempotentRequest(httptest.NewRecorder(), newIdempotentTestRequest("failure", "10.0.0.1"), "3", &config)
+	assert.False(t, replayed)
+	assert.True(t, retry != nil)
+	retry.accept(OcrResult{ID: "3"})
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	store := &idempotencyStore{requests: make(map[string]*idempotentRequest), now: time.Now}
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	first, ok := store.claim("key", time.Minute)
+	assert.True(t, ok)
+	first.accept(OcrResult{ID: "1"})
+	_, ok = store.claim("key", time.Minute)
+	assert.False(t, ok)
+	now = now.Add(2 * time.Minute)
+	_, ok = store.claim("key", time.Minute)
+	assert.True(t, ok)
+}
+
+func TestIdempotencyKeyIsOptional(t *testing.T) {
+	config := DefaultTestConfig()
+	request, replayed := beginIdempotentRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/ocr", nil), "1", &config)
+	assert.True(t, request == nil)
+	assert.False(t, replayed)
+	// accept and abandon are safe without a key
+	request.accept(OcrResult{})
+	request.abandon()
+}
+
+func TestIdempotentUploadsAndBatches(t *testing.T) {
+	defer acceptRequests(10)()
+	cacheTestResult(pngHeader, "", "cached text")
+	config := DefaultTestConfig()
+	config.ResultCache.TTL = 60
+
+	upload := func() (*httptest.ResponseRecorder, OcrResult) {
+		req := newFormDataRequest(t, map[string]string{"deferred": "true"}, pngHeader)
+		req.Header.Set(IdempotencyKeyHeader, "upload")
+		recorder := httptest.NewRecorder()
+		NewOcrHttpMultipartHandler(&config).ServeHTTP(recorder, req)
+		var ocrResult OcrResult
+		assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &ocrResult) == nil)
+		return recorder, ocrResult
+	}
+	_, first := upload()
+	defer deleteRequestFromQueue(first.ID)
+	recorder, repeated := upload()
+	assert.Equals(t, recorder.Header().Get(IdempotentReplayedHeader), "true")
+	assert.Equals(t, repeated.ID, first.ID)
+
+	image := base64.StdEncoding.EncodeToString(pngHeader)
+	body := `{"requests":[{"img_base64":"` + image + `"},{"img_base64":"` + image + `"}]}`
+	submit := func() (*httptest.ResponseRecorder, BatchStatus) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/batches", strings.NewReader(body))
+		req.Header.Set(IdempotencyKeyHeader, "batch")
+		recorder := httptest.NewRecorder()
+		NewOcrHttpBatchHandler(&config).Submit(recorder, req)
+		var status BatchStatus
+		assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &status) == nil)
+		return recorder, status
+	}
+	recorder, firstBatch := submit()
+	assert.Equals(t, recorder.Code, http.StatusAccepted)
+	recorder, repeatedBatch := submit()
+	assert.Equals(t, recorder.Code, http.StatusAccepted)
+	assert.Equals(t, recorder.Header().Get(IdempotentReplayedHeader), "true")
+	assert.Equals(t, repeatedBatch.ID, firstBatch.ID)
+}
@@ -0,0 +1,209 @@
+package ocrworker
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ImgURLFetchConfig limits the download of img_url. It is used by the http daemon as well as by
+// preprocessors and workers, depending on who is the first to need the image bytes
+type ImgURLFetchConfig struct {
+	// MaxSize is the maximal size of a downloaded file in bytes, 0 means no limit
+	MaxSize int64
+	// Timeout in seconds for the whole download
+	Timeout uint
+	// AllowedSchemes e.g. http, https
+	AllowedSchemes []string
+	// AllowedHosts restricts downloads to the listed host names, a leading dot allows all subdomains
+	// e.g. ".example.com". An empty list allows every host
+	AllowedHosts []string
+}
+
+const defaultImgURLTimeout uint = 60
+
+// DefaultImgURLFetchConfig returns the limits used if no flags are given
+func DefaultImgURLFetchConfig() ImgURLFetchConfig {
+	return ImgURLFetchConfig{
+		MaxSize:        100 * 1024 * 1024,
+		Timeout:        defaultImgURLTimeout,
+		AllowedSchemes: []string{"http", "https"},
+		AllowedHosts:   nil,
+	}
+}
+
+// checkURL verifies that uri is allowed to be fetched
+func (c *ImgURLFetchConfig) checkURL(uri string) (*url.URL, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	schemes := c.AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	if !containsFold(schemes, u.Scheme) {
+		return nil, fmt.Errorf("scheme %q of img_url is not allowed", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if len(c.AllowedHosts) > 0 && !hostMatches(c.AllowedHosts, host) {
+		return nil, fmt.Errorf("host %q of img_url is not allowed", host)
+	}
+	if err = checkOutboundURL(u); err != nil {
+		return nil, fmt.Errorf("img_url: %w", err)
+	}
+	return u, nil
+}
+
+// fetch downloads uri into w and enforces the configured limits, the download is a span of the trace of ctx
+func (c *ImgURLFetchConfig) fetch(ctx context.Context, uri string, w io.Writer) (n int64, err error) {
+	ctx, span := tracer.Start(ctx, "download img_url", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		span.SetAttributes(attribute.Int64("ocr.img_size", n))
+		endSpan(span, err)
+	}()
+	u, err := c.checkURL(uri)
+	if err != nil {
+		return 0, err
+	}
+	span.SetAttributes(semconv.ServerAddress(u.Hostname()))
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultImgURLTimeout
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := outboundHTTPClient(time.Duration(timeout) * time.Second).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			log.Warn().Err(err).Caller().Str("component", "OCR_UTIL").Msg(u.Redacted() + " response body could not be closed")
+		}
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("downloading img_url failed with status %d", resp.StatusCode)
+	}
+	if c.MaxSize > 0 && resp.ContentLength > c.MaxSize {
+		return 0, fmt.Errorf("img_url content length %d exceeds the limit of %d bytes", resp.ContentLength, c.MaxSize)
+	}
+
+	var body io.Reader = resp.Body
+	if c.MaxSize > 0 {
+		body = io.LimitReader(resp.Body, c.MaxSize+1)
+	}
+	n, err = io.Copy(w, body)
+	if err != nil {
+		return n, err
+	}
+	if c.MaxSize > 0 && n > c.MaxSize {
+		return n, fmt.Errorf("img_url content exceeds the limit of %d bytes", c.MaxSize)
+	}
+	return n, nil
+}
+
+// fetchToFile downloads uri into the file fileName
+func (c *ImgURLFetchConfig) fetchToFile(ctx context.Context, uri, fileName string) error {
+	outFile, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer func(outFile *os.File) {
+		err := outFile.Close()
+		if err != nil {
+			log.Warn().Err(err).Caller().Str("component", "OCR_UTIL").Msg(outFile.Name() + " could not be closed")
+		}
+	}(outFile)
+
+	_, err = c.fetch(ctx, uri, outFile)
+	return err
+}
+
+// fetchBytes downloads uri into memory
+func (c *ImgURLFetchConfig) fetchBytes(ctx context.Context, uri string) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := c.fetch(ctx, uri, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// addImgURLFetchFlags registers the img_url download flags. The returned function builds the config
+// and has to be called after flagSet was parsed
+func addImgURLFetchFlags(flagSet *flag.FlagSet) func() ImgURLFetchConfig {
+	defaults := DefaultImgURLFetchConfig()
+	var (
+		maxSize int64
+		timeout uint
+		schemes string
+		hosts   string
+	)
+	flagSet.Int64Var(
+		&maxSize,
+		"img_url_max_size",
+		defaults.MaxSize,
+		"Maximal size in bytes of a file downloaded from img_url, 0 disables the limit",
+	)
+	flagSet.UintVar(
+		&timeout,
+		"img_url_timeout",
+		defaults.Timeout,
+		"Timeout in seconds for downloading a file from img_url",
+	)
+	flagSet.StringVar(
+		&schemes,
+		"img_url_schemes",
+		strings.Join(defaults.AllowedSchemes, ","),
+		"Comma separated list of URL schemes allowed for img_url",
+	)
+	flagSet.StringVar(
+		&hosts,
+		"img_url_hosts",
+		"",
+		"Comma separated list of hosts allowed for img_url, a leading dot allows subdomains e.g. .example.com. Empty allows all hosts",
+	)
+	return func() ImgURLFetchConfig {
+		fetchConfig := defaults
+		fetchConfig.MaxSize = maxSize
+		fetchConfig.Timeout = timeout
+		fetchConfig.AllowedSchemes = splitCommaList(schemes)
+		fetchConfig.AllowedHosts = splitCommaList(hosts)
+		return fetchConfig
+	}
+}
+
+func splitCommaList(list string) []string {
+	var result []string
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			result = append(result, element)
+		}
+	}
+	return result
+}
+
+func containsFold(list []string, value string) bool {
+	for _, element := range list {
+		if strings.EqualFold(element, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package ocrworker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestImgURLFetchCheckURL(t *testing.T) {
+	fetchConfig := ImgURLFetchConfig{
+		AllowedSchemes: []string{"https"},
+		AllowedHosts:   []string{"images.example.com", ".cdn.example.org"},
+	}
+	_, err := fetchConfig.checkURL("https://images.example.com/a.png")
+	assert.True(t, err == nil)
+	_, err = fetchConfig.checkURL("https://eu.cdn.example.org/a.png")
+	assert.True(t, err == nil)
+	_, err = fetchConfig.checkURL("http://images.example.com/a.png")
+	assert.True(t, err != nil)
+	_, err = fetchConfig.checkURL("https://example.com/a.png")
+	assert.True(t, err != nil)
+	_, err = fetchConfig.checkURL("file:///etc/passwd")
+	assert.True(t, err != nil)
+}
+
+func TestImgURLFetchMaxSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(strings.Repeat("x", 1024)))
+	}))
+	defer server.Close()
+	defer withOutboundConfig(t, OutboundConfig{AllowInternal: true, MaxRedirects: defaultMaxRedirects})()
+
+	fetchConfig := DefaultImgURLFetchConfig()
+	content, err := fetchConfig.fetchBytes(context.Background(), server.URL+"/img")
+	assert.True(t, err == nil)
+	assert.Equals(t, len(content), 1024)
+
+	fetchConfig.MaxSize = 512
+	_, err = fetchConfig.fetchBytes(context.Background(), server.URL+"/img")
+	assert.True(t, err != nil)
+
+	fetchConfig.MaxSize = 0
+	_, err = fetchConfig.fetchBytes(context.Background(), server.URL+"/missing")
+	assert.True(t, err != nil)
+}
@@ -0,0 +1,224 @@
+package ocrworker
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+)
+
+// states of a job reported by GET /jobs/{id}/events
+const (
+	JobQueued        = "queued"
+	JobPreprocessing = "preprocessing"
+	JobProcessing    = "processing"
+	JobCompleted     = "completed"
+	JobDelivered     = "delivered"
+	JobFailed        = "failed"
+)
+
+const (
+	// jobEventMessageType marks progress messages in the callback queue of a request, the result has no type
+	jobEventMessageType = "progress"
+	// jobEventRetention is the time the events of a finished job are kept for late subscribers
+	jobEventRetention = 5 * time.Minute
+	// jobEventBuffer is the number of events a subscriber may lag behind before it is disconnected
+	jobEventBuffer = 32
+)
+
+// JobEvent is a state change of a job
+type JobEvent struct {
+	// Seq numbers the events of a job starting with 1, it is the id of the server-sent event
+	Seq          uint      `json:"seq"`
+	ID           string    `json:"id"`
+	State        string    `json:"state"`
+	Preprocessor string    `json:"preprocessor,omitempty"`
+	Message      string    `json:"message,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+func (e *JobEvent) terminal() bool {
+	return e.State == JobDelivered || e.State == JobFailed
+}
+
+// resultEvent returns the event for a result received from a worker
+func resultEvent(ocrResult *OcrResult) JobEvent {
+	if ocrResult.Status == "error" {
+		return JobEvent{ID: ocrResult.ID, State: JobFailed, Message: ocrResult.Text}
+	}
+	return JobEvent{ID: ocrResult.ID, State: JobCompleted}
+}
+
+// jobEventLog keeps the events of a job and its subscribers
+type jobEventLog struct {
+	tenant      string
+	history     []JobEvent
+	subscribers map[chan JobEvent]struct{}
+	finished    bool
+	// expires is when the log is removed, it is extended while the job may still produce events
+	expires time.Time
+}
+
+// jobEventHub collects the events of the jobs of this http daemon
+type jobEventHub struct {
+	mu     sync.Mutex
+	jobs   map[string]*jobEventLog
+	pruner sync.Once
+	now    func() time.Time
+}
+
+var jobEvents = &jobEventHub{jobs: make(map[string]*jobEventLog), now: time.Now}
+
+// open starts the event log of a job, events of jobs which weren't opened are ignored
+func (h *jobEventHub) open(requestID, tenant string, expires time.Time) {
+	h.pruner.Do(func() {
+		go func() {
+			for range time.Tick(time.Minute) {
+				h.prune()
+			}
+		}()
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.jobs[requestID] = &jobEventLog{
+		tenant:      tenant,
+		subscribers: make(map[chan JobEvent]struct{}),
+		expires:     expires.Add(jobEventRetention),
+	}
+}
+
+// keepUntil extends the life of the event log, e.g. while the result is still being delivered
+func (h *jobEventHub) keepUntil(requestID string, until time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if job, ok := h.jobs[requestID]; ok && !job.finished && until.Add(jobEventRetention).After(job.expires) {
+		job.expires = until.Add(jobEventRetention)
+	}
+}
+
+// publish appends event to the log of its job and passes it to the subscribers. A terminal event ends
+// the subscriptions
+func (h *jobEventHub) publish(event JobEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	job, ok := h.jobs[event.ID]
+	if !ok || job.finished {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = h.now()
+	}
+	event.Seq = uint(len(job.history) + 1)
+	job.history = append(job.history, event)
+	for subscriber := range job.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			// the subscriber is too slow, it can reconnect with Last-Event-ID
+			delete(job.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+	if event.terminal() {
+		job.finished = true
+		job.expires = h.now().Add(jobEventRetention)
+		for subscriber := range job.subscribers {
+			close(subscriber)
+		}
+		job.subscribers = nil
+	}
+}
+
+// subscribe returns the events of a job after seq and a channel for the following events. The channel
+// is closed after the terminal event. It is nil if the job is finished already
+func (h *jobEventHub) subscribe(requestID string, after uint) (string, []JobEvent, chan JobEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	job, ok := h.jobs[requestID]
+	if !ok {
+		return "", nil, nil, false
+	}
+	var history []JobEvent
+	if after < uint(len(job.history)) {
+		history = append(history, job.history[after:]...)
+	}
+	if job.finished {
+		return job.tenant, history, nil, true
+	}
+	subscriber := make(chan JobEvent, jobEventBuffer)
+	job.subscribers[subscriber] = struct{}{}
+	return job.tenant, history, subscriber, true
+}
+
+// lastState returns the state of the latest event of a job
+func (h *jobEventHub) lastState(requestID string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	job, ok := h.jobs[requestID]
+	if !ok || len(job.history) == 0 {
+		return "", false
+	}
+	return job.history[len(job.history)-1].State, true
+}
+
+// unsubscribe has to be called if the subscriber leaves before the channel is closed
+func (h *jobEventHub) unsubscribe(requestID string, subscriber chan JobEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if job, ok := h.jobs[requestID]; ok {
+		if _, ok := job.subscribers[subscriber]; ok {
+			delete(job.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+func (h *jobEventHub) prune() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	for requestID, job := range h.jobs {
+		if now.After(job.expires) {
+			for subscriber := range job.subscribers {
+				close(subscriber)
+			}
+			delete(h.jobs, requestID)
+		}
+	}
+}
+
+// publishJobEvent sends a progress message to the callback queue of the delivery. Progress is best
+// effort, a failure is logged and doesn't affect the job
+func publishJobEvent(channel *amqp.Channel, exchange string, d *amqp.Delivery, event JobEvent) {
+	if d.ReplyTo == "" {
+		return
+	}
+	event.ID = d.CorrelationId
+	event.Time = time.Now()
+	body, err := json.Marshal(event)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = channel.PublishWithContext(
+			ctx,
+			exchange,  // publish to an exchange
+			d.ReplyTo, // routing to the callback queue of the client
+			false,     // mandatory
+			false,     // immediate
+			amqp.Publishing{
+				ContentType:   "application/json",
+				Type:          jobEventMessageType,
+				Body:          body,
+				DeliveryMode:  amqp.Transient, // 1=non-persistent, 2=persistent
+				CorrelationId: d.CorrelationId,
+			},
+		)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("RequestID", d.CorrelationId).Str("state", event.State).
+			Msg("progress of job could not be published")
+	}
+}
@@ -0,0 +1,107 @@
+package ocrworker
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestJobEventHub(t *testing.T) {
+	hub := &jobEventHub{jobs: make(map[string]*jobEventLog), now: time.Now}
+	hub.publish(JobEvent{ID: "unknown", State: JobQueued})
+	_, _, _, ok := hub.subscribe("unknown", 0)
+	assert.False(t, ok)
+
+	hub.open("1", "tenant-a", time.Now().Add(time.Minute))
+	hub.publish(JobEvent{ID: "1", State: JobQueued})
+	hub.publish(JobEvent{ID: "1", State: JobPreprocessing, Preprocessor: PreprocessorIdentity})
+
+	tenant, history, events, ok := hub.subscribe("1", 1)
+	assert.True(t, ok)
+	assert.Equals(t, tenant, "tenant-a")
+	assert.Equals(t, len(history), 1)
+	assert.Equals(t, history[0].Seq, uint(2))
+	assert.Equals(t, history[0].Preprocessor, PreprocessorIdentity)
+
+	hub.publish(JobEvent{ID: "1", State: JobProcessing})
+	hub.publish(resultEvent(&OcrResult{ID: "1", Status: "done"}))
+	hub.publish(JobEvent{ID: "1", State: JobDelivered})
+	// events after the terminal one are ignored
+	hub.publish(JobEvent{ID: "1", State: JobFailed})
+
+	var states []string
+	for event := range events {
+		states = append(states, event.State)
+	}
+	assert.DeepEquals(t, states, []string{JobProcessing, JobCompleted, JobDelivered})
+
+	_, history, events, ok = hub.subscribe("1", 0)
+	assert.True(t, ok)
+	assert.Equals(t, len(history), 5)
+	assert.True(t, events == nil)
+
+	hub.now = func() time.Time { return time.Now().Add(jobEventRetention + time.Second) }
+	hub.prune()
+	_, _, _, ok = hub.subscribe("1", 0)
+	assert.False(t, ok)
+}
+
+func TestJobEventHubDropsSlowSubscriber(t *testing.T) {
+	hub := &jobEventHub{jobs: make(map[string]*jobEventLog), now: time.Now}
+	hub.open("1", "", time.Now().Add(time.Minute))
+	_, _, events, _ := hub.subscribe("1", 0)
+	for i := 0; i <= jobEventBuffer; i++ {
+		hub.publish(JobEvent{ID: "1", State: JobPreprocessing, Preprocessor: "identity"})
+	}
+	received := 0
+	for range events {
+		received++
+	}
+	assert.Equals(t, received, jobEventBuffer)
+}
+
+func TestJobEventsHandler(t *testing.T) {
+	jobEvents.open("events-1", "tenant-a", time.Now().Add(time.Minute))
+	jobEvents.publish(JobEvent{ID: "events-1", State: JobQueued})
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /jobs/{id}/events", NewJobEventsHandler())
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/jobs/events-1/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	assert.True(t, err == nil)
+	assert.Equals(t, resp.Header.Get("Content-Type"), "text/event-stream")
+
+	jobEvents.publish(JobEvent{ID: "events-1", State: JobProcessing})
+	jobEvents.publish(JobEvent{ID: "events-1", State: JobFailed, Message: "engine failed"})
+	// the stream ends with the terminal event
+	body, err := io.ReadAll(resp.Body)
+	assert.True(t, err == nil)
+	_ = resp.Body.Close()
+	stream := string(body)
+	assert.True(t, strings.Contains(stream, "id: 1\nevent: queued\n"))
+	assert.True(t, strings.Contains(stream, "id: 2\nevent: processing\n"))
+	assert.True(t, strings.Contains(stream, "id: 3\nevent: failed\ndata: {\"seq\":3,\"id\":\"events-1\",\"state\":\"failed\",\"message\":\"engine failed\""))
+
+	resp, err = http.Get(server.URL + "/jobs/unknown/events")
+	assert.True(t, err == nil)
+	assert.Equals(t, resp.StatusCode, http.StatusNotFound)
+	_ = resp.Body.Close()
+
+	// jobs of other tenants are not found
+	req = httptest.NewRequest("GET", "/jobs/events-1/events", nil)
+	req = req.WithContext(withPrincipal(req.Context(), &Principal{Tenant: "tenant-b", Scopes: defaultScopes}))
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	assert.Equals(t, recorder.Code, http.StatusNotFound)
+}
@@ -0,0 +1,265 @@
+package ocrworker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// jwksRefreshInterval is the maximal age of a JWKS fetched from an url. The JWKS is refreshed in the
+	// background, requests never wait for the identity provider
+	jwksRefreshInterval = 15 * time.Minute
+	jwksFetchTimeout    = 10 * time.Second
+)
+
+// jwtAlgorithms are the accepted signature algorithms. Symmetric algorithms must never be used to verify
+// tokens of an external issuer and "none" is never accepted
+var jwtAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// JWTConfig configures the validation of bearer tokens. Tokens are only accepted if JWKSFile or JWKSURL is set
+type JWTConfig struct {
+	// Issuer and Audience have to match the iss and aud claims if set
+	Issuer   string
+	Audience string
+	// JWKSFile or JWKSURL provide the public keys of the identity provider
+	JWKSFile string
+	JWKSURL  string
+	// ClockSkew is tolerated for exp, nbf and iat
+	ClockSkew time.Duration
+	// TenantClaim and ScopeClaim name the claims which are mapped to the tenant and the scopes of the client
+	TenantClaim string
+	ScopeClaim  string
+}
+
+// Enabled reports whether bearer tokens should be validated
+func (c *JWTConfig) Enabled() bool {
+	return c.JWKSFile != "" || c.JWKSURL != ""
+}
+
+// addJWTFlags registers the bearer token flags. The returned function builds the config
+// and has to be called after flagSet was parsed
+func addJWTFlags(flagSet *flag.FlagSet) func() JWTConfig {
+	var (
+		issuer      string
+		audience    string
+		jwksFile    string
+		jwksURL     string
+		clockSkew   uint
+		tenantClaim string
+		scopeClaim  string
+	)
+	flagSet.StringVar(&issuer, "jwt_issuer", "", "Required iss claim of bearer tokens")
+	flagSet.StringVar(&audience, "jwt_audience", "", "Required aud claim of bearer tokens")
+	flagSet.StringVar(&jwksFile, "jwt_jwks_file", "", "Path to a JWKS file with the public keys for bearer tokens, enables bearer token authentication")
+	flagSet.StringVar(&jwksURL, "jwt_jwks_url", "", "URL of the JWKS with the public keys for bearer tokens, enables bearer token authentication")
+	flagSet.UintVar(&clockSkew, "jwt_clock_skew", 60, "Tolerated clock skew in seconds for the exp, nbf and iat claims")
+	flagSet.StringVar(&tenantClaim, "jwt_tenant_claim", "tenant", "Claim which holds the tenant of the client")
+	flagSet.StringVar(&scopeClaim, "jwt_scope_claim", "scope", "Claim which holds the scopes of the client, a space separated string or a list")
+	return func() JWTConfig {
+		return JWTConfig{
+			Issuer:      issuer,
+			Audience:    audience,
+			JWKSFile:    jwksFile,
+			JWKSURL:     jwksURL,
+			ClockSkew:   time.Duration(clockSkew) * time.Second,
+			TenantClaim: tenantClaim,
+			ScopeClaim:  scopeClaim,
+		}
+	}
+}
+
+// JWTAuth authenticates requests by a bearer token signed by one of the keys of a JWKS
+type JWTAuth struct {
+	config JWTConfig
+	keys   keyfunc.Keyfunc
+	parser *jwt.Parser
+	stop   context.CancelFunc
+}
+
+// NewJWTAuth loads the JWKS of config. A JWKS fetched from an url is refreshed in the background
+// every jwksRefreshInterval, a failed refresh keeps the old keys
+func NewJWTAuth(config JWTConfig) (*JWTAuth, error) {
+	if !config.Enabled() {
+		return nil, errors.New("neither a JWKS file nor a JWKS url is configured")
+	}
+	if config.TenantClaim == "" {
+		config.TenantClaim = "tenant"
+	}
+	if config.ScopeClaim == "" {
+		config.ScopeClaim = "scope"
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	storage, err := newJWKSStorage(ctx, config)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	keys, err := keyfunc.New(keyfunc.Options{
+		Storage: storage,
+		// keys without use are accepted, keys for encryption are not
+		UseWhitelist: []jwkset.USE{jwkset.UseSig, ""},
+	})
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtAlgorithms),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(config.ClockSkew),
+	}
+	if config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		options = append(options, jwt.WithAudience(config.Audience))
+	}
+	return &JWTAuth{config: config, keys: keys, parser: jwt.NewParser(options...), stop: stop}, nil
+}
+
+// Close stops refreshing the JWKS
+func (a *JWTAuth) Close() {
+	a.stop()
+}
+
+// newJWKSStorage reads the JWKS file or fetches the JWKS from the url, the url is fetched once before
+// the http daemon starts and then only by the refresh goroutine, which runs until ctx is done
+func newJWKSStorage(ctx context.Context, config JWTConfig) (jwkset.Storage, error) {
+	if config.JWKSFile != "" {
+		content, err := os.ReadFile(config.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := keyfunc.NewJWKSetJSON(content)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse JWKS: %w", err)
+		}
+		return keys.Storage(), nil
+	}
+	jwksURL := config.JWKSURL
+	storage, err := jwkset.NewStorageFromHTTP(jwksURL, jwkset.HTTPClientStorageOptions{
+		Client:          &http.Client{Timeout: jwksFetchTimeout},
+		Ctx:             ctx,
+		HTTPTimeout:     jwksFetchTimeout,
+		RefreshInterval: jwksRefreshInterval,
+		RefreshErrorHandler: func(_ context.Context, err error) {
+			log.Error().Err(err).Str("component", "OCR_AUTH").Msg("can't refresh JWKS, keeping the old keys")
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch JWKS: %w", err)
+	}
+	// without RefreshUnknownKID a token with an unknown key id is rejected instead of fetching the JWKS
+	return jwkset.NewHTTPClient(jwkset.HTTPClientOptions{HTTPURLs: map[string]jwkset.Storage{jwksURL: storage}})
+}
+
+// Wrap returns a handler which only passes requests with a valid bearer token to next
+func (a *JWTAuth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, _ := bearerToken(req)
+		principal, err := a.Verify(token)
+		if err != nil {
+			log.Warn().Err(err).Str("component", "OCR_AUTH").Str("RemoteAddr", req.RemoteAddr).
+				Str("path", req.URL.Path).Msg("request without valid bearer token")
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeRejection(w, http.StatusUnauthorized, "", RejectUnauthorized, "missing or invalid bearer token", 0)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(withPrincipal(req.Context(), principal)))
+	})
+}
+
+// Verify checks signature and claims of token and returns the client it was issued for
+func (a *JWTAuth) Verify(token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.keyfunc); err != nil {
+		return nil, err
+	}
+
+	principal := &Principal{ClientID: claimString(claims, "sub")}
+	if principal.ClientID == "" {
+		principal.ClientID = claimString(claims, "azp")
+	}
+	// the client id is the tenant of tokens without tenant claim
+	if principal.ClientID == "" {
+		return nil, errors.New("token has neither a sub nor an azp claim")
+	}
+	principal.Tenant = claimString(claims, a.config.TenantClaim)
+	principal.Scopes = claimList(claims, a.config.ScopeClaim)
+	return principal, nil
+}
+
+// keyfunc returns the key of the JWKS for the kid of token, or all keys if the token has no kid
+func (a *JWTAuth) keyfunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Header["crit"]; ok {
+		return nil, errors.New("critical header extensions are not supported")
+	}
+	key, err := a.keys.Keyfunc(token)
+	if err != nil {
+		return nil, err
+	}
+	keySet, ok := key.(jwt.VerificationKeySet)
+	if !ok {
+		return key, checkVerificationKey(key)
+	}
+	usable := jwt.VerificationKeySet{}
+	for _, key := range keySet.Keys {
+		if checkVerificationKey(key) == nil {
+			usable.Keys = append(usable.Keys, key)
+		}
+	}
+	if len(usable.Keys) == 0 {
+		return nil, errors.New("JWKS contains no usable keys")
+	}
+	return usable, nil
+}
+
+// checkVerificationKey only accepts public RSA keys of at least 2048 bits and EC keys
+func checkVerificationKey(key interface{}) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < 2048 {
+			return errors.New("RSA keys shorter than 2048 bits are not accepted")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		return nil
+	}
+	return fmt.Errorf("keys of type %T are not accepted", key)
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// claimList reads a claim which is either a space separated string or a list of strings
+func claimList(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var list []string
+		for _, element := range value {
+			if s, ok := element.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package ocrworker
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func padded(i *big.Int, size int) []byte {
+	return i.FillBytes(make([]byte, size))
+}
+
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	fields := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		fields["kid"] = kid
+	}
+	header, _ := json.Marshal(fields)
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if alg == "PS256" {
+			signature, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		signature = append(padded(r, 32), padded(s, 32)...)
+	}
+	assert.True(t, err == nil)
+	return signed + "." + b64(signature)
+}
+
+func testJWKS(rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) []byte {
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(padded(ecKey.X, 32)), "y": b64(padded(ecKey.Y, 32))},
+		{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+	}}
+	content, _ := json.Marshal(jwks)
+	return content
+}
+
+func newTestJWTAuth(t *testing.T) (*JWTAuth, *rsa.PrivateKey, *ecdsa.PrivateKey) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.True(t, err == nil)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.True(t, err == nil)
+
+	content := testJWKS(rsaKey, ecKey)
+	fileName := filepath.Join(t.TempDir(), "jwks.json")
+	assert.True(t, os.WriteFile(fileName, content, 0o600) == nil)
+
+	jwtAuth, err := NewJWTAuth(JWTConfig{
+		Issuer:    "https://idp.example.com",
+		Audience:  "open-ocr",
+		JWKSFile:  fileName,
+		ClockSkew: time.Minute,
+	})
+	assert.True(t, err == nil)
+	return jwtAuth, rsaKey, ecKey
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    "https://idp.example.com",
+		"aud":    []string{"other", "open-ocr"},
+		"sub":    "client1",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"iat":    time.Now().Unix(),
+		"tenant": "acme",
+		"scope":  "submit read-status",
+	}
+}
+
+func TestJWTAuthVerify(t *testing.T) {
+	jwtAuth, rsaKey, ecKey := newTestJWTAuth(t)
+
+	for _, token := range []string{
+		signTestJWT(t, "RS256", "rsa1", rsaKey, validClaims()),
+		signTestJWT(t, "PS256", "rsa1", rsaKey, validClaims()),
+		signTestJWT(t, "ES256", "ec1", ecKey, validClaims()),
+		signTestJWT(t, "ES256", "", ecKey, validClaims()),
+	} {
+		principal, err := jwtAuth.Verify(token)
+		assert.True(t, err == nil)
+		assert.Equals(t, principal.ClientID, "client1")
+		assert.Equals(t, principal.Tenant, "acme")
+		assert.True(t, principal.HasScope(ScopeSubmit))
+		assert.False(t, principal.HasScope(ScopeAdmin))
+	}
+}
+
+func TestJWTAuthRejects(t *testing.T) {
+	jwtAuth, rsaKey, ecKey := newTestJWTAuth(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.True(t, err == nil)
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+	notYetValid := validClaims()
+	notYetValid["nbf"] = time.Now().Add(2 * time.Minute).Unix()
+	wrongIssuer := validClaims()
+	wrongIssuer["iss"] = "https://evil.example.com"
+	wrongAudience := validClaims()
+	wrongAudience["aud"] = "other"
+	noExp := validClaims()
+	delete(noExp, "exp")
+	noClient := validClaims()
+	delete(noClient, "sub")
+
+	header, _ := json.Marshal(map[string]string{"alg": "none"})
+	payload, _ := json.Marshal(validClaims())
+
+	for _, token := range []string{
+		"",
+		"not.a.token",
+		b64(header) + "." + b64(payload) + ".",
+		signTestJWT(t, "RS256", "rsa1", otherKey, validClaims()),
+		signTestJWT(t, "RS256", "ec1", rsaKey, validClaims()),
+		signTestJWT(t, "ES256", "rsa1", ecKey, validClaims()),
+		signTestJWT(t, "RS256", "rsa1", rsaKey, expired),
+		signTestJWT(t, "RS256", "rsa1", rsaKey, notYetValid),
+		signTestJWT(t, "RS256", "rsa1", rsaKey, wrongIssuer),
+		signTestJWT(t, "RS256", "rsa1", rsaKey, wrongAudience),
+		signTestJWT(t, "RS256", "rsa1", rsaKey, noExp),
+		signTestJWT(t, "RS256", "rsa1", rsaKey, noClient),
+	} {
+		_, err := jwtAuth.Verify(token)
+		assert.True(t, err != nil)
+	}
+
+	// within the clock skew
+	almostExpired := validClaims()
+	almostExpired["exp"] = time.Now().Add(-30 * time.Second).Unix()
+	_, err = jwtAuth.Verify(signTestJWT(t, "RS256", "rsa1", rsaKey, almostExpired))
+	assert.True(t, err == nil)
+}
+
+func TestJWTAuthJWKSURL(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.True(t, err == nil)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.True(t, err == nil)
+	var fetched atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/jwks.json" {
+			http.NotFound(w, req)
+			return
+		}
+		fetched.Add(1)
+		_, _ = w.Write(testJWKS(rsaKey, ecKey))
+	}))
+	defer server.Close()
+
+	jwtAuth, err := NewJWTAuth(JWTConfig{JWKSURL: server.URL + "/jwks.json"})
+	assert.True(t, err == nil)
+	defer jwtAuth.Close()
+	_, err = jwtAuth.Verify(signTestJWT(t, "RS256", "rsa1", rsaKey, validClaims()))
+	assert.True(t, err == nil)
+	// an unknown kid doesn't make the request wait for the identity provider
+	_, err = jwtAuth.Verify(signTestJWT(t, "RS256", "rsa2", rsaKey, validClaims()))
+	assert.True(t, err != nil)
+	assert.Equals(t, fetched.Load(), int32(1))
+
+	// the daemon doesn't start without the keys
+	_, err = NewJWTAuth(JWTConfig{JWKSURL: server.URL + "/missing.json"})
+	assert.True(t, err != nil)
+}
+
+func TestAuthChainScopes(t *testing.T) {
+	jwtAuth, rsaKey, _ := newTestJWTAuth(t)
+	apiKeyStore, err := NewAPIKeyStore([]APIKey{{Key: "secret", ClientID: "client2"}})
+	assert.True(t, err == nil)
+	authenticate := NewAuthChain(NewAPIKeyAuth(apiKeyStore), jwtAuth)
+	handler := authenticate(RequireScope(ScopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})))
+
+	admin := validClaims()
+	admin["scope"] = []string{ScopeAdmin}
+	for token, code := range map[string]int{
+		signTestJWT(t, "RS256", "rsa1", rsaKey, admin):         http.StatusOK,
+		signTestJWT(t, "RS256", "rsa1", rsaKey, validClaims()): http.StatusForbidden,
+		"invalid": http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equals(t, recorder.Code, code)
+	}
+
+	// api keys get submit and read-status by default
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(APIKeyHeader, "secret")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equals(t, recorder.Code, http.StatusForbidden)
+
+	// without authentication every request is passed
+	handler = NewAuthChain(nil, nil)(RequireScope(ScopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	assert.Equals(t, recorder.Code, http.StatusOK)
+}
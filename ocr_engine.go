@@ -1,10 +1,12 @@
 package ocrworker
 
 import (
+	"context"
 	"encoding/json"
 	"strings"
 
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type OcrEngineType int
@@ -16,8 +18,10 @@ const (
 	EngineMock
 )
 
+// OcrEngine processes a single request. Implementations have to stop all work, including external
+// commands, as soon as ctx is done
 type OcrEngine interface {
-	ProcessRequest(ocrRequest *OcrRequest, workerConfig *WorkerConfig) (OcrResult, error)
+	ProcessRequest(ctx context.Context, ocrRequest *OcrRequest, workerConfig *WorkerConfig) (OcrResult, error)
 }
 
 func NewOcrEngine(engineType OcrEngineType) OcrEngine {
@@ -32,6 +36,17 @@ func NewOcrEngine(engineType OcrEngineType) OcrEngine {
 	return nil
 }
 
+// processRequest runs the engine of ocrRequest in a span, the external commands of the engine are spans below it
+func processRequest(ctx context.Context, ocrRequest *OcrRequest, workerConfig *WorkerConfig) (OcrResult, error) {
+	ocrEngine := NewOcrEngine(ocrRequest.EngineType)
+	ctx, span := tracer.Start(ctx, "engine "+ocrRequest.EngineType.String(), trace.WithAttributes(
+		requestIDAttribute.String(ocrRequest.RequestID),
+	))
+	ocrResult, err := ocrEngine.ProcessRequest(ctx, ocrRequest, workerConfig)
+	endSpan(span, err)
+	return ocrResult, err
+}
+
 func (e OcrEngineType) String() string {
 	switch e {
 	case EngineMock:
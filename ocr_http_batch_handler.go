@@ -0,0 +1,263 @@
+package ocrworker
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// reasons for rejecting a request to the batch end points
+const (
+	RejectBatchNotFound = "batch_not_found"
+	RejectBatchTooLarge = "batch_too_large"
+)
+
+// OcrHttpBatchHandler accepts many requests in one call. Submit admits the whole batch or nothing, Status
+// reports the state of its requests and Results returns the finished results as JSON lines or a zip archive.
+// Status and Results expect the id of the batch as {id} in the path
+type OcrHttpBatchHandler struct {
+	rabbitConfig *RabbitConfig
+}
+
+func NewOcrHttpBatchHandler(config *RabbitConfig) *OcrHttpBatchHandler {
+	return &OcrHttpBatchHandler{rabbitConfig: config}
+}
+
+func (s *OcrHttpBatchHandler) Submit(w http.ResponseWriter, req *http.Request) {
+	batchID := ksuid.New().String()
+	// a repeated batch is answered even if the service is busy
+	idempotency, replayed := beginIdempotentRequest(w, req, batchID, currentConfig(s.rabbitConfig))
+	if replayed {
+		return
+	}
+	defer idempotency.abandon()
+
+	var batchRequest BatchRequest
+	observeRequestSize := limitRequestBody(w, req, &s.rabbitConfig.Upload)
+	err := json.NewDecoder(req.Body).Decode(&batchRequest)
+	observeRequestSize()
+	if isRequestTooLarge(err) {
+		log.Warn().Str("component", "OCR_BATCH").Err(err).Str("BatchID", batchID).Msg("request body is too large")
+		writeRequestTooLarge(w, batchID, &s.rabbitConfig.Upload)
+		return
+	}
+	if err != nil {
+		log.Warn().Str("component", "OCR_BATCH").Err(err).Str("BatchID", batchID).Msg("did the client send a valid json?")
+		writeAPIError(w, req, http.StatusBadRequest, batchID, "Unable to unmarshal json, malformed request. BatchID "+batchID)
+		return
+	}
+	if s.admit(w, req, batchID, batchRequest) {
+		idempotency.acceptBatch(batchID)
+	}
+}
+
+// admit checks the whole batch against the limits of the client and the capacity and starts publishing its
+// requests. It returns false if the batch was rejected, the rejection is written to w
+func (s *OcrHttpBatchHandler) admit(w http.ResponseWriter, req *http.Request, batchID string, batchRequest BatchRequest) (admitted bool) {
+	_, span := tracer.Start(req.Context(), "admission", trace.WithAttributes(
+		attribute.String("ocr.batch_id", batchID),
+		attribute.Int("ocr.batch_size", len(batchRequest.Requests)),
+	))
+	defer func() { endAdmissionSpan(span, admitted) }()
+	rabbitConfig := currentConfig(s.rabbitConfig)
+	tenant := tenantFromPrincipal(principalFromContext(req.Context()))
+	clientID := clientIDFromRequest(req)
+	ServiceCanAcceptMu.Lock()
+	serviceCanAcceptLocal := ServiceCanAccept
+	appStopLocal := AppStop
+	ServiceCanAcceptMu.Unlock()
+	if reason := rejectReason(serviceCanAcceptLocal, appStopLocal); reason != "" {
+		span.SetAttributes(rejectReasonAttribute.String(reason))
+		tenantRequests.WithLabelValues(tenantLabel(tenant), reason).Inc()
+		writeAdmissionError(w, batchID, reason, clientID)
+		return false
+	}
+
+	total := len(batchRequest.Requests)
+	if total == 0 {
+		writeAPIError(w, req, http.StatusBadRequest, batchID, "batch contains no requests. BatchID "+batchID)
+		return false
+	}
+	if rabbitConfig.MaxBatchSize > 0 && uint(total) > rabbitConfig.MaxBatchSize {
+		writeRejection(w, http.StatusRequestEntityTooLarge, batchID, RejectBatchTooLarge,
+			fmt.Sprintf("batch exceeds the limit of %d requests. BatchID %s", rabbitConfig.MaxBatchSize, batchID), 0)
+		return false
+	}
+	// every request of the batch costs a token of the rate limit
+	if !chargeRateLimit(w, req, batchID, uint(total)) {
+		span.SetAttributes(rejectReasonAttribute.String(RejectRateLimited))
+		tenantRequests.WithLabelValues(tenantLabel(tenant), RejectRateLimited).Inc()
+		return false
+	}
+	if batchRequest.ReplyTo != "" {
+		validURL, err := checkURLForReplyTo(batchRequest.ReplyTo)
+		if err != nil {
+			writeAPIError(w, req, http.StatusBadRequest, batchID, "reply_to is not valid: "+err.Error()+". BatchID "+batchID)
+			return false
+		}
+		batchRequest.ReplyTo = validURL
+	}
+
+	// every request has to pass the limits of the client before any of them is admitted
+	apiKey := apiKeyFromContext(req.Context())
+	b := &batch{id: batchID, tenant: tenant, replyTo: batchRequest.ReplyTo, items: make([]BatchItem, total),
+		traceParent: trace.SpanContextFromContext(req.Context())}
+	requestIDs := make([]string, total)
+	for i := range batchRequest.Requests {
+		ocrRequest := &batchRequest.Requests[i]
+		ocrRequest.assignRequestID(ksuid.New().String())
+		ocrRequest.ClientID = clientID
+		ocrRequest.Tenant = tenant
+		if httpStatus, reason, err := ocrRequest.applyAPIKey(apiKey); err != nil {
+			log.Warn().Err(err).Str("component", "OCR_BATCH").Str("BatchID", batchID).Int("index", i).
+				Str("ClientID", clientID).Str("reason", reason).Msg("batch violates the limits of the client")
+			tenantRequests.WithLabelValues(tenantLabel(tenant), reason).Inc()
+			span.SetAttributes(rejectReasonAttribute.String(reason))
+			writeRejection(w, httpStatus, batchID, reason, fmt.Sprintf("request %d: %v. BatchID %s", i, err, batchID), 0)
+			return false
+		}
+		// results are collected by the batch and delivered together
+		ocrRequest.ReplyTo = ""
+		ocrRequest.Deferred = true
+		ocrRequest.InplaceDecode = false
+		ocrRequest.batchID = batchID
+		ocrRequest.batchIndex = i
+		ocrRequest.traceParent = trace.SpanContextFromContext(req.Context())
+		b.postbackClientID = ocrRequest.postbackClientID
+		b.items[i] = BatchItem{Index: i, ID: ocrRequest.RequestID, ReferenceID: ocrRequest.ReferenceID, State: JobQueued}
+		requestIDs[i] = ocrRequest.RequestID
+	}
+	clientID = batchRequest.Requests[0].ClientID
+
+	if limit := clientLimit(apiKey, rabbitConfig); limit > 0 && !clientShares.acquireAll(clientID, requestIDs, limit) {
+		tenantRequests.WithLabelValues(tenantLabel(tenant), RejectClientShareExceeded).Inc()
+		span.SetAttributes(rejectReasonAttribute.String(RejectClientShareExceeded))
+		writeAdmissionError(w, batchID, RejectClientShareExceeded, clientID)
+		return false
+	}
+	if !reserveSlots(uint(total)) {
+		for _, requestID := range requestIDs {
+			clientShares.release(requestID)
+		}
+		tenantRequests.WithLabelValues(tenantLabel(tenant), RejectQueueFull).Inc()
+		span.SetAttributes(rejectReasonAttribute.String(RejectQueueFull))
+		writeAdmissionError(w, batchID, RejectQueueFull, clientID)
+		return false
+	}
+	for _, requestID := range requestIDs {
+		tenantLoad.acquire(tenant, requestID, math.MaxUint)
+	}
+	tenantRequests.WithLabelValues(tenantLabel(tenant), "accepted").Add(float64(total))
+	batches.add(b)
+	log.Info().Str("component", "OCR_BATCH").Str("BatchID", batchID).Int("total", total).
+		Str("HTTPRequestID", requestIDFromContext(req.Context())).
+		Str("ClientID", clientID).Str("Tenant", tenant).Msg("batch accepted")
+
+	go s.publish(batchID, batchRequest.Requests, rabbitConfig)
+
+	status, _, _ := batches.status(batchID)
+	w.Header().Set("Location", APIPrefix+"/batches/"+url.PathEscape(batchID))
+	writeBatch(w, http.StatusAccepted, status)
+	return true
+}
+
+// publish passes the requests of a batch to the message broker, a request which can't be published
+// finishes with an error result
+func (s *OcrHttpBatchHandler) publish(batchID string, ocrRequests []OcrRequest, rabbitConfig *RabbitConfig) {
+	var wg sync.WaitGroup
+	publishers := make(chan struct{}, batchPublishers)
+	for i := range ocrRequests {
+		publishers <- struct{}{}
+		wg.Add(1)
+		go func(ocrRequest *OcrRequest) {
+			defer wg.Done()
+			defer func() { <-publishers }()
+			_, httpStatus, err := HandleOcrRequest(ocrRequest, rabbitConfig)
+			// the request is in the queue now and counted by getQueueLen
+			releaseSlots(1)
+			if err == nil && httpStatus != http.StatusOK {
+				err = fmt.Errorf("request was not accepted, status %d", httpStatus)
+			}
+			if err != nil {
+				log.Error().Err(err).Str("component", "OCR_BATCH").Str("BatchID", batchID).
+					Str("RequestID", ocrRequest.RequestID).Msg("request of the batch could not be published")
+				deleteRequestFromQueue(ocrRequest.RequestID)
+				jobEvents.publish(JobEvent{ID: ocrRequest.RequestID, State: JobFailed, Message: err.Error()})
+				batches.complete(batchID, ocrRequest.batchIndex,
+					OcrResult{ID: ocrRequest.RequestID, Status: "error", Text: err.Error()}, rabbitConfig)
+			}
+		}(&ocrRequests[i])
+	}
+	wg.Wait()
+}
+
+func (s *OcrHttpBatchHandler) Status(w http.ResponseWriter, req *http.Request) {
+	batchID := req.PathValue("id")
+	status, tenant, ok := batches.status(batchID)
+	// batches of other tenants are reported as not found, like deliveries
+	if !ok || !deliveryVisible(principalFromContext(req.Context()), tenant) {
+		writeRejection(w, http.StatusNotFound, batchID, RejectBatchNotFound, "no such batch, it may have finished a while ago", 0)
+		return
+	}
+	writeBatch(w, http.StatusOK, status)
+}
+
+// Results returns the results finished so far, format=jsonl (default) writes one result per line,
+// format=zip a json file per result
+func (s *OcrHttpBatchHandler) Results(w http.ResponseWriter, req *http.Request) {
+	batchID := req.PathValue("id")
+	format := req.URL.Query().Get("format")
+	if format != "" && format != "jsonl" && format != "zip" {
+		writeAPIError(w, req, http.StatusBadRequest, batchID, "format has to be jsonl or zip")
+		return
+	}
+	lines, tenant, ok := batches.results(batchID)
+	if !ok || !deliveryVisible(principalFromContext(req.Context()), tenant) {
+		writeRejection(w, http.StatusNotFound, batchID, RejectBatchNotFound, "no such batch, it may have finished a while ago", 0)
+		return
+	}
+
+	var err error
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+batchID+`.zip"`)
+		archive := zip.NewWriter(w)
+		for i := 0; i < len(lines) && err == nil; i++ {
+			var file io.Writer
+			if file, err = archive.Create(fmt.Sprintf("%04d-%s.json", lines[i].Index, lines[i].ID)); err == nil {
+				err = json.NewEncoder(file).Encode(lines[i])
+			}
+		}
+		if err == nil {
+			err = archive.Close()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+batchID+`.jsonl"`)
+		encoder := json.NewEncoder(w)
+		for i := 0; i < len(lines) && err == nil; i++ {
+			err = encoder.Encode(lines[i])
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("component", "OCR_BATCH").Str("BatchID", batchID).Msg("http write() failed")
+	}
+}
+
+func writeBatch(w http.ResponseWriter, httpStatus int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Str("component", "OCR_BATCH").Msg("http write() failed")
+	}
+}
@@ -0,0 +1,84 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// reasons for rejecting a request to the deliveries end point
+const (
+	RejectDeliveryNotFound = "delivery_not_found"
+	RejectDeliveryPending  = "delivery_pending"
+)
+
+// OcrHttpDeliveriesHandler lists the postback deliveries with their attempts, GET ?id= returns the delivery
+// of a single request. POST ?id= sends a delivered or failed result again
+type OcrHttpDeliveriesHandler struct {
+	rabbitConfig *RabbitConfig
+}
+
+func NewOcrHttpDeliveriesHandler(config *RabbitConfig) *OcrHttpDeliveriesHandler {
+	return &OcrHttpDeliveriesHandler{rabbitConfig: config}
+}
+
+func (s *OcrHttpDeliveriesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		s.list(w, req)
+	case http.MethodPost:
+		RequireScope(ScopeSubmit, http.HandlerFunc(s.resend)).ServeHTTP(w, req)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeAPIError(w, req, http.StatusMethodNotAllowed, "", "method not allowed")
+	}
+}
+
+func (s *OcrHttpDeliveriesHandler) list(w http.ResponseWriter, req *http.Request) {
+	outbox := currentOutbox(s.rabbitConfig)
+	principal := principalFromContext(req.Context())
+	requestID := req.URL.Query().Get("id")
+	if requestID == "" {
+		all := principal == nil || principal.HasScope(ScopeAdmin)
+		writeDeliveries(w, http.StatusOK, outbox.List(tenantFromPrincipal(principal), all))
+		return
+	}
+	delivery, ok := outbox.Get(requestID)
+	if !ok || !deliveryVisible(principal, delivery.Tenant) {
+		writeRejection(w, http.StatusNotFound, requestID, RejectDeliveryNotFound, errDeliveryNotFound.Error(), 0)
+		return
+	}
+	writeDeliveries(w, http.StatusOK, delivery)
+}
+
+func (s *OcrHttpDeliveriesHandler) resend(w http.ResponseWriter, req *http.Request) {
+	outbox := currentOutbox(s.rabbitConfig)
+	requestID := req.URL.Query().Get("id")
+	// deliveries of other tenants are reported as not found, like results on /ocr-status
+	if delivery, ok := outbox.Get(requestID); !ok || !deliveryVisible(principalFromContext(req.Context()), delivery.Tenant) {
+		writeRejection(w, http.StatusNotFound, requestID, RejectDeliveryNotFound, errDeliveryNotFound.Error(), 0)
+		return
+	}
+	delivery, err := outbox.Resend(requestID)
+	switch err {
+	case nil:
+	case errDeliveryPending:
+		writeRejection(w, http.StatusConflict, requestID, RejectDeliveryPending, err.Error(), 0)
+		return
+	default:
+		writeRejection(w, http.StatusNotFound, requestID, RejectDeliveryNotFound, err.Error(), 0)
+		return
+	}
+	log.Info().Str("component", "OCR_OUTBOX").Str("RequestID", requestID).
+		Str("RemoteAddr", req.RemoteAddr).Msg("delivery was requested again")
+	writeDeliveries(w, http.StatusAccepted, delivery)
+}
+
+func writeDeliveries(w http.ResponseWriter, httpStatus int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Str("component", "OCR_OUTBOX").Msg("http write() failed")
+	}
+}
@@ -1,9 +1,9 @@
 package ocrworker
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 
 	// "github.com/sasha-s/go-deadlock"
 	"net/http"
@@ -13,6 +13,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/segmentio/ksuid"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // OcrHTTPStatusHandler is for initial handling of ocr request
@@ -38,7 +39,8 @@ func (s *OcrHTTPStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Reques
 	requestIDRaw := ksuid.New()
 	requestID := requestIDRaw.String()
 	log.Info().Str("component", "OCR_HTTP").Str("RequestID", requestID).
-		Msg("serveHttp called")
+		Str("HTTPRequestID", requestIDFromContext(req.Context())).Msg("serveHttp called")
+	trace.SpanFromContext(req.Context()).SetAttributes(requestIDAttribute.String(requestID))
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
 		if err != nil {
@@ -46,62 +48,121 @@ func (s *OcrHTTPStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Reques
 		}
 	}(req.Body)
 	httpStatus := 200
+	rabbitConfig := currentConfig(&s.RabbitConfig)
+
+	// a repeated request is answered even if the service is busy
+	idempotency, replayed := beginIdempotentRequest(w, req, requestID, rabbitConfig)
+	if replayed {
+		return
+	}
+	defer idempotency.abandon()
 
 	ServiceCanAcceptMu.Lock()
 	serviceCanAcceptLocal := ServiceCanAccept
 	appStopLocal := AppStop
 	ServiceCanAcceptMu.Unlock()
-	// check if the API should accept new requests. The part after || is needed because the first part can be slow
-	if (!serviceCanAcceptLocal && !appStopLocal) || !schedulerByWorkerNumber() {
-		err := "no resources available to process the request. RequestID " + requestID
-		log.Warn().Str("component", "OCR_HTTP").Err(fmt.Errorf(err)).
-			Str("RequestID", requestID).
-			Msg("conditions for accepting new requests are not met")
-		httpStatus = 503
-		http.Error(w, err, httpStatus)
+	clientID := clientIDFromRequest(req)
+	// check if the API should accept new requests
+	if reason := rejectReason(serviceCanAcceptLocal, appStopLocal); reason != "" {
+		trace.SpanFromContext(req.Context()).SetAttributes(rejectReasonAttribute.String(reason))
+		tenantRequests.WithLabelValues(tenantLabel(tenantFromPrincipal(principalFromContext(req.Context()))), reason).Inc()
+		writeAdmissionError(w, requestID, reason, clientID)
 		return
 	}
 
-	if !serviceCanAcceptLocal && appStopLocal {
-		err := "service is going down. RequestID " + requestID
-		log.Warn().Str("component", "OCR_HTTP").Err(fmt.Errorf(err)).
-			Str("RequestID", requestID).
-			Msg("conditions for accepting new requests are not met")
-		httpStatus = 503
-		http.Error(w, err, httpStatus)
+	ocrRequest := OcrRequest{}
+	defer ocrRequest.removeImgFile()
+	observeRequestSize := limitRequestBody(w, req, &rabbitConfig.Upload)
+	err := decodeOcrRequest(req.Body, &ocrRequest, rabbitConfig.Upload.Dir)
+	observeRequestSize()
+	ocrRequest.assignRequestID(requestID)
+	if isRequestTooLarge(err) {
+		log.Warn().Str("component", "OCR_HTTP").Err(err).Str("RequestID", requestID).Msg("request body is too large")
+		writeRequestTooLarge(w, requestID, &rabbitConfig.Upload)
 		return
 	}
-
-	ocrRequest := OcrRequest{RequestID: requestID}
-	decoder := json.NewDecoder(req.Body)
-	err := decoder.Decode(&ocrRequest)
 	if err != nil {
 		log.Warn().Str("component", "OCR_HTTP").Err(err).
 			Msg("did the client send a valid json? RequestID " + requestID)
 		httpStatus = 400
-		http.Error(w, "Unable to unmarshal json, malformed request. RequestID "+requestID, httpStatus)
+		writeAPIError(w, req, httpStatus, requestID, "Unable to unmarshal json, malformed request. RequestID "+requestID)
+		return
+	}
+
+	if !admitClientRequest(w, req, &ocrRequest, rabbitConfig) {
 		return
 	}
+	defer releaseClientSlot(ocrRequest.RequestID)
+	respondAsync := prefersAsync(req)
+	if respondAsync {
+		ocrRequest.Deferred = true
+	}
 
-	ocrResult, httpStatus, err := HandleOcrRequest(&ocrRequest, &s.RabbitConfig)
+	ocrResult, httpStatus, err := HandleOcrRequest(&ocrRequest, rabbitConfig)
 	if err != nil {
 		msg := "Unable to perform OCR decode. Error: %v"
 		errMsg := fmt.Sprintf(msg, err)
 		log.Error().Err(err).Str("component", "OCR_HTTP").Msg("Unable to perform OCR decode. RequestID " + requestID)
-		http.Error(w, errMsg, httpStatus)
+		writeAPIError(w, req, httpStatus, requestID, errMsg)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	js, err := json.Marshal(ocrResult)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if respondAsync && ocrResult.Status == "processing" {
+		w.Header().Set(PreferenceAppliedHeader, preferRespondAsync)
 	}
-	_, err = w.Write(js)
-	if err != nil {
-		log.Error().Err(err).Str("component", "OCR_HTTP").Str("RequestID", requestID).
-			Msg("http write() failed")
+	idempotency.accept(ocrResult)
+	writeOcrResult(w, req, &ocrResult)
+}
+
+// admitClientRequest applies the api key of the client to ocrRequest and reserves one of the client's slots.
+// If the request is not allowed, the rejection is written to w and false is returned
+func admitClientRequest(w http.ResponseWriter, req *http.Request, ocrRequest *OcrRequest, rabbitConfig *RabbitConfig) (admitted bool) {
+	_, span := tracer.Start(req.Context(), "admission", trace.WithAttributes(requestIDAttribute.String(ocrRequest.RequestID)))
+	defer func() { endAdmissionSpan(span, admitted) }()
+	ocrRequest.traceParent = trace.SpanContextFromContext(req.Context())
+	apiKey := apiKeyFromContext(req.Context())
+	ocrRequest.ClientID = clientIDFromRequest(req)
+	// the tenant is never taken from the request body
+	ocrRequest.Tenant = tenantFromPrincipal(principalFromContext(req.Context()))
+	tenant := tenantLabel(ocrRequest.Tenant)
+	if httpStatus, reason, err := ocrRequest.applyAPIKey(apiKey); err != nil {
+		log.Warn().Err(err).Str("component", "OCR_HTTP").Str("RequestID", ocrRequest.RequestID).
+			Str("ClientID", ocrRequest.ClientID).Str("reason", reason).Msg("request violates the limits of the client")
+		tenantRequests.WithLabelValues(tenant, reason).Inc()
+		span.SetAttributes(rejectReasonAttribute.String(reason))
+		writeRejection(w, httpStatus, ocrRequest.RequestID, reason, err.Error()+". RequestID "+ocrRequest.RequestID, 0)
+		return false
+	}
+
+	if limit := clientLimit(apiKey, rabbitConfig); limit > 0 && !clientShares.acquire(ocrRequest.ClientID, ocrRequest.RequestID, limit) {
+		tenantRequests.WithLabelValues(tenant, RejectClientShareExceeded).Inc()
+		span.SetAttributes(rejectReasonAttribute.String(RejectClientShareExceeded))
+		writeAdmissionError(w, ocrRequest.RequestID, RejectClientShareExceeded, ocrRequest.ClientID)
+		return false
+	}
+	tenantLoad.acquire(ocrRequest.Tenant, ocrRequest.RequestID, math.MaxUint)
+	tenantRequests.WithLabelValues(tenant, "accepted").Inc()
+	return true
+}
+
+// clientLimit is the number of requests the client may have in flight, 0 means no limit
+func clientLimit(apiKey *APIKey, rabbitConfig *RabbitConfig) uint {
+	var limit uint
+	if rabbitConfig.ClientShare > 0 {
+		limit = clientShareLimit(rabbitConfig.ClientShare)
+	}
+	if apiKey != nil && apiKey.MaxConcurrent > 0 && (limit == 0 || apiKey.MaxConcurrent < limit) {
+		limit = apiKey.MaxConcurrent
+	}
+	return limit
+}
+
+// releaseClientSlot frees the slot of a finished request. Deferred requests keep their slot until they are
+// removed from the queue
+func releaseClientSlot(requestID string) {
+	if _, ok := RequestsTrack.Load(requestID); !ok {
+		clientShares.release(requestID)
+		tenantLoad.release(requestID)
 	}
 }
 
@@ -112,13 +173,19 @@ func HandleOcrRequest(ocrRequest *OcrRequest, workerConfig *RabbitConfig) (OcrRe
 	// set the context for zerolog, RequestID will be printed on each logging event
 	logger := zerolog.New(os.Stdout).With().
 		Str("RequestID", ocrRequest.RequestID).Timestamp().Logger()
+	if err := ocrRequest.readImgFile(); err != nil {
+		logger.Error().Err(err).Str("component", "OCR_HTTP").Msg("spooled upload could not be read")
+		return OcrResult{}, 500, err
+	}
 	switch ocrRequest.InplaceDecode {
 	case true:
 		// inplace decode: short circuit rabbitmq, and just call ocr engine directly
-		ocrEngine := NewOcrEngine(ocrRequest.EngineType)
+		ocrRequest.setDeadline(workerConfig)
+		ctx, cancel := ocrRequest.jobContext(contextWithTraceParent(ocrRequest.traceParent))
+		defer cancel()
 
-		workingConfig := WorkerConfig{}
-		ocrResult, err := ocrEngine.ProcessRequest(ocrRequest, &workingConfig)
+		workingConfig := WorkerConfig{CommonConfig: CommonConfig{ImgURLFetch: workerConfig.ImgURLFetch}}
+		ocrResult, err := processRequest(ctx, ocrRequest, &workingConfig)
 		if err != nil {
 			logger.Error().Err(err).Str("component", "OCR_HTTP").Msg("Error processing ocr request")
 			httpStatus = 500
@@ -0,0 +1,97 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RejectJobNotFound is returned for event streams of unknown jobs and jobs of other tenants
+const RejectJobNotFound = "job_not_found"
+
+// jobEventKeepAlive is the interval of comments sent to keep proxies from closing an idle stream
+const jobEventKeepAlive = 15 * time.Second
+
+// JobEventsHandler streams the state changes of a job as server-sent events. The path has to contain
+// the RequestID as {id}. A client reconnecting with Last-Event-ID only gets the events it has missed
+type JobEventsHandler struct{}
+
+func NewJobEventsHandler() *JobEventsHandler {
+	return &JobEventsHandler{}
+}
+
+func (*JobEventsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	requestID := req.PathValue("id")
+	after, _ := strconv.ParseUint(req.Header.Get("Last-Event-ID"), 10, 32)
+	tenant, history, events, ok := jobEvents.subscribe(requestID, uint(after))
+	principal := principalFromContext(req.Context())
+	if ok && principal != nil && !principal.HasScope(ScopeAdmin) && tenantFromPrincipal(principal) != tenant {
+		// jobs of other tenants are reported as not found, so their request ids can't be probed
+		ok = false
+		if events != nil {
+			jobEvents.unsubscribe(requestID, events)
+		}
+	}
+	if !ok {
+		writeRejection(w, http.StatusNotFound, requestID, RejectJobNotFound, "no such job, it may have finished a while ago", 0)
+		return
+	}
+	if events != nil {
+		defer jobEvents.unsubscribe(requestID, events)
+	}
+
+	// the stream lasts as long as the job, which is longer than the write timeout of the server
+	controller := http.NewResponseController(w)
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+		log.Debug().Err(err).Str("component", "OCR_EVENTS").Msg("write deadline of the stream can't be disabled")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for i := range history {
+		if err := writeJobEvent(w, &history[i]); err != nil {
+			return
+		}
+	}
+	if err := controller.Flush(); err != nil || events == nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(jobEventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, open := <-events:
+			if !open {
+				return
+			}
+			if err := writeJobEvent(w, &event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeJobEvent(w http.ResponseWriter, event *JobEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.State, data)
+	return err
+}
@@ -1,17 +1,50 @@
 package ocrworker
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/rs/zerolog/log"
+	"github.com/segmentio/ksuid"
 )
 
+// maxUploadFieldSize limits the option fields of a multipart/form-data upload
+const maxUploadFieldSize = 1 << 20
+
+var (
+	errUploadMethod          = errors.New("this endpoint only accepts POST requests")
+	errUploadContentType     = errors.New("expected multipart/form-data or multipart/related")
+	errUploadNoFile          = errors.New("upload contains no file")
+	errUploadUnsupportedType = errors.New("unsupported file type, expected image/* or application/pdf")
+	errUploadMalformed       = errors.New("malformed upload")
+)
+
+// uploadFieldKinds are the options accepted as multipart/form-data fields, named like the json fields of
+// OcrRequest. The field "request" may hold the whole OcrRequest as json instead
+var uploadFieldKinds = map[string]string{
+	"engine":            "string",
+	"doc_type":          "string",
+	"reference_id":      "string",
+	"reply_to":          "string",
+	"user_agent":        "string",
+	"deferred":          "json",
+	"time_out":          "json",
+	"page_number":       "json",
+	"max_file_size":     "json",
+	"engine_args":       "json",
+	"preprocessor-args": "json",
+	"preprocessors":     "list",
+}
+
 type OcrHttpMultipartHandler struct {
 	RabbitConfig RabbitConfig
 }
@@ -22,69 +55,184 @@ func NewOcrHttpMultipartHandler(r *RabbitConfig) *OcrHttpMultipartHandler {
 	}
 }
 
-func (*OcrHttpMultipartHandler) extractParts(req *http.Request) (OcrRequest, error) {
-	log.Info().Str("component", "OCR_HTTP").Msg("request to ocr-file-upload")
-	ocrReq := OcrRequest{}
-
-	switch req.Method {
-	case "POST":
-		h := req.Header.Get("Content-Type")
-		log.Info().Str("component", "OCR_HTTP").
-			Str("content_type", h).
-			Msg("content type")
-
-		contentType, attrs, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
-		log.Info().Str("component", "OCR_HTTP").
-			Str("content_type", contentType).
-			Msg("content type")
-
-		if !strings.HasPrefix(h, "multipart/related") {
-			return ocrReq, fmt.Errorf("expected multipart related")
+// extractParts returns a request per uploaded file. multipart/form-data takes the options from named fields and
+// accepts several files, multipart/related expects a json part followed by the file
+func (s *OcrHttpMultipartHandler) extractParts(req *http.Request) ([]OcrRequest, error) {
+	log.Info().Str("component", "OCR_HTTP").Str("HTTPRequestID", requestIDFromContext(req.Context())).
+		Msg("request to ocr-file-upload")
+	if req.Method != http.MethodPost {
+		return nil, errUploadMethod
+	}
+	contentType, attrs, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	log.Info().Str("component", "OCR_HTTP").
+		Str("content_type", contentType).
+		Msg("content type")
+	if err != nil || attrs["boundary"] == "" {
+		return nil, errUploadContentType
+	}
+	reader := multipart.NewReader(req.Body, attrs["boundary"])
+	switch contentType {
+	case "multipart/form-data":
+		return extractFormData(reader, s.RabbitConfig.Upload.Dir)
+	case "multipart/related":
+		ocrRequest, err := extractRelated(reader, s.RabbitConfig.Upload.Dir)
+		if err != nil {
+			return nil, err
 		}
+		return []OcrRequest{ocrRequest}, nil
+	default:
+		return nil, errUploadContentType
+	}
+}
 
-		reader := multipart.NewReader(req.Body, attrs["boundary"])
-
-		for {
-
-			part, err := reader.NextPart()
-
-			if err == io.EOF {
-				break
+func extractFormData(reader *multipart.Reader, dir string) ([]OcrRequest, error) {
+	options := OcrRequest{}
+	var files []OcrRequest
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			removeImgFiles(files)
+			return nil, fmt.Errorf("%w: %w", errUploadMalformed, err)
+		}
+		if part.FileName() != "" {
+			file := OcrRequest{}
+			file.imgFile, file.imgFileSize, err = spoolUpload(part, dir)
+			if err == nil {
+				files = append(files, file)
 			}
-			contentTypeOuter := part.Header["Content-Type"][0]
-			contentType, attrs, _ := mime.ParseMediaType(contentTypeOuter)
-
-			log.Info().Str("component", "OCR_HTTP").Interface("attrs", attrs)
-
-			switch contentType {
-			case "application/json":
-				decoder := json.NewDecoder(part)
-				err := decoder.Decode(&ocrReq)
-				if err != nil {
-					return ocrReq, fmt.Errorf("unable to unmarshal json: %s", err)
-				}
-				part.Close()
-			default:
-				if !strings.HasPrefix(contentType, "image") {
-					return ocrReq, fmt.Errorf("expected content-type: image/*")
-				}
-
-				partContents, err := io.ReadAll(part)
-				if err != nil {
-					return ocrReq, fmt.Errorf("failed to read mime part: %v", err)
-				}
-
-				ocrReq.ImgBytes = partContents
-				return ocrReq, nil
+		} else {
+			err = applyUploadField(&options, part)
+		}
+		_ = part.Close()
+		if err != nil {
+			removeImgFiles(files)
+			return nil, err
+		}
+	}
+	if len(files) == 0 {
+		return nil, errUploadNoFile
+	}
+	// the options may come before or after the files
+	for i := range files {
+		imgFile, imgFileSize := files[i].imgFile, files[i].imgFileSize
+		files[i] = options
+		files[i].imgFile, files[i].imgFileSize = imgFile, imgFileSize
+	}
+	return files, nil
+}
 
+func extractRelated(reader *multipart.Reader, dir string) (OcrRequest, error) {
+	ocrRequest := OcrRequest{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return ocrRequest, errUploadNoFile
+		}
+		if err != nil {
+			return ocrRequest, fmt.Errorf("%w: %w", errUploadMalformed, err)
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if contentType == "application/json" {
+			err = json.NewDecoder(part).Decode(&ocrRequest)
+			_ = part.Close()
+			if err != nil {
+				return ocrRequest, fmt.Errorf("%w: unable to unmarshal json: %w", errUploadMalformed, err)
 			}
+			continue
+		}
+		ocrRequest.imgFile, ocrRequest.imgFileSize, err = spoolUpload(part, dir)
+		_ = part.Close()
+		return ocrRequest, err
+	}
+}
 
+// applyUploadField sets the option of a multipart/form-data field
+func applyUploadField(ocrRequest *OcrRequest, part *multipart.Part) error {
+	name := part.FormName()
+	value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldSize))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUploadMalformed, err)
+	}
+	var field []byte
+	switch uploadFieldKinds[name] {
+	case "string":
+		field, _ = json.Marshal(string(value))
+	case "json":
+		field = value
+	case "list":
+		if field = value; !json.Valid(value) {
+			field, _ = json.Marshal(splitCommaList(string(value)))
 		}
+	default:
+		if name != "request" {
+			return fmt.Errorf("%w: unknown field %q", errUploadMalformed, name)
+		}
+		if err = json.Unmarshal(value, ocrRequest); err != nil {
+			return fmt.Errorf("%w: unable to unmarshal json: %w", errUploadMalformed, err)
+		}
+		return nil
+	}
+	if err = json.Unmarshal([]byte(`{`+strconv.Quote(name)+`:`+string(field)+`}`), ocrRequest); err != nil {
+		return fmt.Errorf("%w: field %q: %w", errUploadMalformed, name, err)
+	}
+	return nil
+}
+
+// spoolUpload writes an uploaded file to a temporary file in dir instead of keeping it in memory. Files sent as
+// application/octet-stream are accepted if their content is an image or a pdf
+func spoolUpload(part *multipart.Part, dir string) (string, int64, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", 0, fmt.Errorf("%w: %w", errUploadMalformed, err)
+	}
+	if n == 0 {
+		return "", 0, fmt.Errorf("%w: %s is empty", errUploadNoFile, part.FileName())
+	}
+	head = head[:n]
+	contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+	if !strings.HasPrefix(contentType, "image/") && contentType != "application/pdf" {
+		return "", 0, fmt.Errorf("%w: %s", errUploadUnsupportedType, contentType)
+	}
+
+	file, err := os.CreateTemp(dir, "open-ocr-upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := io.Copy(file, io.MultiReader(bytes.NewReader(head), part))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", 0, fmt.Errorf("%w: %w", errUploadMalformed, err)
+	}
+	return file.Name(), size, nil
+}
 
-		return ocrReq, fmt.Errorf("didn't expect to get this far")
+func removeImgFiles(ocrRequests []OcrRequest) {
+	for i := range ocrRequests {
+		ocrRequests[i].removeImgFile()
+	}
+}
 
+// uploadErrorStatus maps the errors of extractParts to http status codes
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUploadMethod):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, errUploadContentType), errors.Is(err, errUploadUnsupportedType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errUploadNoFile), errors.Is(err, errUploadMalformed):
+		return http.StatusBadRequest
 	default:
-		return ocrReq, fmt.Errorf("this endpoint only accepts POST requests")
+		return http.StatusInternalServerError
 	}
 }
 
@@ -96,21 +244,64 @@ func (s *OcrHttpMultipartHandler) ServeHTTP(w http.ResponseWriter, req *http.Req
 		}
 	}(req.Body)
 	httpStatus := 200
-	ocrRequest, err := s.extractParts(req)
+	rabbitConfig := currentConfig(&s.RabbitConfig)
+	// the id of the job, or of the batch if several files are uploaded
+	requestID := ksuid.New().String()
+	// a repeated upload is answered without receiving the files again
+	idempotency, replayed := beginIdempotentRequest(w, req, requestID, rabbitConfig)
+	if replayed {
+		return
+	}
+	defer idempotency.abandon()
+
+	observeRequestSize := limitRequestBody(w, req, &rabbitConfig.Upload)
+	ocrRequests, err := s.extractParts(req)
+	observeRequestSize()
+	if isRequestTooLarge(err) {
+		log.Warn().Err(err).Str("component", "OCR_HTTP").Msg("upload is too large")
+		writeRequestTooLarge(w, "", &rabbitConfig.Upload)
+		return
+	}
 	if err != nil {
-		log.Error().Err(err).Str("component", "OCR_HTTP")
-		errStr := fmt.Sprintf("Error extracting multipart/related parts: %v", err)
-		http.Error(w, errStr, 500)
+		log.Warn().Err(err).Str("component", "OCR_HTTP").Msg("upload could not be extracted")
+		writeAPIError(w, req, uploadErrorStatus(err), "", fmt.Sprintf("Error extracting multipart parts: %v", err))
 		return
 	}
 
-	ocrResult, httpStatus, err := HandleOcrRequest(&ocrRequest, &s.RabbitConfig)
+	// several files are processed as a batch, see OcrHttpBatchHandler
+	if len(ocrRequests) > 1 {
+		batchRequest := BatchRequest{Requests: ocrRequests, ReplyTo: ocrRequests[0].ReplyTo}
+		if !NewOcrHttpBatchHandler(rabbitConfig).admit(w, req, requestID, batchRequest) {
+			removeImgFiles(ocrRequests)
+			return
+		}
+		idempotency.acceptBatch(requestID)
+		return
+	}
+
+	ocrRequest := ocrRequests[0]
+	defer ocrRequest.removeImgFile()
+	ocrRequest.assignRequestID(requestID)
+	if !admitClientRequest(w, req, &ocrRequest, rabbitConfig) {
+		return
+	}
+	defer releaseClientSlot(ocrRequest.RequestID)
+	respondAsync := prefersAsync(req)
+	if respondAsync {
+		ocrRequest.Deferred = true
+	}
+
+	ocrResult, httpStatus, err := HandleOcrRequest(&ocrRequest, rabbitConfig)
 	if err != nil {
 		msg := "Unable to perform OCR decode."
 		log.Error().Err(err).Str("component", "OCR_HTTP").Msg(msg)
-		http.Error(w, msg, httpStatus)
+		writeAPIError(w, req, httpStatus, ocrRequest.RequestID, msg)
 		return
 	}
 
-	_, _ = fmt.Fprintf(w, ocrResult.Text)
+	if respondAsync && ocrResult.Status == "processing" {
+		w.Header().Set(PreferenceAppliedHeader, preferRespondAsync)
+	}
+	idempotency.accept(ocrResult)
+	writeOcrResult(w, req, &ocrResult)
 }
@@ -0,0 +1,148 @@
+package ocrworker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// pngHeader is enough for content sniffing to detect an image
+var pngHeader = []byte("\x89PNG\r\n\x1a\n0000IHDR")
+
+func newFormDataRequest(t *testing.T, fields map[string]string, files ...[]byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, value := range fields {
+		assert.True(t, writer.WriteField(name, value) == nil)
+	}
+	for i, content := range files {
+		part, err := writer.CreateFormFile("file", "upload-"+strconv.Itoa(i))
+		assert.True(t, err == nil)
+		_, _ = part.Write(content)
+	}
+	assert.True(t, writer.Close() == nil)
+	req := httptest.NewRequest(http.MethodPost, "/ocr-file-upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestMultipartFormData(t *testing.T) {
+	req := newFormDataRequest(t,
+		map[string]string{
+			"engine":        "sandwich",
+			"engine_args":   `{"ocr_type":"txt"}`,
+			"preprocessors": "identity,stroke-width-transform",
+			"page_number":   "2",
+			"reference_id":  "4711",
+		},
+		pngHeader, []byte("%PDF-1.4\n%"),
+	)
+	ocrRequests, err := (&OcrHttpMultipartHandler{}).extractParts(req)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(ocrRequests), 2)
+	defer removeImgFiles(ocrRequests)
+	for _, ocrRequest := range ocrRequests {
+		assert.Equals(t, ocrRequest.EngineType, EngineSandwichTesseract)
+		assert.Equals(t, ocrRequest.EngineArgs["ocr_type"], "txt")
+		assert.DeepEquals(t, ocrRequest.PreprocessorChain, []string{"identity", "stroke-width-transform"})
+		assert.Equals(t, ocrRequest.PageNumber, uint16(2))
+		assert.Equals(t, ocrRequest.ReferenceID, "4711")
+		assert.True(t, ocrRequest.imgFile != "")
+	}
+
+	// the spooled file is read when the request is handled and removed afterwards
+	imgFile := ocrRequests[0].imgFile
+	assert.True(t, ocrRequests[0].readImgFile() == nil)
+	assert.DeepEquals(t, ocrRequests[0].ImgBytes, pngHeader)
+	_, err = os.Stat(imgFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMultipartResponse(t *testing.T) {
+	cacheTestResult(pngHeader, "", "100% cached")
+	config := DefaultTestConfig()
+	config.ResultCache.TTL = 60
+	handler := NewOcrHttpMultipartHandler(&config)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newFormDataRequest(t, nil, pngHeader))
+	assert.Equals(t, recorder.Code, http.StatusOK)
+	var ocrResult OcrResult
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &ocrResult) == nil)
+	assert.Equals(t, ocrResult.Text, "100% cached")
+
+	// a deferred upload gets the id of its job
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, newFormDataRequest(t, map[string]string{"deferred": "true"}, pngHeader))
+	assert.Equals(t, recorder.Code, http.StatusAccepted)
+	ocrResult = OcrResult{}
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &ocrResult) == nil)
+	defer deleteRequestFromQueue(ocrResult.ID)
+	assert.Equals(t, ocrResult.Status, "processing")
+	assert.Equals(t, recorder.Header().Get("Location"), jobStatusPath(ocrResult.ID))
+
+	req := newFormDataRequest(t, nil, pngHeader)
+	req.Header.Set(PreferHeader, preferRespondAsync)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equals(t, recorder.Code, http.StatusAccepted)
+	assert.Equals(t, recorder.Header().Get(PreferenceAppliedHeader), preferRespondAsync)
+	ocrResult = OcrResult{}
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &ocrResult) == nil)
+	defer deleteRequestFromQueue(ocrResult.ID)
+}
+
+func TestMultipartRelated(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	_, _ = part.Write([]byte(`{"engine":"tesseract","page_number":3}`))
+	part, _ = writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/pdf"}})
+	_, _ = part.Write([]byte("%PDF-1.4\n%"))
+	_ = writer.Close()
+	req := httptest.NewRequest(http.MethodPost, "/ocr-file-upload", body)
+	req.Header.Set("Content-Type", "multipart/related; boundary="+writer.Boundary())
+
+	ocrRequests, err := (&OcrHttpMultipartHandler{}).extractParts(req)
+	assert.True(t, err == nil)
+	assert.Equals(t, len(ocrRequests), 1)
+	defer removeImgFiles(ocrRequests)
+	assert.Equals(t, ocrRequests[0].EngineType, EngineTesseract)
+	assert.Equals(t, ocrRequests[0].PageNumber, uint16(3))
+	assert.Equals(t, ocrRequests[0].imgFileSize, int64(10))
+}
+
+func TestMultipartErrors(t *testing.T) {
+	handler := &OcrHttpMultipartHandler{}
+
+	_, err := handler.extractParts(newFormDataRequest(t, map[string]string{"engine": "tesseract"}))
+	assert.True(t, errors.Is(err, errUploadNoFile))
+	assert.Equals(t, uploadErrorStatus(err), http.StatusBadRequest)
+
+	_, err = handler.extractParts(newFormDataRequest(t, nil, []byte("plain text")))
+	assert.True(t, errors.Is(err, errUploadUnsupportedType))
+	assert.Equals(t, uploadErrorStatus(err), http.StatusUnsupportedMediaType)
+
+	_, err = handler.extractParts(newFormDataRequest(t, map[string]string{"unknown": "1"}, pngHeader))
+	assert.True(t, errors.Is(err, errUploadMalformed))
+
+	_, err = handler.extractParts(newFormDataRequest(t, map[string]string{"page_number": "two"}, pngHeader))
+	assert.True(t, errors.Is(err, errUploadMalformed))
+
+	req := httptest.NewRequest(http.MethodPost, "/ocr-file-upload", bytes.NewReader([]byte("{}")))
+	req.Header.Set("Content-Type", "application/json")
+	_, err = handler.extractParts(req)
+	assert.Equals(t, uploadErrorStatus(err), http.StatusUnsupportedMediaType)
+
+	_, err = handler.extractParts(httptest.NewRequest(http.MethodGet, "/ocr-file-upload", nil))
+	assert.Equals(t, uploadErrorStatus(err), http.StatusMethodNotAllowed)
+}
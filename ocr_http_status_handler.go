@@ -21,16 +21,36 @@ func (*OcrHttpStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	err := decoder.Decode(&ocrRequest)
 	if err != nil {
 		log.Error().Err(err).Str("component", "OCR_STATUS")
-		http.Error(w, "unable to unmarshal json", 400)
+		writeAPIError(w, req, http.StatusBadRequest, "", "unable to unmarshal json")
 		return
 	}
+	// the request id is sent in img_url
+	writeOcrStatus(w, req, ocrRequest.ImgUrl)
+	_ = req.Body.Close()
+}
 
-	ocrResult, ocrRequestExists := CheckOcrStatusByID(ocrRequest.ImgUrl)
+// Job serves GET /jobs/{id}, the Location of requests answered with 202. Like /ocr-status, a finished result
+// is returned only once
+func (*OcrHttpStatusHandler) Job(w http.ResponseWriter, req *http.Request) {
+	log.Debug().Str("component", "OCR_STATUS").Msg("OcrHttpStatusHandler called")
+	writeOcrStatus(w, req, req.PathValue("id"))
+}
+
+func writeOcrStatus(w http.ResponseWriter, req *http.Request, requestID string) {
+	// results of other tenants are reported as not found, so their request ids can't be probed
+	var ocrResult OcrResult
+	ocrRequestExists := false
+	if canReadResult(principalFromContext(req.Context()), requestID) {
+		ocrResult, ocrRequestExists = CheckOcrStatusByID(requestID)
+	} else {
+		log.Warn().Str("component", "OCR_STATUS").Str("RequestID", requestID).
+			Str("RemoteAddr", req.RemoteAddr).Msg("request of another tenant was queried")
+	}
 	if !ocrRequestExists {
 		ocrResult.Text = ""
-		ocrResult.ID = ocrRequest.ImgUrl
+		ocrResult.ID = requestID
 		ocrResult.Status = "not found"
-		log.Info().Str("component", "OCR_STATUS").Str("RequestID", ocrRequest.ImgUrl).
+		log.Info().Str("component", "OCR_STATUS").Str("RequestID", requestID).
 			Str("RemoteAddr", req.RemoteAddr).
 			Msg("no such ocr request, processing time limit was probably reached for this request")
 	}
@@ -38,19 +58,18 @@ func (*OcrHttpStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	js, err := json.Marshal(ocrResult)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Error().Err(err).Str("component", "OCR_STATUS").Str("RequestID", ocrRequest.ImgUrl).Str("RemoteAddr", req.RemoteAddr)
+		writeAPIError(w, req, http.StatusInternalServerError, requestID, err.Error())
+		log.Error().Err(err).Str("component", "OCR_STATUS").Str("RequestID", requestID).Str("RemoteAddr", req.RemoteAddr)
 		return
 	}
 	_, err = w.Write(js)
 	if err != nil {
-		log.Error().Err(err).Str("component", "OCR_STATUS").Str("RequestID", ocrRequest.ImgUrl).Str("RemoteAddr", req.RemoteAddr)
+		log.Error().Err(err).Str("component", "OCR_STATUS").Str("RequestID", requestID).Str("RemoteAddr", req.RemoteAddr)
 	}
 	if ocrRequestExists && err == nil {
 		log.Info().Str("component", "OCR_STATUS").
-			Str("RequestID", ocrRequest.ImgUrl).
+			Str("RequestID", requestID).
 			Str("RemoteAddr", req.RemoteAddr).
 			Msg("ocr request was claimed")
 	}
-	_ = req.Body.Close()
 }
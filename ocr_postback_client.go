@@ -3,6 +3,7 @@ package ocrworker
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/rs/zerolog"
+	"github.com/xf0e/open-ocr/webhook"
 )
 
 var (
@@ -18,40 +20,52 @@ var (
 	version     string
 )
 
-type ocrPostClient struct{}
+// ocrPostClient delivers results to reply_to, signed with secret if it is not empty
+type ocrPostClient struct {
+	secret []byte
+}
+
+func newOcrPostClient(secret string) *ocrPostClient {
+	return &ocrPostClient{secret: []byte(secret)}
+}
 
-func newOcrPostClient() *ocrPostClient {
-	return &ocrPostClient{}
+// postOcrRequest posts the result to replyToAddress and returns the status code of the response.
+// Any status other than 2xx is an error, so the delivery is retried
+func (c *ocrPostClient) postOcrRequest(ocrResult *OcrResult, replyToAddress string, numTry uint) (int, error) {
+	jsonReply, err := json.Marshal(ocrResult)
+	if err != nil {
+		return 0, err
+	}
+	return c.postJSON(ocrResult.ID, jsonReply, replyToAddress, numTry)
 }
 
-func (*ocrPostClient) postOcrRequest(ocrResult *OcrResult, replyToAddress string, numTry uint) error {
-	logger := zerolog.New(os.Stdout).With().Str("RequestID", ocrResult.ID).Timestamp().Logger()
+// postJSON posts the json body of a result or a batch to replyToAddress
+func (c *ocrPostClient) postJSON(requestID string, jsonReply []byte, replyToAddress string, numTry uint) (int, error) {
+	logger := zerolog.New(os.Stdout).With().Str("RequestID", requestID).Timestamp().Logger()
 	logger.Info().Str("component", "OCR_HTTP").
 		Uint("attempt", numTry).
 		Str("replyToAddress", replyToAddress).
 		Msg("sending ocr back to requester")
 
-	jsonReply, err := json.Marshal(ocrResult)
-	if err != nil {
-		ocrResult.Status = "error"
-	}
-
 	req, err := http.NewRequest("POST", replyToAddress, bytes.NewBuffer(jsonReply))
 	if err != nil {
 		logger.Error().Str("component", "OCR_HTTP").Err(err).Msg("forming POST reply error")
+		return 0, err
 	}
 	req.Close = true
 	req.Header.Set("User-Agent", "open-ocr/"+version)
 	req.Header.Set("X-open-ocr-reply-type", "automated reply")
 	req.Header.Set("Content-Type", "application/json")
+	if len(c.secret) > 0 {
+		webhook.SetHeaders(req.Header, c.secret, time.Now(), jsonReply)
+	}
 
-	client := &http.Client{Timeout: postTimeout}
-	resp, err := client.Do(req)
+	resp, err := outboundHTTPClient(postTimeout).Do(req)
 	if err != nil {
 		logger.Warn().Err(err).Str("component", "OCR_HTTP").
 			Str("replyToAddress", replyToAddress).
 			Msg("ocr was not delivered. Target did not respond")
-		return err
+		return 0, err
 	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
@@ -60,19 +74,22 @@ func (*ocrPostClient) postOcrRequest(ocrResult *OcrResult, replyToAddress string
 		}
 	}(resp.Body)
 
-	body, err := io.ReadAll(resp.Body)
-	header := resp.StatusCode
+	// the body is only logged, don't read more than that
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 32))
 	if err != nil {
 		logger.Warn().Err(err).Str("component", "OCR_HTTP").
 			Str("replyToAddress", replyToAddress).
 			Msg("ocr was probably not delivered, response body is empty")
-		return err
+		return resp.StatusCode, err
 	}
 	logger.Info().Str("component", "OCR_HTTP").
-		Int("RESPONSE_CODE", header).
+		Int("RESPONSE_CODE", resp.StatusCode).
 		Str("replyToAddress", replyToAddress).
-		Interface("payload(first 32 bytes)", string(body[0:32])).
+		Interface("payload(first 32 bytes)", string(body)).
 		Msg("target responded")
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("target responded with status %d", resp.StatusCode)
+	}
 
-	return err
+	return resp.StatusCode, nil
 }
@@ -0,0 +1,39 @@
+package ocrworker
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+	"github.com/xf0e/open-ocr/webhook"
+)
+
+func TestPostOcrRequestSigned(t *testing.T) {
+	var verifyErr error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, verifyErr = webhook.VerifyRequest([]byte("secret"), req)
+		if req.URL.Path == "/unavailable" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = io.WriteString(w, `{"status":"received","message":"thank you for the result"}`)
+	}))
+	defer server.Close()
+	defer withOutboundConfig(t, OutboundConfig{AllowInternal: true, MaxRedirects: defaultMaxRedirects})()
+
+	ocrResult := &OcrResult{ID: "1", Status: "done", Text: "hello"}
+	status, err := newOcrPostClient("secret").postOcrRequest(ocrResult, server.URL, 1)
+	assert.True(t, err == nil)
+	assert.Equals(t, status, http.StatusOK)
+	assert.True(t, verifyErr == nil)
+
+	_, err = newOcrPostClient("").postOcrRequest(ocrResult, server.URL, 1)
+	assert.True(t, err == nil)
+	assert.Equals(t, verifyErr, webhook.ErrMissingSignature)
+
+	// the result is not delivered unless the target accepts it
+	status, err = newOcrPostClient("").postOcrRequest(ocrResult, server.URL+"/unavailable", 1)
+	assert.True(t, err != nil)
+	assert.Equals(t, status, http.StatusServiceUnavailable)
+}
@@ -1,8 +1,14 @@
 package ocrworker
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type OcrRequest struct {
@@ -19,10 +25,58 @@ type OcrRequest struct {
 	RequestID         string                 `json:"req_id"`
 	PageNumber        uint16                 `json:"page_number"`
 	UserAgent         string                 `json:"user_agent"`
-	TimeOut           uint                   `json:"time_out"`
-	ReferenceID       string                 `json:"reference_id"`
+	// ClientID is the identity of the authenticated client, set by the http daemon
+	ClientID string `json:"client_id"`
+	// Tenant owns the request and its result, set by the http daemon
+	Tenant string `json:"tenant"`
+	// MaxFileSize limits the size of the image in bytes, it can only lower the configured img_url limit
+	MaxFileSize int64 `json:"max_file_size"`
+	// Priority of the message instead of the one of doc_type, set by the http daemon from the api key
+	Priority uint8 `json:"-"`
+	TimeOut  uint  `json:"time_out"`
+	// Deadline is the absolute expiry of the job, set by the http daemon from TimeOut
+	Deadline    time.Time `json:"deadline"`
+	ReferenceID string    `json:"reference_id"`
 	// decode ocr in http handler rather than putting in queue
 	InplaceDecode bool `json:"inplace_decode"`
+	// postbackClientID is the client whose secret signs the postbacks instead of the global secret, set by
+	// the http daemon. The outbox looks the secret up when it posts, so it is never persisted
+	postbackClientID string
+	// batchID and batchIndex locate the request in its batch, the result is collected by the batch
+	batchID    string
+	batchIndex int
+	// ImgSize is the size of the image in bytes, set by the http daemon
+	ImgSize int64 `json:"img_size,omitempty"`
+	// imgFile is an upload spooled to disk, it is read into ImgBytes when the request is handled
+	imgFile     string
+	imgFileSize int64
+	// traceParent is the span of the http request, the spans of the job in the http daemon continue its trace
+	traceParent trace.SpanContext
+}
+
+// assignRequestID sets the id the job is tracked by. The id is always generated by the http daemon, the stores
+// of the jobs are keyed by it and must not be taken over by a client of another tenant. A req_id sent by the
+// client is kept as ReferenceID
+func (ocrRequest *OcrRequest) assignRequestID(requestID string) {
+	if ocrRequest.ReferenceID == "" {
+		ocrRequest.ReferenceID = ocrRequest.RequestID
+	}
+	ocrRequest.RequestID = requestID
+}
+
+// messagePriority returns the priority of the message: the priority of the api key of the client, otherwise
+// the one queuePrio defines for doc_type or for "standard" if doc_type has none
+func (ocrRequest *OcrRequest) messagePriority(queuePrio map[string]uint8) uint8 {
+	if ocrRequest.Priority > 0 {
+		return ocrRequest.Priority
+	}
+	if ocrRequest.DocType == "" {
+		return 1
+	}
+	if priority, ok := queuePrio[ocrRequest.DocType]; ok {
+		return priority
+	}
+	return queuePrio["standard"]
 }
 
 // figure out the next pre-processor routing key to use (if any).
@@ -52,12 +106,47 @@ func (ocrRequest *OcrRequest) decodeBase64() error {
 	return nil
 }
 
+// readImgFile moves an upload spooled to disk into ImgBytes and removes the file
+func (ocrRequest *OcrRequest) readImgFile() error {
+	if ocrRequest.imgFile == "" {
+		return nil
+	}
+	defer ocrRequest.removeImgFile()
+	bytes, err := os.ReadFile(ocrRequest.imgFile)
+	if err != nil {
+		return err
+	}
+	ocrRequest.ImgBytes = bytes
+	return nil
+}
+
+// removeImgFile deletes an upload spooled to disk, it is safe to call it more than once
+func (ocrRequest *OcrRequest) removeImgFile() {
+	if ocrRequest.imgFile == "" {
+		return
+	}
+	if err := os.Remove(ocrRequest.imgFile); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("RequestID", ocrRequest.RequestID).Msg("spooled upload could not be removed")
+	}
+	ocrRequest.imgFile = ""
+}
+
 func (ocrRequest *OcrRequest) hasBase64() bool {
 	return ocrRequest.ImgBase64 != ""
 }
 
-func (ocrRequest *OcrRequest) downloadImgUrl() error {
-	bytes, err := url2bytes(ocrRequest.ImgUrl)
+// imgURLFetchConfig returns fetchConfig with the size limit of the request applied
+func (ocrRequest *OcrRequest) imgURLFetchConfig(fetchConfig *ImgURLFetchConfig) *ImgURLFetchConfig {
+	if ocrRequest.MaxFileSize <= 0 || (fetchConfig.MaxSize > 0 && fetchConfig.MaxSize <= ocrRequest.MaxFileSize) {
+		return fetchConfig
+	}
+	limited := *fetchConfig
+	limited.MaxSize = ocrRequest.MaxFileSize
+	return &limited
+}
+
+func (ocrRequest *OcrRequest) downloadImgUrl(ctx context.Context, fetchConfig *ImgURLFetchConfig) error {
+	bytes, err := ocrRequest.imgURLFetchConfig(fetchConfig).fetchBytes(ctx, ocrRequest.ImgUrl)
 	if err != nil {
 		return err
 	}
@@ -66,6 +155,33 @@ func (ocrRequest *OcrRequest) downloadImgUrl() error {
 	return nil
 }
 
+// setDeadline limits TimeOut to the configured values and derives the absolute Deadline of the job from it
+func (ocrRequest *OcrRequest) setDeadline(rabbitConfig *RabbitConfig) {
+	// setting the timeout for worker if not set or to high
+	if ocrRequest.TimeOut >= rabbitConfig.MaximalResponseCacheTimeout || ocrRequest.TimeOut == 0 {
+		ocrRequest.TimeOut = rabbitConfig.ResponseCacheTimeout
+	}
+	ocrRequest.Deadline = time.Now().Add(time.Duration(ocrRequest.TimeOut) * time.Second)
+}
+
+// deadlineExceeded reports whether the job has expired and should not be processed anymore
+func (ocrRequest *OcrRequest) deadlineExceeded() bool {
+	return !ocrRequest.Deadline.IsZero() && time.Now().After(ocrRequest.Deadline)
+}
+
+// jobContext returns a context which is canceled as soon as the job's deadline is reached.
+// Messages without a deadline fall back to TimeOut counted from now
+func (ocrRequest *OcrRequest) jobContext(parent context.Context) (context.Context, context.CancelFunc) {
+	switch {
+	case !ocrRequest.Deadline.IsZero():
+		return context.WithDeadline(parent, ocrRequest.Deadline)
+	case ocrRequest.TimeOut > 0:
+		return context.WithTimeout(parent, time.Duration(ocrRequest.TimeOut)*time.Second)
+	default:
+		return context.WithCancel(parent)
+	}
+}
+
 func (ocrRequest *OcrRequest) String() string {
 	return fmt.Sprintf("ImgUrl: %s, EngineType: %s, Preprocessors: %s, Request ID: %s", ocrRequest.ImgUrl, ocrRequest.EngineType, ocrRequest.PreprocessorChain, ocrRequest.RequestID)
 }
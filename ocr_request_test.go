@@ -0,0 +1,62 @@
+package ocrworker
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestOcrRequestSetDeadline(t *testing.T) {
+	rabbitConfig := rabbitConfigForTests()
+	rabbitConfig.ResponseCacheTimeout = 60
+	rabbitConfig.MaximalResponseCacheTimeout = 120
+
+	ocrRequest := OcrRequest{TimeOut: 500}
+	ocrRequest.setDeadline(&rabbitConfig)
+	assert.Equals(t, ocrRequest.TimeOut, uint(60))
+	assert.True(t, ocrRequest.Deadline.After(time.Now().Add(59*time.Second)))
+	assert.False(t, ocrRequest.deadlineExceeded())
+
+	// the deadline has to survive the trip through the message broker
+	jsonBytes, err := json.Marshal(ocrRequest)
+	assert.True(t, err == nil)
+	decoded := OcrRequest{}
+	err = json.Unmarshal(jsonBytes, &decoded)
+	assert.True(t, err == nil)
+	assert.True(t, decoded.Deadline.Equal(ocrRequest.Deadline))
+}
+
+func TestOcrRequestJobContext(t *testing.T) {
+	expired := OcrRequest{Deadline: time.Now().Add(-time.Second)}
+	assert.True(t, expired.deadlineExceeded())
+	ctx, cancel := expired.jobContext(context.Background())
+	defer cancel()
+	assert.True(t, ctx.Err() != nil)
+
+	// messages of older http daemons don't carry a deadline
+	legacy := OcrRequest{TimeOut: 30}
+	assert.False(t, legacy.deadlineExceeded())
+	ctx, cancel = legacy.jobContext(context.Background())
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.True(t, deadline.After(time.Now().Add(29*time.Second)))
+}
+
+func TestMessagePriority(t *testing.T) {
+	queuePrio := map[string]uint8{"standard": 1, "egvp": 9}
+	assert.Equals(t, (&OcrRequest{}).messagePriority(queuePrio), uint8(1))
+	assert.Equals(t, (&OcrRequest{DocType: "egvp"}).messagePriority(queuePrio), uint8(9))
+	assert.Equals(t, (&OcrRequest{DocType: "unknown"}).messagePriority(queuePrio), uint8(1))
+
+	// the priority of the api key applies to the default doc_type of the key and to the doc_type of the request
+	for _, docType := range []string{"", "egvp"} {
+		ocrRequest := OcrRequest{DocType: docType}
+		_, _, err := ocrRequest.applyAPIKey(&APIKey{ClientID: "client", DocType: "egvp", Priority: 4})
+		assert.True(t, err == nil)
+		assert.Equals(t, ocrRequest.messagePriority(queuePrio), uint8(4))
+	}
+}
@@ -1,19 +1,21 @@
 package ocrworker
 
 import (
-	"encoding/json"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
-// OcrQueueManager is used as a main component of resource manager
+// OcrQueueManager is the queue stats returned by the RabbitMQ management API
 type OcrQueueManager struct {
 	NumMessages  uint `json:"messages"` // TODO: do not read the number of messages from API because it is slow, and the clients of this product may not behave and put too many requests in too fast.
 	NumConsumers uint `json:"consumers"`
 	MessageBytes uint `json:"message_bytes"`
 }
 
+// ocrResManager is the node stats returned by the RabbitMQ management API
 type ocrResManager struct {
 	MemLimit uint64 `json:"mem_limit"`
 	MemUsed  uint64 `json:"mem_used"`
@@ -23,111 +25,107 @@ const (
 	memoryThreshold uint64 = 95 // if memory usage of RabbitMQ is over this value, no more requests will be added
 )
 
-func newOcrQueueManager() *OcrQueueManager {
-	return &OcrQueueManager{NumMessages: 0}
-}
-
-func newOcrResManager() []ocrResManager {
-	resManager := make([]ocrResManager, 0)
-	return resManager
-}
-
 var (
-	queueManager *OcrQueueManager
-	resManager   []ocrResManager
 	// StopChan is used to gracefully stop http daemon
 	StopChan                 = make(chan bool, 1)
-	factorForMessageAccept   uint // formula: NumMessages < NumConsumers * FactorForMessageAccept
 	TechnicalErrorResManager bool
+	// admissionState is the last snapshot taken by the admission controller
+	admissionState AdmissionState
+	// admissionReason is why the last check didn't accept new requests, see the Reject* constants
+	admissionReason string
+	// admissionPolled is the time of the last poll, zero before the first one
+	admissionPolled  time.Time
+	admissionStateMu sync.RWMutex
+	// reservedSlots are held by batches for requests which are not published yet
+	reservedSlots uint
 )
 
-// CheckForAcceptRequest will check by reading the RabbitMQ API if resources for incoming request are available
-func CheckForAcceptRequest(urlQueue, urlStat string) bool {
-	isAvailable := false
+// CheckForAcceptRequest will poll the admission controller and check if resources for incoming request are available
+func CheckForAcceptRequest(controller AdmissionController) bool {
 	TechnicalErrorResManager = false
-	jsonQueueStat, err := url2bytes(urlQueue)
-	if err != nil {
-		log.Error().Err(err).Str("component", "OCR_RESMAN").Msg("can't get Queue stats")
-		TechnicalErrorResManager = true
-		return false
-	}
-	jsonResStat, err := url2bytes(urlStat)
-	if err != nil {
-		log.Error().Caller().Err(err).Str("component", "OCR_RESMAN").
-			Str("body", string(jsonQueueStat)).
-			Bytes("payload", jsonResStat).
-			Msg("error calling url2bytes for rabbitMQ stats")
-		TechnicalErrorResManager = true
-		return false
+	state, err := controller.Poll()
+	admissionStateMu.Lock()
+	admissionState = state
+	admissionStateMu.Unlock()
+
+	reason := ""
+	switch {
+	case errors.Is(err, errNoConsumers):
+		reason = RejectNoWorkers
+	case err != nil:
+		reason = RejectBrokerUnreachable
+	case !schedulerByMemoryLoad():
+		reason = RejectMemoryPressure
+	case !schedulerByWorkerNumber():
+		reason = RejectQueueFull
 	}
+	admissionStateMu.Lock()
+	admissionReason = reason
+	admissionPolled = time.Now()
+	admissionStateMu.Unlock()
 
-	err = json.Unmarshal(jsonQueueStat, queueManager)
 	if err != nil {
-		log.Error().Caller().Err(err).Str("component", "OCR_RESMAN").
-			Str("body", string(jsonQueueStat)).
-			Bytes("payload", jsonQueueStat).
-			Msg("error unmarshalling json")
-		TechnicalErrorResManager = true
-		return false
-	}
-
-	err = json.Unmarshal(jsonResStat, &resManager)
-	if err != nil {
-		log.Error().Caller().Err(err).Str("component", "OCR_RESMAN").Msg("error unmarshalling json")
-		log.Error().Err(err).Str("component", "OCR_RESMAN").
-			Str("body", string(jsonResStat))
-		TechnicalErrorResManager = true
-		return false
-	}
-
-	if queueManager.NumConsumers == 0 {
+		log.Error().Err(err).Str("component", "OCR_RESMAN").Msg("admission controller can't determine the state of the service")
 		TechnicalErrorResManager = true
 		return false
 	}
-
-	flagForResources := schedulerByMemoryLoad()
-	flagForQueue := schedulerByWorkerNumber()
-	if flagForQueue && flagForResources {
-		TechnicalErrorResManager = false
-		isAvailable = true
-	}
-	return isAvailable
+	return reason == ""
 }
 
-// computes the ratio of total available memory and used memory and returns a bool value if a threshold is reached
+// computes the ratio of total available memory and used memory and returns a bool value if a threshold is reached.
+// If the admission controller doesn't know the memory usage of the broker, there is no limit
 func schedulerByMemoryLoad() bool {
-	resFlag := false
-	var memTotalAvailable uint64
-	var memTotalInUse uint64
-	for k := range resManager {
-		memTotalInUse += resManager[k].MemUsed
-		memTotalAvailable += resManager[k].MemLimit
+	admissionStateMu.RLock()
+	defer admissionStateMu.RUnlock()
+	if admissionState.MemLimit == 0 {
+		return true
 	}
-
-	if memTotalInUse < ((memTotalAvailable * memoryThreshold) / 100) {
-		resFlag = true
-	}
-	return resFlag
+	return admissionState.MemUsed < ((admissionState.MemLimit * memoryThreshold) / 100)
 }
 
 // if the number of messages in the queue too high we should not accept the new messages
 func schedulerByWorkerNumber() bool {
-	resFlag := false
-	if getQueueLen() < (queueManager.NumConsumers * factorForMessageAccept) {
-		resFlag = true
+	admissionStateMu.RLock()
+	defer admissionStateMu.RUnlock()
+	return getQueueLen()+reservedSlots < admissionState.Capacity
+}
+
+// reserveSlots takes n slots of the capacity at once, so a batch is either accepted as a whole or not at all
+func reserveSlots(n uint) bool {
+	admissionStateMu.Lock()
+	defer admissionStateMu.Unlock()
+	if getQueueLen()+reservedSlots+n > admissionState.Capacity {
+		return false
 	}
-	return resFlag
+	reservedSlots += n
+	return true
+}
+
+// releaseSlots frees reserved slots, the requests of the batch are in the queue or have failed
+func releaseSlots(n uint) {
+	admissionStateMu.Lock()
+	defer admissionStateMu.Unlock()
+	if n > reservedSlots {
+		n = reservedSlots
+	}
+	reservedSlots -= n
 }
 
 // SetResManagerState sets boolean value of resource manager; if memory of rabbitMQ and the number
 // messages is not exceeding  the limit
 func SetResManagerState(ampqAPIConfig *RabbitConfig) {
-	var sleepFor time.Duration = 5
-	resManager = newOcrResManager()
-	queueManager = newOcrQueueManager()
-	urlQueue := ampqAPIConfig.AmqpAPIURI + ampqAPIConfig.APIPathQueue + ampqAPIConfig.APIQueueName
-	urlStat := ampqAPIConfig.AmqpAPIURI + ampqAPIConfig.APIPathStats
-	factorForMessageAccept = ampqAPIConfig.FactorForMessageAccept
+	sleepFor := time.Duration(resManagerInterval)
+	admissionConfig := currentConfig(ampqAPIConfig)
+	controller, err := NewAdmissionController(admissionConfig)
+	if err != nil {
+		log.Fatal().Err(err).Str("component", "OCR_RESMAN").Msg("can't create admission controller")
+	}
+	defer func() {
+		if err := controller.Close(); err != nil {
+			log.Warn().Err(err).Str("component", "OCR_RESMAN").Msg("can't close admission controller")
+		}
+	}()
+	log.Info().Str("component", "OCR_RESMAN").Str("admission", ampqAPIConfig.Admission).Msg("admission controller created")
 
 	boolCurValue := false
 	boolOldValue := true
@@ -144,18 +142,39 @@ Loop:
 			ServiceCanAcceptMu.Unlock()
 			break Loop
 		default:
+			// worker_factor and max_in_flight may have been reloaded
+			if reloaded := currentConfig(ampqAPIConfig); reloaded.FactorForMessageAccept != admissionConfig.FactorForMessageAccept ||
+				reloaded.MaxInFlight != admissionConfig.MaxInFlight {
+				if reloadedController, err := NewAdmissionController(reloaded); err != nil {
+					log.Error().Err(err).Str("component", "OCR_RESMAN").Msg("keeping the admission controller")
+				} else {
+					// the replaced controller may hold a connection to the broker
+					if err := controller.Close(); err != nil {
+						log.Warn().Err(err).Str("component", "OCR_RESMAN").Msg("can't close admission controller")
+					}
+					controller = reloadedController
+					log.Info().Str("component", "OCR_RESMAN").Uint("worker_factor", reloaded.FactorForMessageAccept).
+						Uint("max_in_flight", reloaded.MaxInFlight).Msg("admission controller updated")
+				}
+				admissionConfig = reloaded
+			}
 			// only print the RESMAN output if the state has changed
+			throughput.tick(time.Now())
 			ServiceCanAcceptMu.Lock()
-			boolOldValue, boolCurValue = boolCurValue, CheckForAcceptRequest(urlQueue, urlStat)
+			boolOldValue, boolCurValue = boolCurValue, CheckForAcceptRequest(controller)
 			ServiceCanAccept = boolCurValue
 			ServiceCanAcceptMu.Unlock()
 			if boolCurValue != boolOldValue {
+				admissionStateMu.RLock()
 				log.Info().Str("component", "OCR_RESMAN").
-					Uint("MessageBytes", queueManager.MessageBytes).
-					Uint("NumConsumers", queueManager.NumConsumers).
-					Uint("NumMessages", queueManager.NumMessages).
-					Interface("resManager", resManager).
+					Uint("NumConsumers", admissionState.NumConsumers).
+					Uint("NumMessages", admissionState.NumMessages).
+					Uint("Capacity", admissionState.Capacity).
+					Uint64("MemUsed", admissionState.MemUsed).
+					Uint64("MemLimit", admissionState.MemLimit).
+					Str("reason", admissionReason).
 					Msg("OCR_RESMAN stats")
+				admissionStateMu.RUnlock()
 
 				if boolCurValue {
 					log.Info().Str("component", "OCR_RESMAN").Msg("open-ocr is operational with free resources, we are ready to serve")
@@ -19,6 +19,7 @@ func CheckOcrStatusByID(requestID string) (OcrResult, bool) {
 		select {
 		case ocrResult = <-tempChannel:
 			defer deleteRequestFromQueue(requestID)
+			jobEvents.publish(JobEvent{ID: requestID, State: JobDelivered})
 			// log.Debug().Str("component", "OCR_CLIENT").Msg("got ocrResult := <-Requests[requestID]")
 			return ocrResult, true
 		default:
@@ -40,10 +41,14 @@ func deleteRequestFromQueue(requestID string) {
 		inFlightGauge.Dec()
 		RequestsTrack.Delete(requestID)
 	}
+	requestTenants.Delete(requestID)
+	clientShares.release(requestID)
+	tenantLoad.release(requestID)
 }
 
-func addNewOcrResultToQueue(requestID string, rpcResponseChan chan OcrResult) {
+func addNewOcrResultToQueue(requestID, tenant string, rpcResponseChan chan OcrResult) {
 	atomic.AddUint32(&RequestTrackLength, 1)
+	requestTenants.Store(requestID, tenant)
 	inFlightGauge.Inc()
 	RequestsTrack.Store(requestID, rpcResponseChan)
 }
@@ -17,7 +17,6 @@ import (
 
 // rpcResponseTimeout sets timeout for getting the result from channel
 var rpcResponseTimeout = time.Second * 20
-var numRetries uint = 3
 
 type OcrRpcClient struct {
 	rabbitConfig RabbitConfig
@@ -29,6 +28,8 @@ type OcrResult struct {
 	Text   string `json:"text"`
 	Status string `json:"status"`
 	ID     string `json:"id"`
+	// Cached is set if the result was taken from the result cache instead of a worker
+	Cached bool `json:"cached,omitempty"`
 }
 
 func NewOcrRpcClient(rc *RabbitConfig) (*OcrRpcClient, error) {
@@ -54,11 +55,15 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest) (OcrResult, int, erro
 		Bool("InplaceDecode", ocrRequest.InplaceDecode).
 		Uint16("PageNumber", ocrRequest.PageNumber).
 		Str("ReplyTo", ocrRequest.ReplyTo).
-		Str("UserAgent", ocrRequest.UserAgent).
+		Str("ClientID", ocrRequest.ClientID).
+		Str("Tenant", ocrRequest.Tenant).
 		Str("EngineType", ocrRequest.EngineType.String()).
 		Str("ReferenceID", ocrRequest.ReferenceID).
 		Msg("incoming request")
 
+	// the download and the publishing are part of the trace of the http request
+	traceCtx := contextWithTraceParent(ocrRequest.traceParent)
+
 	if ocrRequest.ReplyTo != "" {
 		logger.Info().Msg("Automated response requested")
 		validURL, err := checkURLForReplyTo(ocrRequest.ReplyTo)
@@ -70,22 +75,70 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest) (OcrResult, int, erro
 		// ocr automatically to the URL in ReplyTo tag
 		ocrRequest.Deferred = true
 	}
+	if ocrRequest.batchID != "" {
+		// the result is collected by the batch
+		ocrRequest.Deferred = true
+	}
+
+	messagePriority := ocrRequest.messagePriority(c.rabbitConfig.QueuePrio)
+	logger.Info().Str("DocType", ocrRequest.DocType).Uint8("ClientPriority", ocrRequest.Priority).
+		Uint8("priority", messagePriority).Msg("priority of the message")
+	if fair := fairPriority(ocrRequest.Tenant, messagePriority); fair != messagePriority {
+		logger.Info().Str("Tenant", ocrRequest.Tenant).Uint8("priority", fair).
+			Msg("tenant exceeds its fair share, lowering the priority of the request")
+		messagePriority = fair
+	}
+	// setting the timeout for worker if not set or to high, workers won't process the job after its deadline
+	ocrRequest.setDeadline(&c.rabbitConfig)
 
-	var messagePriority uint8 = 1
-	if ocrRequest.DocType != "" {
-		logger.Info().Str("DocType", ocrRequest.DocType).
-			Msg("message type is specified, check for higher priority request")
-		// set highest priority for defined message id
-		logger.Debug().Interface("doc_types_available", c.rabbitConfig.QueuePrio)
-		if val, ok := c.rabbitConfig.QueuePrio[ocrRequest.DocType]; ok {
-			messagePriority = val
+	// if rabbitmq isn't in same data center as open-ocr, it will be expensive in terms of bandwidth
+	// to have image binary in messages. With FetchImgURLInWorker the url is forwarded instead and
+	// the first preprocessor or worker which needs the image will download it
+	if ocrRequest.ImgBytes == nil {
+		// if we do not have bytes use base 64 file by converting it to bytes
+		if ocrRequest.hasBase64() {
+			logger.Info().Msg("OCR request has base 64 convert it to bytes")
+
+			err = ocrRequest.decodeBase64()
+			if err != nil {
+				logger.Warn().Err(err).Msg("Error decoding base64")
+				return OcrResult{}, 500, err
+			}
+		} else if c.rabbitConfig.FetchImgURLInWorker {
+			// check the url now, so the client gets an error instead of a failed job
+			if _, err = c.rabbitConfig.ImgURLFetch.checkURL(ocrRequest.ImgUrl); err != nil {
+				logger.Warn().Err(err).Msg("img_url is not allowed")
+				return OcrResult{}, 400, err
+			}
+			logger.Info().Msg("img_url will be fetched by the first preprocessor or worker")
 		} else {
-			messagePriority = c.rabbitConfig.QueuePrio["standard"]
+			// if we do not have base 64 or bytes download the file
+			err = ocrRequest.downloadImgUrl(traceCtx, &c.rabbitConfig.ImgURLFetch)
+			if err != nil {
+				logger.Warn().Err(err).Msg("Error downloading img urlToLog")
+				return OcrResult{}, 500, err
+			}
 		}
 	}
-	// setting the timeout for worker if not set or to high
-	if ocrRequest.TimeOut >= c.rabbitConfig.MaximalResponseCacheTimeout || ocrRequest.TimeOut == 0 {
-		ocrRequest.TimeOut = c.rabbitConfig.ResponseCacheTimeout
+
+	ocrRequest.ImgSize = int64(len(ocrRequest.ImgBytes))
+	logger.Info().Int64("ImgSize", ocrRequest.ImgSize).Msg("image of the request")
+
+	cacheKey := ""
+	if c.rabbitConfig.ResultCache.TTL > 0 {
+		cacheKey = ocrRequest.cacheKey()
+	}
+	if cacheKey != "" {
+		if cached, ok := resultCache.get(cacheKey); ok {
+			logger.Info().Str("CachedID", cached.ID).Msg("identical document was processed before, answering from the result cache")
+			cached.ID = ocrRequest.RequestID
+			cached.Cached = true
+			jobEvents.open(ocrRequest.RequestID, ocrRequest.Tenant, ocrRequest.Deadline.Add(rpcResponseTimeout))
+			jobEvents.publish(JobEvent{ID: ocrRequest.RequestID, State: JobCompleted, Message: "answered from the result cache"})
+			rpcResponseChan := make(chan OcrResult, 1)
+			rpcResponseChan <- cached
+			return c.awaitResult(ocrRequest, rpcResponseChan, logger)
+		}
 	}
 
 	// setting rabbitMQ correlation ID. There is no reason to be different from requestID
@@ -139,31 +192,7 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest) (OcrResult, int, erro
 		defer confirmDelivery(ack, nack)
 	}
 
-	// TODO: we only need to download image urlToLog if there are
-	// any preprocessors.  if rabbitmq isn't in same data center
-	// as open-ocr, it will be expensive in terms of bandwidth
-	// to have image binary in messages
-	if ocrRequest.ImgBytes == nil {
-		// if we do not have bytes use base 64 file by converting it to bytes
-		if ocrRequest.hasBase64() {
-			logger.Info().Msg("OCR request has base 64 convert it to bytes")
-
-			err = ocrRequest.decodeBase64()
-			if err != nil {
-				logger.Warn().Err(err).Msg("Error decoding base64")
-				return OcrResult{}, 500, err
-			}
-		} else {
-			// if we do not have base 64 or bytes download the file
-			err = ocrRequest.downloadImgUrl()
-			if err != nil {
-				logger.Warn().Err(err).Msg("Error downloading img urlToLog")
-				return OcrResult{}, 500, err
-			}
-		}
-	}
-
-	routingKey := ocrRequest.nextPreprocessor(c.rabbitConfig.RoutingKey)
+	routingKey := ocrRequest.nextPreprocessor(c.rabbitConfig.Scheduling.routingKey(c.rabbitConfig.RoutingKey, ocrRequest))
 	logger.Info().Str("routingKey", routingKey).Msg("publishing with routing key")
 
 	ocrRequestJson, err := json.Marshal(ocrRequest)
@@ -173,14 +202,22 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest) (OcrResult, int, erro
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err = c.channel.PublishWithContext(
+	// the log has to exist before the first preprocessor or worker reports progress
+	jobEvents.open(ocrRequest.RequestID, ocrRequest.Tenant, ocrRequest.Deadline.Add(rpcResponseTimeout))
+	jobEvents.publish(JobEvent{ID: ocrRequest.RequestID, State: JobQueued})
+	if cacheKey != "" {
+		resultCache.expect(ocrRequest.RequestID, cacheKey, ocrRequest.Deadline.Add(rpcResponseTimeout))
+	}
+	// the preprocessors and workers continue the trace from the headers of the message
+	publishCtx, publishSpan := startPublishSpan(traceCtx, c.rabbitConfig.Exchange, routingKey, ocrRequest.RequestID)
+	err = c.channel.PublishWithContext(
 		ctx,
 		c.rabbitConfig.Exchange, // publish to an exchange
 		routingKey,
 		false, // mandatory
 		false, // immediate
 		amqp.Publishing{
-			Headers:         amqp.Table{},
+			Headers:         traceHeaders(publishCtx, amqp.Table{publishedAtHeader: time.Now().UnixMilli()}),
 			ContentType:     "application/json",
 			ContentEncoding: "",
 			Body:            ocrRequestJson,
@@ -190,17 +227,25 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest) (OcrResult, int, erro
 			CorrelationId:   correlationID,
 			// a bunch of application/implementation-specific fields
 		},
-	); err != nil {
+	)
+	endSpan(publishSpan, err)
+	if err != nil {
 		return OcrResult{}, 500, nil
 	}
 
+	return c.awaitResult(ocrRequest, rpcResponseChan, logger)
+}
+
+// awaitResult waits for the result of a published request. Deferred requests are answered with their RequestID,
+// the result is delivered to reply_to, collected by the batch or kept for /ocr-status
+func (c *OcrRpcClient) awaitResult(ocrRequest *OcrRequest, rpcResponseChan chan OcrResult, logger zerolog.Logger) (OcrResult, int, error) {
 	if ocrRequest.Deferred {
 		logger.Info().Msg("Asynchronous request accepted")
 
-		addNewOcrResultToQueue(ocrRequest.RequestID, rpcResponseChan)
+		addNewOcrResultToQueue(ocrRequest.RequestID, ocrRequest.Tenant, rpcResponseChan)
 		// deferred == true but no automatic reply to the requester
 		// client should poll to get the ocr
-		if ocrRequest.ReplyTo == "" {
+		if ocrRequest.ReplyTo == "" && ocrRequest.batchID == "" {
 			// this go routine will cancel the request after global timeout or if requester doesn't retrieve the request
 			logger.Info().Msg("deferred request without reply-to address set, will decay automatically after " + strconv.FormatUint(uint64(ocrRequest.TimeOut), 10) + " seconds")
 			go func() {
@@ -211,6 +256,7 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest) (OcrResult, int, erro
 					case <-timeout:
 						if _, ok := RequestsTrack.Load(ocrRequest.RequestID); ok {
 							deleteRequestFromQueue(ocrRequest.RequestID)
+							jobEvents.publish(JobEvent{ID: ocrRequest.RequestID, State: JobFailed, Message: "result was not claimed in time"})
 							logger.Info().Msg("deferred request without reply-to address has decayed, client doesn't claimed request in time")
 							break Loop
 						}
@@ -227,7 +273,7 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest) (OcrResult, int, erro
 				ID:     ocrRequest.RequestID,
 			}, 200, nil
 		}
-		// automatic delivery POST to the requester
+		// automatic delivery POST to the requester or to the batch of the request
 		// check interval for order to be ready to deliver
 		go func(requestID string) {
 			// trigger deleting request from internal queue
@@ -239,41 +285,24 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest) (OcrResult, int, erro
 				//	}
 			}()
 			ocrRes := OcrResult{ID: ocrRequest.RequestID, Status: "error", Text: ""}
-			ocrPostClient := newOcrPostClient()
-			var tryCounter uint = 1
-		T:
-			for {
-				select {
-				case ocrResult := <-rpcResponseChan:
-					logger.Info().Msg("request is ready for sending back")
-					ocrRes = ocrResult
-					for ok := true; ok; ok = tryCounter <= numRetries {
-						err = ocrPostClient.postOcrRequest(&ocrRes, ocrRequest.ReplyTo, tryCounter)
-						if err != nil {
-							logger.Info().Uint("delivery_attempt", tryCounter).Msg("delivery attempt " +
-								strconv.FormatUint(uint64(tryCounter), 10) + " was not successful, attempt " + strconv.FormatUint(uint64(tryCounter), 10) +
-								"/" + strconv.FormatUint(uint64(numRetries), 10))
-							tryCounter++
-							logger.Error().Err(err)
-							time.Sleep(2 * time.Second)
-						} else {
-							logger.Debug().Msg("delivery was successful")
-							break T
-						}
-					}
-					break T
-				case <-time.After(rpcResponseTimeout * time.Second):
-					err = ocrPostClient.postOcrRequest(&ocrRes, ocrRequest.ReplyTo, tryCounter)
-					if err != nil {
-						tryCounter++
-						logger.Error().Err(err)
-						time.Sleep(rpcResponseTimeout * time.Second)
-					} else {
-						break T
-					}
-					break T
-				}
+			select {
+			case ocrResult := <-rpcResponseChan:
+				logger.Info().Msg("request is ready for sending back")
+				ocrRes = ocrResult
+			case <-time.After(time.Until(ocrRequest.Deadline) + rpcResponseTimeout):
+				logger.Warn().Msg("no result before the deadline, sending an error back")
+				ocrRes.Text = "timeout waiting for RPC response"
+				jobEvents.publish(JobEvent{ID: requestID, State: JobFailed, Message: ocrRes.Text})
 			}
+			if ocrRequest.batchID != "" {
+				jobEvents.publish(JobEvent{ID: requestID, State: JobDelivered})
+				batches.complete(ocrRequest.batchID, ocrRequest.batchIndex, ocrRes, &c.rabbitConfig)
+				return
+			}
+			jobEvents.keepUntil(requestID, time.Now().Add(time.Duration(c.rabbitConfig.Outbox.RetryWindow)*time.Second))
+			// the outbox retries until the requester accepts the result, even across restarts
+			currentOutbox(&c.rabbitConfig).Enqueue(contextWithTraceParent(ocrRequest.traceParent), ocrRes, ocrRequest.ReplyTo,
+				ocrRequest.Tenant, ocrRequest.postbackClientID)
 		}(ocrRequest.RequestID)
 		// initial response to the caller to inform it with request id
 		return OcrResult{
@@ -284,8 +313,10 @@ func (c *OcrRpcClient) DecodeImage(ocrRequest *OcrRequest) (OcrResult, int, erro
 		select {
 		case ocrResult := <-rpcResponseChan:
 			// logger.Debug().Str("st", ocrResult.Status).Str("text", ocrResult.Text).Str("id", ocrResult.ID)
+			jobEvents.publish(JobEvent{ID: ocrRequest.RequestID, State: JobDelivered})
 			return ocrResult, 200, nil
 		case <-time.After(time.Duration(c.rabbitConfig.ResponseCacheTimeout) * time.Second):
+			jobEvents.publish(JobEvent{ID: ocrRequest.RequestID, State: JobFailed, Message: "timeout waiting for RPC response"})
 			return OcrResult{}, 500, fmt.Errorf("timeout waiting for RPC response")
 		}
 	}
@@ -348,6 +379,16 @@ func (c *OcrRpcClient) handleRPCResponse(deliveries <-chan amqp.Delivery, correl
 	logger.Debug().Int("deliveries", len(deliveries)).Msg("Number of elements in deliveries variable")
 	for d := range deliveries {
 		logger.Debug().Str("deliveries", d.CorrelationId).Msg("looping over deliveries variable")
+		if d.CorrelationId == correlationID && d.Type == jobEventMessageType {
+			event := JobEvent{}
+			if err := json.Unmarshal(d.Body, &event); err != nil {
+				logger.Warn().Err(err).Msg("ignoring malformed progress message")
+				continue
+			}
+			event.ID = correlationID
+			jobEvents.publish(event)
+			continue
+		}
 		if d.CorrelationId == correlationID {
 			bodyLenToLog := len(d.Body)
 			logger.Debug().Str("deliveries", d.CorrelationId).Msg("reached if in d.CorrelationId == correlationID")
@@ -373,7 +414,10 @@ func (c *OcrRpcClient) handleRPCResponse(deliveries <-chan amqp.Delivery, correl
 				logger.Error().Err(fmt.Errorf(errMsg))
 			}
 			ocrResult.ID = correlationID
+			jobEvents.publish(resultEvent(&ocrResult))
+			resultCache.store(&ocrResult, c.rabbitConfig.ResultCache)
 
+			throughput.markCompleted()
 			logger.Info().Msg("send result to rpcResponseChan")
 			rpcResponseChan <- ocrResult
 			logger.Info().Msg("sent result to rpcResponseChan")
@@ -3,9 +3,12 @@ package ocrworker
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
@@ -20,20 +23,34 @@ type OcrRpcWorker struct {
 	conn         *amqp.Connection
 	channel      *amqp.Channel
 	tag          string
+	// consumerTags of all consumed queues, more than one with weighted scheduling
+	consumerTags []string
 	Done         chan error
+	// jobCtx is the parent of all job contexts, it is canceled if the shutdown grace period is exceeded
+	jobCtx     context.Context
+	cancelJobs context.CancelFunc
+	draining   int32
+	// confirmMu serializes publishing in reliable mode, each publishing waits for its own confirmation
+	confirmMu sync.Mutex
 }
 
 // tag is based on K-Sortable Globally Unique IDs
 var tag = ksuid.New().String()
 
+// errJobAborted marks a job which was interrupted by a shutdown and has to be requeued
+var errJobAborted = errors.New("job was aborted by worker shutdown")
+
 // NewOcrRpcWorker is needed to establish a connection to a message broker
 func NewOcrRpcWorker(wc *WorkerConfig) (*OcrRpcWorker, error) {
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
 	ocrRpcWorker := &OcrRpcWorker{
 		workerConfig: *wc,
 		conn:         nil,
 		channel:      nil,
 		tag:          tag,
 		Done:         make(chan error),
+		jobCtx:       jobCtx,
+		cancelJobs:   cancelJobs,
 	}
 	return ocrRpcWorker, nil
 }
@@ -67,6 +84,7 @@ func (w *OcrRpcWorker) Run() error {
 
 	go func() {
 		fmt.Printf("closing: %s", <-w.conn.NotifyClose(make(chan *amqp.Error)))
+		processHealth.setConnected(false)
 	}()
 
 	log.Info().Str("component", "OCR_WORKER").
@@ -76,8 +94,19 @@ func (w *OcrRpcWorker) Run() error {
 	if err != nil {
 		return err
 	}
-	// setting the prefetchCount to 1 reduces the Memory Consumption by the worker
-	err = w.channel.Qos(int(w.workerConfig.NumParallelJobs), 0, true)
+	if w.workerConfig.Scheduling.weighted() {
+		// RabbitMQ applies a non-global prefetch count per consumer. Every class may have all jobs running
+		// and one more delivery waiting in the dispatcher, the dispatcher decides which class runs next.
+		// The global prefetch count limits the channel to all jobs and one waiting delivery per class
+		err = w.channel.Qos(int(w.workerConfig.NumParallelJobs)+1, 0, false)
+		if err == nil {
+			err = w.channel.Qos(int(w.workerConfig.NumParallelJobs)+len(w.workerConfig.Scheduling.classes()), 0, true)
+		}
+	} else {
+		// the prefetchCount equals the number of parallel jobs, so no message is waiting in a busy worker
+		// while another worker is idle. Setting it to 1 reduces the Memory Consumption by the worker
+		err = w.channel.Qos(int(w.workerConfig.NumParallelJobs), 0, true)
+	}
 	if err != nil {
 		return err
 	}
@@ -94,10 +123,40 @@ func (w *OcrRpcWorker) Run() error {
 		return err
 	}
 
-	// just use the routing key as the queue name, since there's no reason
-	// to have a different name
-	queueName := w.workerConfig.RoutingKey
+	if !w.workerConfig.Scheduling.weighted() {
+		deliveries, err := w.consume(w.workerConfig.RoutingKey, tag, queueArgs)
+		if err != nil {
+			return err
+		}
+		w.consumerTags = []string{tag}
+		processHealth.setConnected(true)
+		go w.handle(deliveries, w.Done)
+		return nil
+	}
 
+	// weighted scheduling: one queue per class, merged by the dispatcher
+	classes := w.workerConfig.Scheduling.classes()
+	classDeliveries := make([]<-chan amqp.Delivery, 0, len(classes))
+	for _, class := range classes {
+		queueName := w.workerConfig.Scheduling.queueName(w.workerConfig.RoutingKey, class)
+		consumerTag := tag + "." + class
+		deliveries, err := w.consume(queueName, consumerTag, queueArgs)
+		if err != nil {
+			return err
+		}
+		w.consumerTags = append(w.consumerTags, consumerTag)
+		classDeliveries = append(classDeliveries, deliveries)
+	}
+	deliveries := make(chan amqp.Delivery)
+	go newWeightedDispatcher(classes, &w.workerConfig.Scheduling).run(classDeliveries, deliveries)
+	processHealth.setConnected(true)
+	go w.handle(deliveries, w.Done)
+
+	return nil
+}
+
+// consume declares the queue queueName, binds it to the routing key of the same name and starts consuming it
+func (w *OcrRpcWorker) consume(queueName, consumerTag string, queueArgs amqp.Table) (<-chan amqp.Delivery, error) {
 	queue, err := w.channel.QueueDeclare(
 		queueName, // name of the queue
 		true,      // durable
@@ -107,63 +166,119 @@ func (w *OcrRpcWorker) Run() error {
 		queueArgs, // arguments
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Info().Str("component", "OCR_WORKER").Str("RoutingKey", w.workerConfig.RoutingKey).
+	log.Info().Str("component", "OCR_WORKER").Str("RoutingKey", queueName).
 		Str("tag", tag).
 		Msg("binding to routing key")
 
+	// just use the queue name as the routing key, since there's no reason
+	// to have a different name
 	if err := w.channel.QueueBind(
-		queue.Name,                // name of the queue
-		w.workerConfig.RoutingKey, // bindingKey
-		w.workerConfig.Exchange,   // sourceExchange
-		false,                     // noWait
-		queueArgs,                 // arguments
+		queue.Name,              // name of the queue
+		queueName,               // bindingKey
+		w.workerConfig.Exchange, // sourceExchange
+		false,                   // noWait
+		queueArgs,               // arguments
 	); err != nil {
-		return err
+		return nil, err
 	}
 
-	log.Info().Str("component", "OCR_WORKER").Str("tag", tag).
+	log.Info().Str("component", "OCR_WORKER").Str("tag", consumerTag).
 		Msg("Queue bound to Exchange, starting Consume tag")
-	deliveries, err := w.channel.Consume(
-		queue.Name, // name
-		tag,        // consumerTag,
-		false,      // noAck
-		false,      // exclusive
-		false,      // noLocal
-		false,      // noWait
-		queueArgs,  // arguments
+	return w.channel.Consume(
+		queue.Name,  // name
+		consumerTag, // consumerTag,
+		false,       // noAck
+		false,       // exclusive
+		false,       // noLocal
+		false,       // noWait
+		queueArgs,   // arguments
 	)
-	if err != nil {
-		return err
-	}
-
-	go w.handle(deliveries, w.Done)
-
-	return nil
 }
 
+// Shutdown stops consuming new messages and gives the running job the configured grace period to finish.
+// Prefetched messages and a job which could not be finished in time are requeued
 func (w *OcrRpcWorker) Shutdown() error {
-	// will close() the deliveries channel
-	if err := w.channel.Cancel(w.tag, true); err != nil {
-		return fmt.Errorf("worker with tag %s cancel failed: %s", tag, err)
+	atomic.StoreInt32(&w.draining, 1)
+	processHealth.setDraining()
+	// will close() the deliveries channels after the prefetched deliveries were handed over
+	for _, consumerTag := range w.consumerTags {
+		if err := w.channel.Cancel(consumerTag, false); err != nil {
+			return fmt.Errorf("worker with tag %s cancel failed: %s", consumerTag, err)
+		}
+	}
+
+	// wait for handle() to exit
+	grace := time.Duration(w.workerConfig.ShutdownGrace) * time.Second
+	select {
+	case <-w.Done:
+	case <-time.After(grace):
+		log.Warn().Str("component", "OCR_WORKER").
+			Str("tag", tag).
+			Dur("grace", grace).
+			Msg("shutdown grace period exceeded, aborting running job")
+		w.cancelJobs()
+		<-w.Done
 	}
 
 	if err := w.conn.Close(); err != nil {
 		return fmt.Errorf("AMQP connection with worker %s close error: %s", tag, err)
 	}
 
-	defer log.Info().Str("component", "OCR_WORKER").
+	log.Info().Str("component", "OCR_WORKER").
 		Str("tag", tag).
 		Msg("Shutdown OK")
-
-	// wait for handle() to exit
-	return <-w.Done
+	return nil
 }
 
+// handle starts NumParallelJobs goroutines which share the deliveries and waits until all of them have exited.
+// The number of jobs held in memory is bounded by the prefetch count which is set to the same value
 func (w *OcrRpcWorker) handle(deliveries <-chan amqp.Delivery, done chan error) {
+	numParallelJobs := int(w.workerConfig.NumParallelJobs)
+	if numParallelJobs < 1 {
+		numParallelJobs = 1
+	}
+
+	errs := make(chan error, numParallelJobs)
+	var (
+		wg   sync.WaitGroup
+		stop sync.Once
+	)
+	for i := 0; i < numParallelJobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.processDeliveries(deliveries); err != nil {
+				// the worker fails as a whole, not one goroutine after the other
+				stop.Do(w.stopPool)
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	handleErr, ok := <-errs
+	if !ok {
+		log.Info().Str("component", "OCR_WORKER").
+			Str("tag", tag).
+			Msg("handle: deliveries channel closed")
+		handleErr = fmt.Errorf("handle: deliveries channel closed")
+	}
+	done <- handleErr
+}
+
+// processDeliveries runs one job at a time until the deliveries channel is closed,
+// every delivery is acknowledged as soon as its job is finished
+func (w *OcrRpcWorker) processDeliveries(deliveries <-chan amqp.Delivery) error {
 	for d := range deliveries {
+		if atomic.LoadInt32(&w.draining) == 1 {
+			w.requeue(&d)
+			continue
+		}
+
 		log.Info().Str("component", "OCR_WORKER").
 			Str("tag", tag).
 			Int("msg_size", len(d.Body)).
@@ -178,7 +293,13 @@ func (w *OcrRpcWorker) handle(deliveries <-chan amqp.Delivery, done chan error)
 			Msg("worker got delivery, starting processing")
 		// reply from engine here
 		// id is not set, Text is set, Status is set
+		processHealth.jobStarted(d.CorrelationId)
 		ocrResult, err := w.resultForDelivery(&d)
+		processHealth.jobFinished(d.CorrelationId, err == nil, errors.Is(err, errJobAborted))
+		if errors.Is(err, errJobAborted) {
+			w.requeue(&d)
+			continue
+		}
 		if err != nil {
 			log.Error().Err(err).Str("component", "OCR_WORKER").
 				Str("RequestID", d.CorrelationId).
@@ -193,9 +314,9 @@ func (w *OcrRpcWorker) handle(deliveries <-chan amqp.Delivery, done chan error)
 				Str("tag", tag).
 				Msg("Error generating ocr result, sendRpcResponse failed")
 
-			// if we can't send our response, let's just abort
-			done <- err
-			break
+			// if we can't send our response, another worker has to process the job
+			w.requeue(&d)
+			return err
 		}
 		err = d.Ack(false)
 		if err != nil {
@@ -205,10 +326,34 @@ func (w *OcrRpcWorker) handle(deliveries <-chan amqp.Delivery, done chan error)
 		}
 
 	}
+	return nil
+}
+
+// stopPool is called if a job could not be finished. It stops consuming, aborts the running jobs and lets the
+// other goroutines requeue the deliveries they hold, so handle reports the error as soon as possible
+func (w *OcrRpcWorker) stopPool() {
+	atomic.StoreInt32(&w.draining, 1)
+	w.cancelJobs()
+	for _, consumerTag := range w.consumerTags {
+		if err := w.channel.Cancel(consumerTag, false); err != nil {
+			log.Warn().Str("component", "OCR_WORKER").Err(err).
+				Str("tag", consumerTag).
+				Msg("consumer could not be canceled")
+		}
+	}
+}
+
+// requeue gives the delivery back to the broker, so another worker can process it
+func (*OcrRpcWorker) requeue(d *amqp.Delivery) {
 	log.Info().Str("component", "OCR_WORKER").
 		Str("tag", tag).
-		Msg("handle: deliveries channel closed")
-	done <- fmt.Errorf("handle: deliveries channel closed")
+		Str("RequestID", d.CorrelationId).
+		Msg("delivery is not processed by this worker, requeue delivery")
+	if err := d.Nack(false, true); err != nil {
+		log.Warn().Str("component", "OCR_WORKER").Err(err).
+			Str("tag", tag).
+			Msg("Nack() was not successful")
+	}
 }
 
 func (w *OcrRpcWorker) resultForDelivery(d *amqp.Delivery) (OcrResult, error) {
@@ -227,8 +372,45 @@ func (w *OcrRpcWorker) resultForDelivery(d *amqp.Delivery) (OcrResult, error) {
 		return ocrResult, err
 	}
 
-	ocrEngine := NewOcrEngine(ocrRequest.EngineType)
-	ocrResult, err = ocrEngine.ProcessRequest(&ocrRequest, &w.workerConfig)
+	// the client has already got a timeout, there is no reason to run the engine
+	if ocrRequest.deadlineExceeded() {
+		err = fmt.Errorf("job deadline %s was exceeded before processing started", ocrRequest.Deadline.Format(time.RFC3339))
+		log.Warn().Err(err).
+			Str("RequestID", ocrRequest.RequestID).
+			Str("tag", tag).
+			Msg("dropping expired job")
+		ocrResult.Text = err.Error()
+		ocrResult.Status = "error"
+		return ocrResult, err
+	}
+
+	publishJobEvent(w.channel, w.workerConfig.Exchange, d, JobEvent{State: JobProcessing})
+	// the job continues the trace of the request from the headers of the message
+	ctx, span := startConsumerSpan(w.jobCtx, "ocr "+d.RoutingKey, d)
+	defer span.End()
+	ctx, cancel := ocrRequest.jobContext(ctx)
+	defer cancel()
+
+	// every job gets its own temp directory, so parallel jobs can't interfere with each other
+	jobTempDir, err := os.MkdirTemp("", "open-ocr-job-")
+	if err != nil {
+		ocrResult.Text = "Internal server error"
+		ocrResult.Status = "error"
+		return ocrResult, err
+	}
+	if !w.workerConfig.SaveFiles {
+		defer func(dir string) {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Warn().Err(err).Str("component", "OCR_WORKER").Msg(dir + " could not be removed")
+			}
+		}(jobTempDir)
+	}
+	ctx = withJobTempDir(ctx, jobTempDir)
+
+	ocrResult, err = processRequest(ctx, &ocrRequest, &w.workerConfig)
+	if w.jobCtx.Err() != nil {
+		return ocrResult, errJobAborted
+	}
 	if err != nil {
 		msg := "Error processing image url: %v.  Error: %v"
 		errMsg := fmt.Sprintf(msg, ocrRequest.RequestID, err)
@@ -252,6 +434,8 @@ func (w *OcrRpcWorker) sendRpcResponse(r OcrResult, replyTo, correlationId strin
 		Str("RequestID", correlationId).Timestamp().Logger()
 
 	if w.workerConfig.Reliable {
+		w.confirmMu.Lock()
+		defer w.confirmMu.Unlock()
 		// Do not use w.workerConfig.Reliable=true due to major issues
 		// that will completely  wedge the rpc worker.  Setting the
 		// buffered channels length higher would delay the problem,
@@ -1,12 +1,12 @@
 package ocrworker
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
@@ -15,41 +15,6 @@ import (
 	"github.com/segmentio/ksuid"
 )
 
-func saveUrlContentToFileName(uri, tmpFileName string) error {
-	outFile, err := os.Create(tmpFileName)
-	if err != nil {
-		return err
-	}
-	defer func(outFile *os.File) {
-		err := outFile.Close()
-		if err != nil {
-			log.Warn().Err(err).Caller().Str("component", "OCR_UTIL").Msg(outFile.Name() + " could not be closed")
-		}
-	}(outFile)
-
-	resp, err := http.Get(uri)
-	if err != nil {
-		return err
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Warn().Err(err).Caller().Str("component", "OCR_UTIL").Msg(resp.Request.RequestURI + " request Body could not be closed")
-		}
-	}(resp.Body)
-
-	if resp.StatusCode != http.StatusOK {
-		return err
-	}
-
-	_, err = io.Copy(outFile, resp.Body)
-	if err != nil {
-		log.Warn().Err(err).Caller().Str("component", "OCR_UTIL").Msg(outFile.Name() + " could not be written")
-		return err
-	}
-	return err
-}
-
 func saveBytesToFileName(bytes []byte, tmpFileName string) error {
 	return os.WriteFile(tmpFileName, bytes, 0600)
 }
@@ -77,10 +42,21 @@ func url2bytes(uri string) ([]byte, error) {
 	return bodyBytes, nil
 }
 
-// createTempFileName generating a file name within of a temp directory. If function argument ist empty string
+type jobTempDirKey struct{}
+
+// withJobTempDir makes createTempFileName place all files of a job within dir
+func withJobTempDir(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, jobTempDirKey{}, dir)
+}
+
+// createTempFileName generating a file name within the temp directory of the job or, if the job has none,
+// within the temp directory of the system. If function argument ist empty string
 // file name will be generated in ksuid format.
-func createTempFileName(fileName string) (string, error) {
-	tempDir := os.TempDir()
+func createTempFileName(ctx context.Context, fileName string) (string, error) {
+	tempDir, ok := ctx.Value(jobTempDirKey{}).(string)
+	if !ok || tempDir == "" {
+		tempDir = os.TempDir()
+	}
 
 	if fileName == "" {
 		ksuidRaw := ksuid.New()
@@ -133,14 +109,14 @@ func detectFileType(buffer []byte) string {
 
 // if sandwich engine gets a TIFF image instead of PDF file
 // we need to convert the input file to pdf first since pdfsandwich can't handle images
-func convertImageToPdf(inputFilename string) string {
+func convertImageToPdf(ctx context.Context, inputFilename string) string {
 	log.Info().Str("component", "OCR_IMAGECONVERT").Msg("got image file instead of pdf, trying to convert it...")
 
 	tmpFileImgToPdf := fmt.Sprintf("%s%s", inputFilename, ".pdf")
-	cmd := exec.Command("convert", inputFilename, tmpFileImgToPdf)
-	_, err := cmd.CombinedOutput()
+	cmdArgs := []string{inputFilename, tmpFileImgToPdf}
+	_, err := combinedOutput(ctx, "convert", cmdArgs...)
 	if err != nil {
-		log.Debug().Err(err).Str("component", "OCR_IMAGECONVERT").Interface("tiff2pdf_args", cmd.Args)
+		log.Debug().Err(err).Str("component", "OCR_IMAGECONVERT").Interface("tiff2pdf_args", cmdArgs)
 		log.Warn().Err(err).Str("component", "OCR_IMAGECONVERT").Err(err).
 			Msg("error exec convert for transforming TIFF to PDF")
 		return ""
@@ -152,14 +128,14 @@ func convertImageToPdf(inputFilename string) string {
 // if sandwich engine gets a TIFF image instead of PDF file
 // we need to convert the input file to pdf first since pdfsandwich can't handle images
 // in this case tiff2pdf will be used; seems to be more reliable
-func tiff2Pdf(inputFilename string) string {
+func tiff2Pdf(ctx context.Context, inputFilename string) string {
 	log.Info().Str("component", "OCR_IMAGECONVERT").Msg("got image file instead of pdf, trying to tiff2pdf it...")
 
 	tmpFileImgToPdf := fmt.Sprintf("%s%s", inputFilename, ".pdf")
-	cmd := exec.Command("tiff2pdf", inputFilename, "-o", tmpFileImgToPdf)
-	_, err := cmd.CombinedOutput()
+	cmdArgs := []string{inputFilename, "-o", tmpFileImgToPdf}
+	_, err := combinedOutput(ctx, "tiff2pdf", cmdArgs...)
 	if err != nil {
-		log.Debug().Err(err).Str("component", "OCR_IMAGECONVERT").Interface("tiff2pdf_args", cmd.Args)
+		log.Debug().Err(err).Str("component", "OCR_IMAGECONVERT").Interface("tiff2pdf_args", cmdArgs)
 		log.Warn().Err(err).Str("component", "OCR_IMAGECONVERT").Err(err).
 			Msg("error exec tiff2pdf for transforming TIFF to PDF")
 		return ""
@@ -176,9 +152,12 @@ func checkURLForReplyTo(uri string) (string, error) {
 	}
 	if u.Scheme != "https" && u.Scheme != "http" {
 		errorText := "provided " + u.String() + " URI must be an absolute URL"
-		err = fmt.Errorf(errorText)
+		return u.String(), fmt.Errorf(errorText)
+	}
+	if err = checkOutboundURL(u); err != nil {
+		return u.String(), fmt.Errorf("reply_to: %w", err)
 	}
-	return u.String(), err
+	return u.String(), nil
 }
 
 // timeTrack used to measure time of selected operations
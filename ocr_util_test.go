@@ -0,0 +1,22 @@
+package ocrworker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestCreateTempFileNameWithJobTempDir(t *testing.T) {
+	fileName, err := createTempFileName(context.Background(), "")
+	assert.True(t, err == nil)
+	assert.Equals(t, filepath.Dir(fileName), filepath.Clean(os.TempDir()))
+
+	jobTempDir := t.TempDir()
+	ctx := withJobTempDir(context.Background(), jobTempDir)
+	fileName, err = createTempFileName(ctx, "input")
+	assert.True(t, err == nil)
+	assert.Equals(t, fileName, filepath.Join(jobTempDir, "input"))
+}
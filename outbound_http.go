@@ -0,0 +1,290 @@
+package ocrworker
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrOutboundBlocked is returned for img_url and reply_to destinations which must not be requested
+var ErrOutboundBlocked = errors.New("destination is not allowed")
+
+const (
+	defaultMaxRedirects = 3
+	outboundDialTimeout = 10 * time.Second
+)
+
+// internalPrefixes are blocked by default in addition to loopback, private, link-local, multicast and
+// unspecified addresses
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+}
+
+// OutboundConfig restricts the destinations the http daemon, preprocessors and workers request on behalf
+// of clients, i.e. img_url downloads and reply_to postbacks. The connection to the message broker and
+// its management API is not affected
+type OutboundConfig struct {
+	// AllowCIDRs are exempt from blocking internal addresses, e.g. a document server in the local network
+	AllowCIDRs []string
+	// DenyCIDRs are always blocked
+	DenyCIDRs []string
+	// AllowHosts restricts the destinations to the listed host names, a leading dot allows all subdomains.
+	// An empty list allows every host
+	AllowHosts []string
+	// DenyHosts are always blocked, a leading dot blocks all subdomains
+	DenyHosts []string
+	// AllowInternal disables blocking loopback, private and link-local addresses
+	AllowInternal bool
+	// MaxRedirects followed per request
+	MaxRedirects int
+}
+
+func DefaultOutboundConfig() OutboundConfig {
+	return OutboundConfig{MaxRedirects: defaultMaxRedirects}
+}
+
+// outboundClient enforces an OutboundConfig when connecting, so host names resolving to internal
+// addresses are blocked as well
+type outboundClient struct {
+	config    OutboundConfig
+	allow     []netip.Prefix
+	deny      []netip.Prefix
+	transport *http.Transport
+}
+
+var (
+	outbound   = mustOutboundClient(DefaultOutboundConfig())
+	outboundMu sync.RWMutex
+)
+
+func newOutboundClient(config OutboundConfig) (*outboundClient, error) {
+	c := &outboundClient{config: config}
+	var err error
+	if c.allow, err = parsePrefixes(config.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if c.deny, err = parsePrefixes(config.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout: outboundDialTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return c.checkIP(addrPort.Addr())
+		},
+	}
+	c.transport = &http.Transport{
+		// a proxy would connect to the destination instead of us and bypass the checks
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   outboundDialTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	return c, nil
+}
+
+func mustOutboundClient(config OutboundConfig) *outboundClient {
+	c, err := newOutboundClient(config)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// SetOutboundConfig replaces the restrictions for img_url downloads and postbacks
+func SetOutboundConfig(config OutboundConfig) error {
+	c, err := newOutboundClient(config)
+	if err != nil {
+		return err
+	}
+	outboundMu.Lock()
+	previous := outbound
+	outbound = c
+	outboundMu.Unlock()
+	previous.transport.CloseIdleConnections()
+	return nil
+}
+
+// outboundHTTPClient returns a client for requests on behalf of clients, sharing the connections
+// of the current OutboundConfig
+func outboundHTTPClient(timeout time.Duration) *http.Client {
+	outboundMu.RLock()
+	c := outbound
+	outboundMu.RUnlock()
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: c.transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > c.config.MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", c.config.MaxRedirects)
+			}
+			return c.checkURL(req.URL)
+		},
+	}
+}
+
+// checkOutboundURL verifies the scheme and host of a destination before it is accepted,
+// addresses of host names are checked when connecting
+func checkOutboundURL(u *url.URL) error {
+	outboundMu.RLock()
+	c := outbound
+	outboundMu.RUnlock()
+	return c.checkURL(u)
+}
+
+func (c *outboundClient) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme %q", ErrOutboundBlocked, u.Scheme)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return fmt.Errorf("%w: missing host", ErrOutboundBlocked)
+	}
+	if hostMatches(c.config.DenyHosts, host) || (len(c.config.AllowHosts) > 0 && !hostMatches(c.config.AllowHosts, host)) {
+		return fmt.Errorf("%w: host %q", ErrOutboundBlocked, host)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return c.checkIP(ip)
+	}
+	if !c.config.AllowInternal && (host == "localhost" || strings.HasSuffix(host, ".localhost")) {
+		return fmt.Errorf("%w: host %q", ErrOutboundBlocked, host)
+	}
+	return nil
+}
+
+func (c *outboundClient) checkIP(ip netip.Addr) error {
+	ip = ip.Unmap()
+	for _, prefix := range c.deny {
+		if prefix.Contains(ip) {
+			return fmt.Errorf("%w: address %s", ErrOutboundBlocked, ip)
+		}
+	}
+	for _, prefix := range c.allow {
+		if prefix.Contains(ip) {
+			return nil
+		}
+	}
+	if !c.config.AllowInternal && isInternalIP(ip) {
+		return fmt.Errorf("%w: internal address %s", ErrOutboundBlocked, ip)
+	}
+	return nil
+}
+
+func isInternalIP(ip netip.Addr) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range internalPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches reports whether host is in list, entries with a leading dot match all subdomains
+func hostMatches(list []string, host string) bool {
+	for _, entry := range list {
+		entry = strings.ToLower(entry)
+		if host == entry || (strings.HasPrefix(entry, ".") && strings.HasSuffix(host, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes accepts CIDRs and single addresses
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, entry := range list {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither a CIDR nor an IP address", entry)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// addOutboundFlags registers the flags restricting img_url downloads and postbacks. The returned function
+// builds and validates the config and has to be called after flagSet was parsed, see SetOutboundConfig
+func addOutboundFlags(flagSet *flag.FlagSet) func() (OutboundConfig, error) {
+	defaults := DefaultOutboundConfig()
+	var (
+		allowCIDRs    string
+		denyCIDRs     string
+		allowHosts    string
+		denyHosts     string
+		allowInternal bool
+		maxRedirects  int
+	)
+	flagSet.StringVar(
+		&allowCIDRs,
+		"outbound_allow_cidrs",
+		"",
+		"Comma separated list of CIDRs img_url and reply_to may point to although they are internal e.g. 10.1.2.0/24",
+	)
+	flagSet.StringVar(
+		&denyCIDRs,
+		"outbound_deny_cidrs",
+		"",
+		"Comma separated list of CIDRs img_url and reply_to must never point to",
+	)
+	flagSet.StringVar(
+		&allowHosts,
+		"outbound_allow_hosts",
+		"",
+		"Comma separated list of hosts img_url and reply_to are restricted to, a leading dot allows subdomains. Empty allows all hosts",
+	)
+	flagSet.StringVar(
+		&denyHosts,
+		"outbound_deny_hosts",
+		"",
+		"Comma separated list of hosts img_url and reply_to must never point to, a leading dot denies subdomains",
+	)
+	flagSet.BoolVar(
+		&allowInternal,
+		"outbound_allow_internal",
+		false,
+		"Allow img_url and reply_to to point to loopback, private and link-local addresses",
+	)
+	flagSet.IntVar(
+		&maxRedirects,
+		"outbound_max_redirects",
+		defaults.MaxRedirects,
+		"Maximal number of redirects followed when downloading img_url or posting to reply_to",
+	)
+	return func() (OutboundConfig, error) {
+		outboundConfig := defaults
+		outboundConfig.AllowCIDRs = splitCommaList(allowCIDRs)
+		outboundConfig.DenyCIDRs = splitCommaList(denyCIDRs)
+		outboundConfig.AllowHosts = splitCommaList(allowHosts)
+		outboundConfig.DenyHosts = splitCommaList(denyHosts)
+		outboundConfig.AllowInternal = allowInternal
+		outboundConfig.MaxRedirects = maxRedirects
+		_, err := newOutboundClient(outboundConfig)
+		return outboundConfig, err
+	}
+}
@@ -0,0 +1,86 @@
+package ocrworker
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+// withOutboundConfig installs config until the returned function is called, tests need it to reach
+// servers on the loopback interface
+func withOutboundConfig(t *testing.T, config OutboundConfig) func() {
+	outboundMu.RLock()
+	previous := outbound.config
+	outboundMu.RUnlock()
+	assert.True(t, SetOutboundConfig(config) == nil)
+	return func() {
+		_ = SetOutboundConfig(previous)
+	}
+}
+
+func TestOutboundCheckURL(t *testing.T) {
+	c := mustOutboundClient(OutboundConfig{
+		AllowCIDRs: []string{"10.1.2.0/24"},
+		DenyCIDRs:  []string{"203.0.113.7"},
+		DenyHosts:  []string{".internal.example.com"},
+	})
+	blocked := []string{
+		"http://127.0.0.1/", "http://[::1]/", "http://169.254.169.254/latest/meta-data/", "http://10.0.0.1/",
+		"http://192.168.1.1/", "http://[::ffff:127.0.0.1]/", "http://0.0.0.0/", "http://100.64.0.1/",
+		"http://localhost:15672/api", "http://203.0.113.7/", "http://rabbit.internal.example.com/",
+		"file:///etc/passwd", "gopher://example.com/",
+	}
+	for _, uri := range blocked {
+		u, _ := url.Parse(uri)
+		assert.True(t, errors.Is(c.checkURL(u), ErrOutboundBlocked))
+	}
+	for _, uri := range []string{"https://example.com/a.png", "http://203.0.113.8/", "http://10.1.2.3/"} {
+		u, _ := url.Parse(uri)
+		assert.True(t, c.checkURL(u) == nil)
+	}
+
+	c = mustOutboundClient(OutboundConfig{AllowHosts: []string{".example.com"}})
+	u, _ := url.Parse("https://images.example.com/a.png")
+	assert.True(t, c.checkURL(u) == nil)
+	u, _ = url.Parse("https://example.org/a.png")
+	assert.True(t, errors.Is(c.checkURL(u), ErrOutboundBlocked))
+
+	_, err := newOutboundClient(OutboundConfig{AllowCIDRs: []string{"10.1.2.0/33"}})
+	assert.True(t, err != nil)
+	assert.True(t, isInternalIP(netip.MustParseAddr("fd00::1")))
+	assert.False(t, isInternalIP(netip.MustParseAddr("2001:4860:4860::8888")))
+}
+
+func TestOutboundClientBlocksWhenConnecting(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+
+	// the test server listens on the loopback interface, which is blocked by default
+	_, err := outboundHTTPClient(time.Second).Get(server.URL)
+	assert.True(t, errors.Is(err, ErrOutboundBlocked))
+
+	defer withOutboundConfig(t, OutboundConfig{AllowCIDRs: []string{"127.0.0.0/8"}, MaxRedirects: 2})()
+	resp, err := outboundHTTPClient(time.Second).Get(server.URL)
+	assert.True(t, err == nil)
+	_ = resp.Body.Close()
+
+	_, err = outboundHTTPClient(time.Second).Get(server.URL + "/metadata")
+	assert.True(t, errors.Is(err, ErrOutboundBlocked))
+	_, err = outboundHTTPClient(time.Second).Get(server.URL + "/loop")
+	assert.True(t, err != nil)
+}
@@ -0,0 +1,500 @@
+package ocrworker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// states of a postback delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+var (
+	errDeliveryNotFound  = errors.New("no delivery for this request")
+	errDeliveryPending   = errors.New("delivery is still pending")
+	errDeliveryDiscarded = errors.New("result was delivered and is not kept anymore")
+
+	postbackAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ocr_postback_attempts_total",
+			Help: "A counter for attempts to deliver results to reply_to, result is delivered, retry or failed.",
+		},
+		[]string{"result"},
+	)
+)
+
+// OutboxConfig controls how results are delivered to reply_to
+type OutboxConfig struct {
+	// Dir keeps the pending deliveries, so they survive a restart. Empty keeps them in memory only. It holds
+	// the results of the clients and must not be readable by other users
+	Dir string
+	// RetryWindow in seconds after which a delivery is given up, finished deliveries are listed for the same time
+	RetryWindow uint
+	// InitialBackoff in seconds before the second attempt, it doubles with every failed attempt up to MaxBackoff
+	InitialBackoff uint
+	MaxBackoff     uint
+}
+
+func DefaultOutboxConfig() OutboxConfig {
+	return OutboxConfig{
+		Dir:            defaultOutboxDir(),
+		RetryWindow:    86400,
+		InitialBackoff: 2,
+		MaxBackoff:     600,
+	}
+}
+
+// defaultOutboxDir is below the cache directory of the user running the http daemon instead of the shared
+// temp directory, or below the working directory if the user has none
+func defaultOutboxDir() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "open-ocr-outbox"
+	}
+	return filepath.Join(cacheDir, "open-ocr", "outbox")
+}
+
+// addOutboxFlags registers the postback delivery flags. The returned function builds the config
+// and has to be called after flagSet was parsed
+func addOutboxFlags(flagSet *flag.FlagSet) func() OutboxConfig {
+	outboxConfig := DefaultOutboxConfig()
+	flagSet.StringVar(
+		&outboxConfig.Dir,
+		"outbox_dir",
+		outboxConfig.Dir,
+		"Directory for results waiting to be delivered to reply_to, pending deliveries are resumed after a restart. "+
+			"Empty keeps them in memory only",
+	)
+	flagSet.UintVar(
+		&outboxConfig.RetryWindow,
+		"postback_retry_window",
+		outboxConfig.RetryWindow,
+		"Time in seconds a result is tried to be delivered to reply_to before it is given up",
+	)
+	flagSet.UintVar(
+		&outboxConfig.InitialBackoff,
+		"postback_backoff",
+		outboxConfig.InitialBackoff,
+		"Time in seconds between the first two delivery attempts, it doubles with every failed attempt",
+	)
+	flagSet.UintVar(
+		&outboxConfig.MaxBackoff,
+		"postback_max_backoff",
+		outboxConfig.MaxBackoff,
+		"Maximal time in seconds between two delivery attempts",
+	)
+	return func() OutboxConfig {
+		return outboxConfig
+	}
+}
+
+// DeliveryAttempt is a single try to post a result to reply_to
+type DeliveryAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Delivery describes the postback of a result, as listed by the deliveries end point
+type Delivery struct {
+	ID          string            `json:"id"`
+	ReplyTo     string            `json:"reply_to"`
+	Tenant      string            `json:"tenant"`
+	State       string            `json:"state"`
+	Created     time.Time         `json:"created"`
+	GiveUpAt    time.Time         `json:"give_up_at"`
+	NextAttempt time.Time         `json:"next_attempt,omitempty"`
+	Attempts    []DeliveryAttempt `json:"attempts"`
+}
+
+// outboxEntry is the persisted form of a delivery
+type outboxEntry struct {
+	Delivery
+	// Body is the json posted to ReplyTo, a result or the result of a batch. It is dropped once the
+	// result is delivered
+	Body json.RawMessage `json:"body,omitempty"`
+	// ClientID is the client whose postback secret signs the postback instead of the global secret
+	ClientID string `json:"client_id,omitempty"`
+	// TraceContext continues the trace of the request in the postbacks, even after a restart
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+}
+
+// Outbox delivers results to reply_to until the receiver accepts them with a 2xx status or the retry window ends
+type Outbox struct {
+	config OutboxConfig
+	secret string
+	// clientSecrets returns the postback secret of a client, the secrets are looked up for every attempt
+	// and never written to the outbox directory
+	clientSecrets func(clientID string) string
+	mu            sync.Mutex
+	// entries holds pending deliveries and finished ones until they are pruned
+	entries map[string]*outboxEntry
+	post    func(entry *outboxEntry, secret string, attempt uint) (int, error)
+	now     func() time.Time
+}
+
+var (
+	postbackOutbox   *Outbox
+	postbackOutboxMu sync.Mutex
+)
+
+// NewOutbox creates an outbox signing with the global secret and loads the deliveries left in config.Dir
+func NewOutbox(config OutboxConfig, secret string) (*Outbox, error) {
+	outbox := &Outbox{
+		config:  config,
+		secret:  secret,
+		entries: make(map[string]*outboxEntry),
+		now:     time.Now,
+	}
+	outbox.post = func(entry *outboxEntry, secret string, attempt uint) (int, error) {
+		return newOcrPostClient(secret).postJSON(entry.ID, entry.Body, entry.ReplyTo, attempt)
+	}
+	if config.Dir == "" {
+		return outbox, nil
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(config.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		entry := &outboxEntry{}
+		if err = json.Unmarshal(content, entry); err != nil {
+			log.Warn().Err(err).Str("component", "OCR_OUTBOX").Str("file", file).Msg("skipping unreadable delivery")
+			continue
+		}
+		outbox.entries[entry.ID] = entry
+	}
+	return outbox, nil
+}
+
+// StartOutbox creates the outbox used by all requests with reply_to, resumes its pending deliveries
+// and prunes finished deliveries in the background
+func StartOutbox(config *RabbitConfig) (*Outbox, error) {
+	outbox, err := NewOutbox(config.Outbox, config.PostbackSecret)
+	if err != nil {
+		return nil, err
+	}
+	postbackOutboxMu.Lock()
+	postbackOutbox = outbox
+	postbackOutboxMu.Unlock()
+
+	outbox.mu.Lock()
+	var pending []string
+	for id, entry := range outbox.entries {
+		if entry.State == DeliveryPending {
+			pending = append(pending, id)
+		}
+	}
+	outbox.mu.Unlock()
+	if len(pending) > 0 {
+		log.Info().Str("component", "OCR_OUTBOX").Int("pending", len(pending)).Msg("resuming pending deliveries")
+	}
+	for _, id := range pending {
+		go outbox.deliver(id)
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			outbox.prune()
+		}
+	}()
+	return outbox, nil
+}
+
+// SetClientSecrets sets the lookup of the postback secrets of the clients, e.g. APIKeyAuth.PostbackSecret
+func (o *Outbox) SetClientSecrets(lookup func(clientID string) string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.clientSecrets = lookup
+}
+
+// currentOutbox returns the outbox of StartOutbox, or an outbox in memory if it wasn't started
+func currentOutbox(config *RabbitConfig) *Outbox {
+	postbackOutboxMu.Lock()
+	defer postbackOutboxMu.Unlock()
+	if postbackOutbox == nil {
+		memoryConfig := config.Outbox
+		memoryConfig.Dir = ""
+		postbackOutbox, _ = NewOutbox(memoryConfig, config.PostbackSecret)
+	}
+	return postbackOutbox
+}
+
+// Enqueue persists the result and delivers it to replyTo in the background, the postbacks are spans of the
+// trace of ctx
+func (o *Outbox) Enqueue(ctx context.Context, result OcrResult, replyTo, tenant, clientID string) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		log.Error().Err(err).Str("component", "OCR_OUTBOX").Str("RequestID", result.ID).Msg("result can't be delivered")
+		return
+	}
+	o.enqueue(ctx, result.ID, body, replyTo, tenant, clientID)
+}
+
+// enqueue persists body and posts it to replyTo in the background, id is the RequestID or the batch id.
+// The postbacks are signed with the secret of clientID if it is set
+func (o *Outbox) enqueue(ctx context.Context, id string, body []byte, replyTo, tenant, clientID string) {
+	now := o.now()
+	entry := &outboxEntry{
+		Delivery: Delivery{
+			ID:          id,
+			ReplyTo:     replyTo,
+			Tenant:      tenant,
+			State:       DeliveryPending,
+			Created:     now,
+			GiveUpAt:    now.Add(time.Duration(o.config.RetryWindow) * time.Second),
+			NextAttempt: now,
+		},
+		Body:         body,
+		ClientID:     clientID,
+		TraceContext: traceCarrier(ctx),
+	}
+	o.mu.Lock()
+	o.entries[entry.ID] = entry
+	o.persist(entry)
+	o.mu.Unlock()
+	go o.deliver(entry.ID)
+}
+
+// Get returns the delivery of the result of requestID
+func (o *Outbox) Get(requestID string) (Delivery, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entry, ok := o.entries[requestID]
+	if !ok {
+		return Delivery{}, false
+	}
+	return entry.snapshot(), true
+}
+
+// List returns the deliveries of tenant ordered by creation, all deliveries if all is set
+func (o *Outbox) List(tenant string, all bool) []Delivery {
+	o.mu.Lock()
+	deliveries := make([]Delivery, 0, len(o.entries))
+	for _, entry := range o.entries {
+		if all || entry.Tenant == tenant {
+			deliveries = append(deliveries, entry.snapshot())
+		}
+	}
+	o.mu.Unlock()
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Created.Before(deliveries[j].Created)
+	})
+	return deliveries
+}
+
+// Resend delivers a failed result again, with a new retry window. Delivered results are not kept
+func (o *Outbox) Resend(requestID string) (Delivery, error) {
+	o.mu.Lock()
+	entry, ok := o.entries[requestID]
+	if !ok {
+		o.mu.Unlock()
+		return Delivery{}, errDeliveryNotFound
+	}
+	if entry.State == DeliveryPending {
+		o.mu.Unlock()
+		return entry.snapshot(), errDeliveryPending
+	}
+	if entry.Body == nil {
+		o.mu.Unlock()
+		return entry.snapshot(), errDeliveryDiscarded
+	}
+	now := o.now()
+	entry.State = DeliveryPending
+	entry.NextAttempt = now
+	entry.GiveUpAt = now.Add(time.Duration(o.config.RetryWindow) * time.Second)
+	o.persist(entry)
+	delivery := entry.snapshot()
+	o.mu.Unlock()
+	go o.deliver(requestID)
+	return delivery, nil
+}
+
+// deliver posts the result of requestID until it is accepted or given up
+func (o *Outbox) deliver(requestID string) {
+	for {
+		o.mu.Lock()
+		entry, ok := o.entries[requestID]
+		if !ok || entry.State != DeliveryPending {
+			o.mu.Unlock()
+			return
+		}
+		wait := entry.NextAttempt.Sub(o.now())
+		o.mu.Unlock()
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+		if !o.attempt(requestID) {
+			return
+		}
+	}
+}
+
+// attempt posts the result once and schedules the next attempt. It returns false if the delivery is finished
+func (o *Outbox) attempt(requestID string) bool {
+	o.mu.Lock()
+	entry, ok := o.entries[requestID]
+	if !ok || entry.State != DeliveryPending {
+		o.mu.Unlock()
+		return false
+	}
+	secret := o.secret
+	if entry.ClientID != "" && o.clientSecrets != nil {
+		if clientSecret := o.clientSecrets(entry.ClientID); clientSecret != "" {
+			secret = clientSecret
+		}
+	}
+	attempt := uint(len(entry.Attempts) + 1)
+	traceCtx := contextFromCarrier(context.Background(), entry.TraceContext)
+	o.mu.Unlock()
+
+	_, span := tracer.Start(traceCtx, "postback", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		requestIDAttribute.String(requestID),
+		attribute.Int("ocr.postback_attempt", int(attempt)),
+	))
+	if replyTo, err := url.Parse(entry.ReplyTo); err == nil {
+		span.SetAttributes(semconv.ServerAddress(replyTo.Hostname()))
+	}
+	statusCode, err := o.post(entry, secret, attempt)
+	if statusCode != 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(statusCode))
+	}
+	endSpan(span, err)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := o.now()
+	record := DeliveryAttempt{Time: now, StatusCode: statusCode}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	entry.Attempts = append(entry.Attempts, record)
+	logger := log.With().Str("component", "OCR_OUTBOX").Str("RequestID", requestID).
+		Str("replyToAddress", entry.ReplyTo).Uint("attempt", attempt).Logger()
+	switch next := now.Add(o.backoff(attempt)); {
+	case err == nil:
+		entry.State = DeliveryDelivered
+		entry.NextAttempt = time.Time{}
+		// only the delivery is listed until it is pruned, the result isn't needed anymore
+		entry.Body = nil
+		postbackAttempts.WithLabelValues(DeliveryDelivered).Inc()
+		jobEvents.publish(JobEvent{ID: requestID, State: JobDelivered})
+		logger.Info().Msg("result was delivered")
+	case next.After(entry.GiveUpAt):
+		entry.State = DeliveryFailed
+		entry.NextAttempt = time.Time{}
+		postbackAttempts.WithLabelValues(DeliveryFailed).Inc()
+		jobEvents.publish(JobEvent{ID: requestID, State: JobFailed, Message: "result could not be delivered to reply_to"})
+		logger.Error().Err(err).Msg("result could not be delivered within the retry window, giving up")
+	default:
+		entry.NextAttempt = next
+		postbackAttempts.WithLabelValues("retry").Inc()
+		logger.Warn().Err(err).Time("next_attempt", next).Msg("delivery attempt was not successful")
+	}
+	o.persist(entry)
+	return entry.State == DeliveryPending
+}
+
+// backoff returns the time to wait after the given failed attempt
+func (o *Outbox) backoff(attempt uint) time.Duration {
+	backoff := time.Duration(o.config.InitialBackoff) * time.Second
+	maxBackoff := time.Duration(o.config.MaxBackoff) * time.Second
+	for i := uint(1); i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// prune removes finished deliveries older than the retry window
+func (o *Outbox) prune() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	horizon := o.now().Add(-time.Duration(o.config.RetryWindow) * time.Second)
+	for id, entry := range o.entries {
+		if entry.State != DeliveryPending && entry.lastAttempt().Before(horizon) {
+			delete(o.entries, id)
+			o.remove(id)
+		}
+	}
+}
+
+// persist writes the entry to the outbox directory, it has to be called with o.mu held
+func (o *Outbox) persist(entry *outboxEntry) {
+	if o.config.Dir == "" {
+		return
+	}
+	content, err := json.Marshal(entry)
+	if err == nil {
+		// write to a temporary file first, so a crash doesn't leave a truncated delivery
+		tmpFile := o.fileName(entry.ID) + ".tmp"
+		if err = os.WriteFile(tmpFile, content, 0o600); err == nil {
+			err = os.Rename(tmpFile, o.fileName(entry.ID))
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("component", "OCR_OUTBOX").Str("RequestID", entry.ID).
+			Msg("delivery could not be persisted and won't survive a restart")
+	}
+}
+
+func (o *Outbox) remove(requestID string) {
+	if o.config.Dir == "" {
+		return
+	}
+	if err := os.Remove(o.fileName(requestID)); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("component", "OCR_OUTBOX").Str("RequestID", requestID).
+			Msg("delivery file could not be removed")
+	}
+}
+
+// fileName is derived from the hash of requestID, as clients may choose the RequestID
+func (o *Outbox) fileName(requestID string) string {
+	sum := sha256.Sum256([]byte(requestID))
+	return filepath.Join(o.config.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (entry *outboxEntry) snapshot() Delivery {
+	delivery := entry.Delivery
+	delivery.Attempts = append([]DeliveryAttempt{}, entry.Attempts...)
+	return delivery
+}
+
+func (entry *outboxEntry) lastAttempt() time.Time {
+	if len(entry.Attempts) == 0 {
+		return entry.Created
+	}
+	return entry.Attempts[len(entry.Attempts)-1].Time
+}
+
+// deliveryVisible reports whether principal may see the delivery of tenant
+func deliveryVisible(principal *Principal, tenant string) bool {
+	return principal == nil || principal.HasScope(ScopeAdmin) || tenantFromPrincipal(principal) == tenant
+}
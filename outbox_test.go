@@ -0,0 +1,139 @@
+package ocrworker
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func newTestOutbox(t *testing.T, dir string) *Outbox {
+	outbox, err := NewOutbox(OutboxConfig{Dir: dir, RetryWindow: 60, InitialBackoff: 2, MaxBackoff: 10}, "global")
+	assert.True(t, err == nil)
+	return outbox
+}
+
+// addTestEntry adds a pending delivery without starting its delivery in the background
+func addTestEntry(outbox *Outbox, id, clientID string) {
+	now := outbox.now()
+	entry := &outboxEntry{
+		Delivery: Delivery{
+			ID: id, ReplyTo: "http://localhost/postback", State: DeliveryPending,
+			Created: now, GiveUpAt: now.Add(time.Duration(outbox.config.RetryWindow) * time.Second), NextAttempt: now,
+		},
+		Body:     []byte(`{"id":"` + id + `","status":"done"}`),
+		ClientID: clientID,
+	}
+	outbox.mu.Lock()
+	outbox.entries[id] = entry
+	outbox.persist(entry)
+	outbox.mu.Unlock()
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	outbox := newTestOutbox(t, "")
+	assert.Equals(t, outbox.backoff(1), 2*time.Second)
+	assert.Equals(t, outbox.backoff(2), 4*time.Second)
+	assert.Equals(t, outbox.backoff(3), 8*time.Second)
+	assert.Equals(t, outbox.backoff(4), 10*time.Second)
+	assert.Equals(t, outbox.backoff(40), 10*time.Second)
+}
+
+func TestOutboxRetriesUntilDelivered(t *testing.T) {
+	outbox := newTestOutbox(t, t.TempDir())
+	var secrets []string
+	outbox.post = func(entry *outboxEntry, secret string, attempt uint) (int, error) {
+		secrets = append(secrets, secret)
+		if attempt < 3 {
+			return 502, errors.New("target responded with status 502")
+		}
+		return 200, nil
+	}
+	clientSecrets := map[string]string{"client": "client secret"}
+	outbox.SetClientSecrets(func(clientID string) string { return clientSecrets[clientID] })
+	addTestEntry(outbox, "1", "")
+	addTestEntry(outbox, "2", "client")
+	addTestEntry(outbox, "3", "removed client")
+
+	assert.True(t, outbox.attempt("1"))
+	assert.True(t, outbox.attempt("1"))
+	assert.False(t, outbox.attempt("1"))
+	delivery, ok := outbox.Get("1")
+	assert.True(t, ok)
+	assert.Equals(t, delivery.State, DeliveryDelivered)
+	assert.Equals(t, len(delivery.Attempts), 3)
+	assert.Equals(t, delivery.Attempts[0].StatusCode, 502)
+	assert.Equals(t, delivery.Attempts[2].Error, "")
+
+	outbox.attempt("2")
+	outbox.attempt("3")
+	// a client without secret falls back to the global secret
+	assert.DeepEquals(t, secrets, []string{"global", "global", "global", "client secret", "global"})
+
+	// delivered results are dropped and can't be sent again
+	assert.True(t, outbox.entries["1"].Body == nil)
+	_, err := outbox.Resend("1")
+	assert.Equals(t, err, errDeliveryDiscarded)
+	restarted := newTestOutbox(t, outbox.config.Dir)
+	assert.True(t, restarted.entries["1"].Body == nil)
+}
+
+func TestDefaultOutboxDir(t *testing.T) {
+	// results must not end up in the temp directory shared by all users
+	assert.False(t, strings.HasPrefix(DefaultOutboxConfig().Dir, os.TempDir()))
+}
+
+func TestOutboxGivesUpAfterRetryWindow(t *testing.T) {
+	outbox := newTestOutbox(t, "")
+	outbox.post = func(*outboxEntry, string, uint) (int, error) {
+		return 0, errors.New("connection refused")
+	}
+	now := time.Now()
+	outbox.now = func() time.Time { return now }
+	addTestEntry(outbox, "1", "")
+
+	for outbox.attempt("1") {
+		now = now.Add(10 * time.Second)
+	}
+	delivery, _ := outbox.Get("1")
+	assert.Equals(t, delivery.State, DeliveryFailed)
+	assert.True(t, delivery.NextAttempt.IsZero())
+	assert.Equals(t, len(delivery.Attempts), 7)
+
+	_, err := outbox.Resend("2")
+	assert.Equals(t, err, errDeliveryNotFound)
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	outbox := newTestOutbox(t, dir)
+	outbox.post = func(*outboxEntry, string, uint) (int, error) {
+		return 500, errors.New("target responded with status 500")
+	}
+	addTestEntry(outbox, "../1", "client")
+	outbox.attempt("../1")
+
+	restarted := newTestOutbox(t, dir)
+	delivery, ok := restarted.Get("../1")
+	assert.True(t, ok)
+	assert.Equals(t, delivery.State, DeliveryPending)
+	assert.Equals(t, len(delivery.Attempts), 1)
+	assert.Equals(t, restarted.entries["../1"].ClientID, "client")
+	// the secret of the client is looked up for every attempt and never persisted
+	content, err := os.ReadFile(restarted.fileName("../1"))
+	assert.True(t, err == nil)
+	assert.False(t, strings.Contains(string(content), "secret"))
+
+	_, err = restarted.Resend("../1")
+	assert.Equals(t, err, errDeliveryPending)
+}
+
+func TestDeliveryVisible(t *testing.T) {
+	assert.True(t, deliveryVisible(nil, "a"))
+	assert.True(t, deliveryVisible(&Principal{Tenant: "a"}, "a"))
+	assert.False(t, deliveryVisible(&Principal{Tenant: "b"}, "a"))
+	assert.True(t, deliveryVisible(&Principal{Tenant: "b", Scopes: []string{ScopeAdmin}}, "a"))
+}
@@ -1,17 +1,20 @@
 package ocrworker
 
+import "context"
+
 const (
 	PreprocessorIdentity             = "identity"
 	PreprocessorStrokeWidthTransform = "stroke-width-transform"
 	PreprocessorConvertPdf           = "convert-pdf"
 )
 
+// Preprocessor transforms the image of a request, external commands have to be stopped as soon as ctx is done
 type Preprocessor interface {
-	preprocess(ocrRequest *OcrRequest) error
+	preprocess(ctx context.Context, ocrRequest *OcrRequest) error
 }
 
 type IdentityPreprocessor struct{}
 
-func (IdentityPreprocessor) preprocess(_ *OcrRequest) error {
+func (IdentityPreprocessor) preprocess(_ context.Context, _ *OcrRequest) error {
 	return nil
 }
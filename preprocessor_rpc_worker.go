@@ -3,13 +3,16 @@ package ocrworker
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/segmentio/ksuid"
+	"go.opentelemetry.io/otel/trace"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -22,6 +25,10 @@ type PreprocessorRpcWorker struct {
 	Done            chan error
 	bindingKey      string
 	preprocessorMap map[string]Preprocessor
+	// jobCtx is the parent of all job contexts, it is canceled if the shutdown grace period is exceeded
+	jobCtx     context.Context
+	cancelJobs context.CancelFunc
+	draining   int32
 }
 
 var preprocessorTag = ksuid.New().String()
@@ -37,6 +44,7 @@ func NewPreprocessorRpcWorker(rc *RabbitConfig, preprocessor string) (*Preproces
 		return nil, fmt.Errorf("no preprocessor found for: %q", preprocessor)
 	}
 
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
 	preprocessorRpcWorker := &PreprocessorRpcWorker{
 		rabbitConfig:    *rc,
 		conn:            nil,
@@ -45,6 +53,8 @@ func NewPreprocessorRpcWorker(rc *RabbitConfig, preprocessor string) (*Preproces
 		Done:            make(chan error),
 		bindingKey:      preprocessor,
 		preprocessorMap: preprocessorMap,
+		jobCtx:          jobCtx,
+		cancelJobs:      cancelJobs,
 	}
 	return preprocessorRpcWorker, nil
 }
@@ -63,6 +73,7 @@ func (w *PreprocessorRpcWorker) Run() error {
 
 	go func() {
 		fmt.Printf("closing: %s", <-w.conn.NotifyClose(make(chan *amqp.Error)))
+		processHealth.setConnected(false)
 	}()
 
 	log.Info().Str("component", "PREPROCESSOR_WORKER").Msg("got Connection, getting Channel")
@@ -70,6 +81,11 @@ func (w *PreprocessorRpcWorker) Run() error {
 	if err != nil {
 		return err
 	}
+	// messages are acknowledged after they were forwarded, so only hold one message at a time
+	err = w.channel.Qos(1, 0, true)
+	if err != nil {
+		return err
+	}
 
 	if err := w.channel.ExchangeDeclare(
 		w.rabbitConfig.Exchange,     // name of the exchange
@@ -116,7 +132,7 @@ func (w *PreprocessorRpcWorker) Run() error {
 	deliveries, err := w.channel.Consume(
 		queue.Name,      // name
 		preprocessorTag, // consumerTag,
-		true,            // noAck
+		false,           // noAck
 		false,           // exclusive
 		false,           // noLocal
 		false,           // noWait
@@ -126,25 +142,39 @@ func (w *PreprocessorRpcWorker) Run() error {
 		return err
 	}
 
+	processHealth.setConnected(true)
 	go w.handle(deliveries, w.Done)
 
 	return nil
 }
 
+// Shutdown stops consuming new messages and gives the running job the configured grace period to finish.
+// A job which could not be finished in time is requeued
 func (w *PreprocessorRpcWorker) Shutdown() error {
+	atomic.StoreInt32(&w.draining, 1)
+	processHealth.setDraining()
 	// will close() the deliveries channel
-	if err := w.channel.Cancel(w.tag, true); err != nil {
+	if err := w.channel.Cancel(w.tag, false); err != nil {
 		return fmt.Errorf("worker cancel failed: %s", err)
 	}
 
+	// wait for handle() to exit
+	grace := time.Duration(w.rabbitConfig.ShutdownGrace) * time.Second
+	select {
+	case <-w.Done:
+	case <-time.After(grace):
+		log.Warn().Str("component", "PREPROCESSOR_WORKER").Dur("grace", grace).
+			Msg("shutdown grace period exceeded, aborting running job")
+		w.cancelJobs()
+		<-w.Done
+	}
+
 	if err := w.conn.Close(); err != nil {
 		return fmt.Errorf("AMQP connection close error: %s", err)
 	}
 
-	defer log.Info().Str("component", "PREPROCESSOR_WORKER").Msg("Shutdown OK")
-
-	// wait for handle() to exit
-	return <-w.Done
+	log.Info().Str("component", "PREPROCESSOR_WORKER").Msg("Shutdown OK")
+	return nil
 }
 
 func (w *PreprocessorRpcWorker) handle(deliveries <-chan amqp.Delivery, done chan error) {
@@ -155,24 +185,48 @@ func (w *PreprocessorRpcWorker) handle(deliveries <-chan amqp.Delivery, done cha
 			Str("ReplyTo", d.ReplyTo).
 			Msg("got delivery")
 
+		if atomic.LoadInt32(&w.draining) == 1 {
+			w.requeue(&d)
+			continue
+		}
+
+		processHealth.jobStarted(d.CorrelationId)
 		err := w.handleDelivery(&d)
+		processHealth.jobFinished(d.CorrelationId, err == nil, errors.Is(err, errJobAborted))
+		if errors.Is(err, errJobAborted) {
+			w.requeue(&d)
+			continue
+		}
 		if err != nil {
 			log.Error().Err(err).Str("component", "PREPROCESSOR_WORKER").Msg("Error handling delivery in preprocessor.")
 		}
-
+		if err := d.Ack(false); err != nil {
+			log.Warn().Err(err).Str("component", "PREPROCESSOR_WORKER").Msg("Ack() was not successful")
+		}
 	}
 	log.Info().Str("component", "PREPROCESSOR_WORKER").Msg("handle: deliveries channel closed")
 	done <- fmt.Errorf("handle: deliveries channel closed")
 }
 
-func (w *PreprocessorRpcWorker) preprocessImage(ocrRequest *OcrRequest) error {
+// requeue gives the delivery back to the broker, so another preprocessor can process it
+func (*PreprocessorRpcWorker) requeue(d *amqp.Delivery) {
+	log.Info().Str("component", "PREPROCESSOR_WORKER").Str("RequestID", d.CorrelationId).
+		Msg("preprocessor is shutting down, requeue delivery")
+	if err := d.Nack(false, true); err != nil {
+		log.Warn().Err(err).Str("component", "PREPROCESSOR_WORKER").Msg("Nack() was not successful")
+	}
+}
+
+func (w *PreprocessorRpcWorker) preprocessImage(ctx context.Context, ocrRequest *OcrRequest) error {
 	descriptor := w.bindingKey // eg, "stroke-width-transform"
 	preprocessor := w.preprocessorMap[descriptor]
 	log.Info().Str("component", "PREPROCESSOR_WORKER").
 		Str("ocrRequest", ocrRequest.RequestID).Str("descriptor", descriptor).
 		Msg("Preprocess request via descriptor")
 
-	err := preprocessor.preprocess(ocrRequest)
+	ctx, span := tracer.Start(ctx, "preprocessor "+descriptor, trace.WithAttributes(requestIDAttribute.String(ocrRequest.RequestID)))
+	err := preprocessor.preprocess(ctx, ocrRequest)
+	endSpan(span, err)
 	if err != nil {
 		msg := "Error doing %s on: %v."
 		errMsg := fmt.Sprintf(msg, descriptor, ocrRequest)
@@ -185,7 +239,7 @@ func (w *PreprocessorRpcWorker) preprocessImage(ocrRequest *OcrRequest) error {
 func (*PreprocessorRpcWorker) strokeWidthTransform(ocrRequest *OcrRequest) error {
 	// write bytes to a temp file
 
-	tmpFileNameInput, err := createTempFileName("")
+	tmpFileNameInput, err := createTempFileName(context.Background(), "")
 	if err != nil {
 		return err
 	}
@@ -196,7 +250,7 @@ func (*PreprocessorRpcWorker) strokeWidthTransform(ocrRequest *OcrRequest) error
 		}
 	}(tmpFileNameInput)
 
-	tmpFileNameOutput, err := createTempFileName("")
+	tmpFileNameOutput, err := createTempFileName(context.Background(), "")
 	if err != nil {
 		return err
 	}
@@ -246,16 +300,48 @@ func (w *PreprocessorRpcWorker) handleDelivery(d *amqp.Delivery) error {
 		return err
 	}
 
-	routingKey := ocrRequest.nextPreprocessor(w.rabbitConfig.RoutingKey)
+	// the client has already got a timeout, tell it the job was dropped instead of preprocessing it
+	if ocrRequest.deadlineExceeded() {
+		err = fmt.Errorf("job deadline %s was exceeded before preprocessing started", ocrRequest.Deadline.Format(time.RFC3339))
+		log.Warn().Err(err).Str("component", "PREPROCESSOR_WORKER").Str("RequestID", ocrRequest.RequestID).
+			Msg("dropping expired job")
+		return w.sendErrorResult(d, err)
+	}
+	publishJobEvent(w.channel, w.rabbitConfig.Exchange, d, JobEvent{State: JobPreprocessing, Preprocessor: w.bindingKey})
+	// the job continues the trace of the request from the headers of the message
+	ctx, span := startConsumerSpan(w.jobCtx, "preprocess "+w.bindingKey, d)
+	defer span.End()
+	ctx, cancel := ocrRequest.jobContext(ctx)
+	defer cancel()
+
+	// the http daemon may have forwarded img_url instead of the image itself
+	if len(ocrRequest.ImgBytes) == 0 && ocrRequest.ImgUrl != "" {
+		log.Info().Str("component", "PREPROCESSOR_WORKER").Str("RequestID", ocrRequest.RequestID).
+			Msg("downloading img_url")
+		err = ocrRequest.downloadImgUrl(ctx, &w.rabbitConfig.ImgURLFetch)
+		if w.jobCtx.Err() != nil {
+			return errJobAborted
+		}
+		if err != nil {
+			log.Error().Err(err).Str("component", "PREPROCESSOR_WORKER").Str("RequestID", ocrRequest.RequestID).
+				Msg("error downloading img_url")
+			return w.sendErrorResult(d, err)
+		}
+	}
+
+	routingKey := ocrRequest.nextPreprocessor(w.rabbitConfig.Scheduling.routingKey(w.rabbitConfig.RoutingKey, &ocrRequest))
 	log.Info().Str("component", "PREPROCESSOR_WORKER").Str("routingKey", routingKey).
 		Msg("publishing with routing key")
 
-	err = w.preprocessImage(&ocrRequest)
+	err = w.preprocessImage(ctx, &ocrRequest)
+	if w.jobCtx.Err() != nil {
+		return errJobAborted
+	}
 	if err != nil {
 		msg := "Error preprocessing image: %v."
 		errMsg := fmt.Sprintf(msg, ocrRequest)
 		log.Error().Err(err).Str("component", "PREPROCESSOR_WORKER").Msg(errMsg)
-		return err
+		return w.sendErrorResult(d, err)
 	}
 
 	ocrRequestJson, err := json.Marshal(ocrRequest)
@@ -266,30 +352,60 @@ func (w *PreprocessorRpcWorker) handleDelivery(d *amqp.Delivery) error {
 	log.Info().Str("component", "PREPROCESSOR_WORKER").Str("routingKey", routingKey).
 		Msg("sendRpcResponse via routingKey")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	publishCtx, publishCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer publishCancel()
 
-	if err := w.channel.PublishWithContext(
-		ctx,
+	spanCtx, publishSpan := startPublishSpan(ctx, w.rabbitConfig.Exchange, routingKey, ocrRequest.RequestID)
+	err = w.channel.PublishWithContext(
+		publishCtx,
 		w.rabbitConfig.Exchange, // publish to an exchange
 		routingKey,              // routing to 0 or more queues
 		false,                   // mandatory
 		false,                   // immediate
 		amqp.Publishing{
-			Headers:         amqp.Table{},
+			// keeps the publishing time of the http daemon for the wait time of the class
+			Headers:         traceHeaders(spanCtx, d.Headers),
 			ContentType:     "text/plain",
 			ContentEncoding: "",
 			Body:            ocrRequestJson,
 			DeliveryMode:    amqp.Transient, // 1=non-persistent, 2=persistent
-			Priority:        0,              // 0-9
+			Priority:        d.Priority,     // 0-9
 			ReplyTo:         d.ReplyTo,
 			CorrelationId:   d.CorrelationId,
 			// a bunch of application/implementation-specific fields
 		},
-	); err != nil {
+	)
+	endSpan(publishSpan, err)
+	if err != nil {
 		return err
 	}
 	log.Info().Str("component", "PREPROCESSOR_WORKER").Msg("handleDelivery succeeded")
 
 	return nil
 }
+
+// sendErrorResult replies directly to the client's callback queue, skipping the rest of the chain
+func (w *PreprocessorRpcWorker) sendErrorResult(d *amqp.Delivery, jobErr error) error {
+	body, err := json.Marshal(OcrResult{ID: d.CorrelationId, Status: "error", Text: jobErr.Error()})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return w.channel.PublishWithContext(
+		ctx,
+		w.rabbitConfig.Exchange, // publish to an exchange
+		d.ReplyTo,               // routing to the callback queue of the client
+		false,                   // mandatory
+		false,                   // immediate
+		amqp.Publishing{
+			Headers:       amqp.Table{},
+			ContentType:   "text/plain",
+			Body:          body,
+			DeliveryMode:  amqp.Transient, // 1=non-persistent, 2=persistent
+			CorrelationId: d.CorrelationId,
+		},
+	)
+}
@@ -32,10 +32,25 @@ var (
 	)
 
 	// requestSize has no labels, making it a zero-dimensional ObserverVec.
+	tenantRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ocr_tenant_requests_total",
+			Help: "A counter for requests per tenant, result is accepted or the reason of the rejection.",
+		},
+		[]string{"tenant", "result"},
+	)
+	tenantInFlightGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ocr_tenant_in_flight_requests",
+			Help: "Number of currently pending and processed requests per tenant.",
+		},
+		[]string{"tenant"},
+	)
+
 	requestSize = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "ocr_request_size_bytes",
-			Help:    "A histogram of response sizes for requests.",
+			Help:    "A histogram of the body sizes of requests to /ocr, /ocr-file-upload and /batches.",
 			Buckets: []float64{100, 1500, 5000000, 10000000, 25000000, 50000000},
 		},
 		[]string{},
@@ -45,15 +60,20 @@ var (
 // InstrumentHttpStatusHandler wraps httpHandler to provide prometheus metrics
 func InstrumentHttpStatusHandler(ocrHttpHandler *OcrHTTPStatusHandler) http.Handler {
 	// Register all the metrics in the standard registry.
-	prometheus.MustRegister(inFlightGauge, counter, duration, requestSize)
+	prometheus.MustRegister(inFlightGauge, counter, duration, requestSize, tenantRequests, tenantInFlightGauge, postbackAttempts,
+		resultCacheLookups, idempotentReplays)
 
 	ocrChain := promhttp.InstrumentHandlerInFlight(inFlightGauge,
 		promhttp.InstrumentHandlerDuration(duration.MustCurryWith(prometheus.Labels{"handler": "ocr"}),
-			promhttp.InstrumentHandlerCounter(counter,
-				// promhttp.InstrumentHandlerRequestSize(requestSize, ocrworker.NewOcrHttpHandler(rabbitConfig)),
-				promhttp.InstrumentHandlerRequestSize(requestSize, ocrHttpHandler),
-			),
+			// requestSize is observed by the handlers with the bytes actually read, see limitRequestBody
+			promhttp.InstrumentHandlerCounter(counter, ocrHttpHandler),
 		),
 	)
 	return ocrChain
 }
+
+// WorkerMetricsHandler registers the metrics of the ocr worker and returns the handler exposing them
+func WorkerMetricsHandler() http.Handler {
+	prometheus.MustRegister(classWait)
+	return promhttp.Handler()
+}
@@ -0,0 +1,207 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ReloadableConfig is the part of RabbitConfig the http daemon can change while it is running, see ConfigReloader
+type ReloadableConfig struct {
+	QueuePrio                   map[string]uint8
+	FactorForMessageAccept      uint
+	ResponseCacheTimeout        uint
+	MaximalResponseCacheTimeout uint
+	MaxInFlight                 uint
+	ClientShare                 uint
+	MaxBatchSize                uint
+	IdempotencyTTL              uint
+	ImgURLFetch                 ImgURLFetchConfig
+	Outbound                    OutboundConfig
+}
+
+func (c *RabbitConfig) reloadable() ReloadableConfig {
+	return ReloadableConfig{
+		QueuePrio:                   c.QueuePrio,
+		FactorForMessageAccept:      c.FactorForMessageAccept,
+		ResponseCacheTimeout:        c.ResponseCacheTimeout,
+		MaximalResponseCacheTimeout: c.MaximalResponseCacheTimeout,
+		MaxInFlight:                 c.MaxInFlight,
+		ClientShare:                 c.ClientShare,
+		MaxBatchSize:                c.MaxBatchSize,
+		IdempotencyTTL:              c.IdempotencyTTL,
+		ImgURLFetch:                 c.ImgURLFetch,
+		Outbound:                    c.Outbound,
+	}
+}
+
+func (c *RabbitConfig) setReloadable(reloadable ReloadableConfig) {
+	c.QueuePrio = reloadable.QueuePrio
+	c.FactorForMessageAccept = reloadable.FactorForMessageAccept
+	c.ResponseCacheTimeout = reloadable.ResponseCacheTimeout
+	c.MaximalResponseCacheTimeout = reloadable.MaximalResponseCacheTimeout
+	c.MaxInFlight = reloadable.MaxInFlight
+	c.ClientShare = reloadable.ClientShare
+	c.MaxBatchSize = reloadable.MaxBatchSize
+	c.IdempotencyTTL = reloadable.IdempotencyTTL
+	c.ImgURLFetch = reloadable.ImgURLFetch
+	c.Outbound = reloadable.Outbound
+}
+
+var (
+	reloadedConfig   *ReloadableConfig
+	reloadedConfigMu sync.RWMutex
+)
+
+// currentConfig returns config with the settings of the last reload. The handlers keep the config they were
+// created with and call it once per request, so a request sees either the old or the new settings
+func currentConfig(config *RabbitConfig) *RabbitConfig {
+	reloadedConfigMu.RLock()
+	defer reloadedConfigMu.RUnlock()
+	if reloadedConfig == nil {
+		return config
+	}
+	current := *config
+	current.setReloadable(*reloadedConfig)
+	return &current
+}
+
+// ReloadResult lists the settings changed by a reload and the changed settings which need a restart, the api
+// keys file is read again on every reload
+type ReloadResult struct {
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restart_required,omitempty"`
+	APIKeysReloaded bool     `json:"api_keys_reloaded,omitempty"`
+}
+
+// ConfigReloader reads the config file, the OPENOCR_* environment variables and the api keys file again and
+// applies the ReloadableConfig and the api keys. The flags given on the command line keep their value.
+// If the new configuration is not valid, the running one is kept
+type ConfigReloader struct {
+	mu         sync.Mutex
+	config     RabbitConfig
+	apiKeyAuth *APIKeyAuth
+}
+
+// NewConfigReloader creates the reloader for the config the http daemon was started with, apiKeyAuth is nil
+// if api keys are not used
+func NewConfigReloader(config *RabbitConfig, apiKeyAuth *APIKeyAuth) *ConfigReloader {
+	return &ConfigReloader{config: *config, apiKeyAuth: apiKeyAuth}
+}
+
+// Reload applies the current configuration, it is called on SIGHUP and by POST /admin/reload
+func (r *ConfigReloader) Reload() (ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := ReloadResult{Changed: []string{}}
+	loaded, err := loadRabbitConfig()
+	if controller, admissionErr := NewAdmissionController(&loaded); admissionErr != nil {
+		err = errors.Join(err, admissionErr)
+	} else {
+		_ = controller.Close()
+	}
+	var apiKeyStore APIKeyStore
+	if err == nil && r.apiKeyAuth != nil && loaded.APIKeysFile != "" {
+		apiKeyStore, err = NewFileAPIKeyStore(loaded.APIKeysFile)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("component", "OCR_CONFIG").Msg("configuration was not reloaded, keeping the running configuration")
+		return result, err
+	}
+
+	previous, next := r.config.reloadable(), loaded.reloadable()
+	result.Changed = changedFields(previous, next)
+	result.RestartRequired = restartRequired(r.config, loaded, apiKeyStore != nil)
+	if err = SetOutboundConfig(next.Outbound); err != nil {
+		return result, err
+	}
+	reloadedConfigMu.Lock()
+	reloadedConfig = &next
+	reloadedConfigMu.Unlock()
+	if apiKeyStore != nil {
+		r.apiKeyAuth.SetStore(apiKeyStore)
+		r.config.APIKeysFile = loaded.APIKeysFile
+		result.APIKeysReloaded = true
+	}
+	r.config.setReloadable(next)
+
+	logger := log.Info().Str("component", "OCR_CONFIG").Strs("changed", result.Changed).
+		Bool("api_keys_reloaded", result.APIKeysReloaded)
+	if len(result.RestartRequired) > 0 {
+		logger = logger.Strs("restart_required", result.RestartRequired)
+	}
+	logger.Msg("configuration reloaded")
+	return result, nil
+}
+
+// ServeHTTP reloads the configuration on POST /admin/reload, a configuration which is not valid is answered
+// with 422 and the list of its problems
+func (r *ConfigReloader) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	result, err := r.Reload()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	var body interface{} = result
+	httpStatus := http.StatusOK
+	if err != nil {
+		httpStatus = http.StatusUnprocessableEntity
+		body = map[string]string{"error": err.Error()}
+	}
+	w.WriteHeader(httpStatus)
+	if err = json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Str("component", "OCR_CONFIG").Msg("http write() failed")
+	}
+}
+
+// loadRabbitConfig builds the config of the http daemon from the command line flags of the process, the
+// environment and the config file like DefaultConfigFlagsOverride
+func loadRabbitConfig() (RabbitConfig, error) {
+	flagSet := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	rabbitConfigFlags := addRabbitConfigFlags(flagSet)
+	var errs []error
+	for name, value := range configSources.onCommandLine {
+		if flagSet.Lookup(name) == nil {
+			continue
+		}
+		if err := flagSet.Set(name, value); err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %v", name, err))
+		}
+	}
+	errs = append(errs, applyConfigSources(flagSet, configSources.path, os.LookupEnv))
+	rabbitConfig, err := rabbitConfigFlags()
+	return rabbitConfig, errors.Join(append(errs, err)...)
+}
+
+// changedFields returns the names of the fields of the structs previous and next which differ, the fields of
+// embedded structs like CommonConfig are compared one by one
+func changedFields(previous, next interface{}) []string {
+	changed := []string{}
+	previousValue, nextValue := reflect.ValueOf(previous), reflect.ValueOf(next)
+	for i := 0; i < previousValue.NumField(); i++ {
+		field := previousValue.Type().Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			changed = append(changed, changedFields(previousValue.Field(i).Interface(), nextValue.Field(i).Interface())...)
+			continue
+		}
+		if !reflect.DeepEqual(previousValue.Field(i).Interface(), nextValue.Field(i).Interface()) {
+			changed = append(changed, field.Name)
+		}
+	}
+	return changed
+}
+
+// restartRequired returns the changed settings which are not reloaded
+func restartRequired(previous, loaded RabbitConfig, apiKeysReloaded bool) []string {
+	previous.setReloadable(ReloadableConfig{})
+	loaded.setReloadable(ReloadableConfig{})
+	if apiKeysReloaded {
+		loaded.APIKeysFile = previous.APIKeysFile
+	}
+	return changedFields(previous, loaded)
+}
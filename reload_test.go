@@ -0,0 +1,89 @@
+package ocrworker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func setConfigSources(t *testing.T, path string, onCommandLine map[string]string) {
+	previousSources := configSources
+	configSources.path = path
+	configSources.onCommandLine = onCommandLine
+	t.Cleanup(func() {
+		configSources = previousSources
+		reloadedConfigMu.Lock()
+		reloadedConfig = nil
+		reloadedConfigMu.Unlock()
+		_ = SetOutboundConfig(DefaultOutboundConfig())
+	})
+}
+
+func TestConfigReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "open-ocr.yaml")
+	writeConfig := func(content string) {
+		assert.True(t, os.WriteFile(path, []byte(content), 0o600) == nil)
+	}
+	writeConfig("")
+	setConfigSources(t, path, map[string]string{"worker_factor": "3"})
+	config, err := loadRabbitConfig()
+	assert.True(t, err == nil)
+
+	writeConfig("max_batch_size: 10\nqueue_prio: {egvp: 9}\n")
+	assert.True(t, currentConfig(&config) == &config)
+	reloader := NewConfigReloader(&config, nil)
+	result, err := reloader.Reload()
+	assert.True(t, err == nil)
+	assert.DeepEquals(t, result.Changed, []string{"QueuePrio", "MaxBatchSize"})
+	current := currentConfig(&config)
+	assert.Equals(t, current.MaxBatchSize, uint(10))
+	assert.Equals(t, current.QueuePrio["egvp"], uint8(9))
+	// the flags given on the command line keep their value
+	assert.Equals(t, current.FactorForMessageAccept, uint(3))
+	// the config of the handler isn't changed
+	assert.Equals(t, config.MaxBatchSize, uint(defaultMaxBatchSize))
+	assert.Equals(t, config.FactorForMessageAccept, uint(3))
+
+	// settings which are not reloaded are reported
+	writeConfig("max_batch_size: 10\nqueue_prio: {egvp: 9}\namqp_uri: amqp://other/\n")
+	result, err = reloader.Reload()
+	assert.True(t, err == nil)
+	assert.DeepEquals(t, result.Changed, []string{})
+	assert.DeepEquals(t, result.RestartRequired, []string{"AmqpURI"})
+
+	// a configuration which is not valid is rejected as a whole
+	writeConfig("max_batch_size: 20\ndefault_timeout: 100\nmaximal_timeout: 10\noutbound_allow_cidrs: nonsense\n")
+	recorder := httptest.NewRecorder()
+	reloader.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	assert.Equals(t, recorder.Code, http.StatusUnprocessableEntity)
+	assert.Equals(t, currentConfig(&config).MaxBatchSize, uint(10))
+}
+
+func TestConfigReloadAPIKeys(t *testing.T) {
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, "keys.json")
+	assert.True(t, os.WriteFile(keysFile, []byte(`[{"key":"old","client_id":"a"}]`), 0o600) == nil)
+	setConfigSources(t, "", map[string]string{"api_keys": keysFile})
+	config := DefaultTestConfig()
+	config.APIKeysFile = keysFile
+	store, err := NewFileAPIKeyStore(keysFile)
+	assert.True(t, err == nil)
+	auth := NewAPIKeyAuth(store)
+
+	assert.True(t, os.WriteFile(keysFile, []byte(`[{"key":"new","client_id":"a","rate_limit":1}]`), 0o600) == nil)
+	result, err := NewConfigReloader(&config, auth).Reload()
+	assert.True(t, err == nil)
+	assert.True(t, result.APIKeysReloaded)
+	handler := auth.Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	for key, code := range map[string]int{"old": http.StatusUnauthorized, "new": http.StatusOK} {
+		request := httptest.NewRequest(http.MethodPost, "/ocr", nil)
+		request.Header.Set(APIKeyHeader, key)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		assert.Equals(t, recorder.Code, code)
+	}
+}
@@ -0,0 +1,259 @@
+package ocrworker
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// RejectRequestTooLarge is returned with 413 if the body exceeds UploadConfig.MaxRequestSize
+const RejectRequestTooLarge = "request_too_large"
+
+const defaultMaxRequestSize = 100 << 20
+
+var errMalformedRequest = errors.New("malformed request")
+
+// UploadConfig limits request bodies and sets where uploads wait until they are published
+type UploadConfig struct {
+	// MaxRequestSize limits the body of /ocr, /ocr-file-upload and /batches in bytes, 0 disables the limit
+	MaxRequestSize int64
+	// Dir holds uploaded files and decoded img_base64 until the request is published, empty is the
+	// temporary directory of the system
+	Dir string
+}
+
+func DefaultUploadConfig() UploadConfig {
+	return UploadConfig{MaxRequestSize: defaultMaxRequestSize}
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// limitRequestBody caps the body of req at MaxRequestSize. The returned function records the bytes read
+// in the requestSize histogram and has to be called once the body is consumed
+func limitRequestBody(w http.ResponseWriter, req *http.Request, config *UploadConfig) func() {
+	if config.MaxRequestSize > 0 {
+		req.Body = http.MaxBytesReader(w, req.Body, config.MaxRequestSize)
+	}
+	body := &countingBody{ReadCloser: req.Body}
+	req.Body = body
+	return func() {
+		requestSize.WithLabelValues().Observe(float64(body.n))
+	}
+}
+
+func isRequestTooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
+
+func writeRequestTooLarge(w http.ResponseWriter, requestID string, config *UploadConfig) {
+	writeRejection(w, http.StatusRequestEntityTooLarge, requestID, RejectRequestTooLarge,
+		fmt.Sprintf("request exceeds the limit of %d bytes. RequestID %s", config.MaxRequestSize, requestID), 0)
+}
+
+// decodeOcrRequest decodes the json body of /ocr. img_base64 is decoded while it is read and spooled to a file in
+// dir, so neither the base64 string nor the image have to be kept in memory. The caller has to remove the file
+// with removeImgFile if the request is not handled
+func decodeOcrRequest(body io.Reader, ocrRequest *OcrRequest, dir string) error {
+	reader := bufio.NewReader(body)
+	fields := make(map[string]json.RawMessage)
+	decoder := json.NewDecoder(reader)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return malformedRequest(err, "expected a json object")
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return malformedRequest(err, "")
+		}
+		key, _ := token.(string)
+		if key != "img_base64" {
+			var value json.RawMessage
+			if err = decoder.Decode(&value); err != nil {
+				return malformedRequest(err, "")
+			}
+			fields[key] = value
+			continue
+		}
+		// the decoder stopped after the key, the value is read from the rest of the body
+		reader = bufio.NewReader(io.MultiReader(decoder.Buffered(), reader))
+		if err = spoolBase64(reader, ocrRequest, dir); err != nil {
+			return err
+		}
+		next, err := skipSpace(reader)
+		if err != nil {
+			return malformedRequest(err, "")
+		}
+		if next == '}' {
+			decoder = nil
+			break
+		}
+		if next != ',' {
+			return malformedRequest(nil, "expected , or } after img_base64")
+		}
+		decoder = json.NewDecoder(io.MultiReader(strings.NewReader("{"), reader))
+		_, _ = decoder.Token()
+	}
+	if decoder != nil {
+		if _, err := decoder.Token(); err != nil {
+			return malformedRequest(err, "")
+		}
+	}
+	object, err := json.Marshal(fields)
+	if err == nil {
+		err = json.Unmarshal(object, ocrRequest)
+	}
+	if err != nil {
+		return malformedRequest(err, "")
+	}
+	return nil
+}
+
+// spoolBase64 reads the json string following a key from reader, decodes it and writes the image to a file
+func spoolBase64(reader *bufio.Reader, ocrRequest *OcrRequest, dir string) error {
+	next, err := skipSpace(reader)
+	if err == nil && next != ':' {
+		err = errors.New("expected : after img_base64")
+	}
+	if err == nil {
+		next, err = skipSpace(reader)
+	}
+	if err != nil {
+		return malformedRequest(err, "")
+	}
+	if next == 'n' {
+		// null
+		if _, err = reader.Discard(3); err != nil {
+			return malformedRequest(err, "")
+		}
+		return nil
+	}
+	if next != '"' {
+		return malformedRequest(nil, "img_base64 has to be a string")
+	}
+
+	file, err := os.CreateTemp(dir, "open-ocr-upload-*")
+	if err != nil {
+		return err
+	}
+	// the base64 decoder skips line breaks, other characters of the alphabet are never escaped except for /
+	size, err := io.Copy(file, base64.NewDecoder(base64.StdEncoding, &jsonStringReader{reader: reader}))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return malformedRequest(err, "img_base64 is not valid base64")
+	}
+	ocrRequest.removeImgFile()
+	ocrRequest.imgFile, ocrRequest.imgFileSize = file.Name(), size
+	return nil
+}
+
+// jsonStringReader returns the content of a json string up to its closing quote
+type jsonStringReader struct {
+	reader *bufio.Reader
+	done   bool
+}
+
+func (r *jsonStringReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && !r.done {
+		c, err := r.reader.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		switch c {
+		case '"':
+			r.done = true
+			continue
+		case '\\':
+			if c, err = r.reader.ReadByte(); err != nil {
+				return n, io.ErrUnexpectedEOF
+			}
+			switch c {
+			case '/':
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			default:
+				return n, fmt.Errorf("unexpected escape sequence \\%c", c)
+			}
+		}
+		p[n] = c
+		n++
+	}
+	if n == 0 && r.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func skipSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			return c, nil
+		}
+	}
+}
+
+// malformedRequest keeps errors of the body limit detectable by isRequestTooLarge
+func malformedRequest(err error, message string) error {
+	switch {
+	case err == nil:
+		return fmt.Errorf("%w: %s", errMalformedRequest, message)
+	case message == "":
+		return fmt.Errorf("%w: %w", errMalformedRequest, err)
+	default:
+		return fmt.Errorf("%w: %s: %w", errMalformedRequest, message, err)
+	}
+}
+
+// addUploadFlags registers the flags limiting request bodies, the returned function has to be called after flagSet was parsed
+func addUploadFlags(flagSet *flag.FlagSet) func() UploadConfig {
+	defaults := DefaultUploadConfig()
+	var (
+		maxRequestSize int64
+		dir            string
+	)
+	flagSet.Int64Var(
+		&maxRequestSize,
+		"max_request_size",
+		defaults.MaxRequestSize,
+		"Maximal size in bytes of a request body to /ocr, /ocr-file-upload and /v1/batches, larger requests are rejected with 413. 0 disables the limit",
+	)
+	flagSet.StringVar(
+		&dir,
+		"upload_dir",
+		defaults.Dir,
+		"Directory for uploads and decoded img_base64 until they are published. Empty uses the temporary directory of the system",
+	)
+	return func() UploadConfig {
+		return UploadConfig{MaxRequestSize: maxRequestSize, Dir: dir}
+	}
+}
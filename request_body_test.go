@@ -0,0 +1,101 @@
+package ocrworker
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestDecodeOcrRequestSpoolsBase64(t *testing.T) {
+	image := append([]byte(nil), pngHeader...)
+	image = append(image, 0xff, 0xfe, 0xfd, 0xfc)
+	// json encoders may escape the / of the base64 alphabet and wrap long lines
+	encoded := base64.StdEncoding.EncodeToString(image)
+	encoded = strings.ReplaceAll(encoded, "/", `\/`)
+	encoded = encoded[:8] + `\n` + encoded[8:]
+	body := `{"engine": "tesseract", "img_base64" : "` + encoded + `", "reference_id":"4711", "engine_args":{"lang":"deu"}}`
+
+	ocrRequest := OcrRequest{RequestID: "id"}
+	err := decodeOcrRequest(strings.NewReader(body), &ocrRequest, t.TempDir())
+	assert.True(t, err == nil)
+	defer ocrRequest.removeImgFile()
+	assert.Equals(t, ocrRequest.RequestID, "id")
+	assert.Equals(t, ocrRequest.EngineType, EngineTesseract)
+	assert.Equals(t, ocrRequest.ReferenceID, "4711")
+	assert.Equals(t, ocrRequest.EngineArgs["lang"], "deu")
+	assert.Equals(t, ocrRequest.ImgBase64, "")
+	assert.Equals(t, ocrRequest.imgFileSize, int64(len(image)))
+
+	imgFile := ocrRequest.imgFile
+	assert.True(t, ocrRequest.readImgFile() == nil)
+	assert.DeepEquals(t, ocrRequest.ImgBytes, image)
+	_, err = os.Stat(imgFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDecodeOcrRequestWithoutBase64(t *testing.T) {
+	ocrRequest := OcrRequest{}
+	err := decodeOcrRequest(strings.NewReader(`{"img_url":"http://example.com/a.png","img_base64":null}`), &ocrRequest, t.TempDir())
+	assert.True(t, err == nil)
+	assert.Equals(t, ocrRequest.ImgUrl, "http://example.com/a.png")
+	assert.Equals(t, ocrRequest.imgFile, "")
+
+	ocrRequest = OcrRequest{}
+	err = decodeOcrRequest(strings.NewReader(`{"img_base64":"aGVsbG8="}`), &ocrRequest, t.TempDir())
+	assert.True(t, err == nil)
+	assert.Equals(t, ocrRequest.imgFileSize, int64(5))
+	ocrRequest.removeImgFile()
+}
+
+func TestDecodeOcrRequestMalformed(t *testing.T) {
+	dir := t.TempDir()
+	for _, body := range []string{
+		``,
+		`[]`,
+		`{"engine":`,
+		`{"img_base64":42}`,
+		`{"img_base64":"not base64!"}`,
+		`{"img_base64":"aGVsbG8="`,
+		`{"img_base64":"aGVsbG8=" "engine":"tesseract"}`,
+		`{"img_base64":"aGVsbG8=", "engine":}`,
+	} {
+		ocrRequest := OcrRequest{}
+		err := decodeOcrRequest(strings.NewReader(body), &ocrRequest, dir)
+		assert.True(t, errors.Is(err, errMalformedRequest))
+		ocrRequest.removeImgFile()
+	}
+	// nothing is left behind
+	files, _ := os.ReadDir(dir)
+	assert.Equals(t, len(files), 0)
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	config := UploadConfig{MaxRequestSize: 64, Dir: t.TempDir()}
+	body := `{"img_base64":"` + base64.StdEncoding.EncodeToString(make([]byte, 128)) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/ocr", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	observe := limitRequestBody(recorder, req, &config)
+
+	ocrRequest := OcrRequest{}
+	err := decodeOcrRequest(req.Body, &ocrRequest, config.Dir)
+	observe()
+	assert.True(t, isRequestTooLarge(err))
+	writeRequestTooLarge(recorder, "id", &config)
+	assert.Equals(t, recorder.Code, http.StatusRequestEntityTooLarge)
+	assert.True(t, strings.Contains(recorder.Body.String(), RejectRequestTooLarge))
+	files, _ := os.ReadDir(config.Dir)
+	assert.Equals(t, len(files), 0)
+
+	// uploads are limited as well
+	req = newFormDataRequest(t, nil, append(pngHeader, make([]byte, 128)...))
+	observe = limitRequestBody(httptest.NewRecorder(), req, &config)
+	_, err = (&OcrHttpMultipartHandler{RabbitConfig: RabbitConfig{Upload: config}}).extractParts(req)
+	observe()
+	assert.True(t, isRequestTooLarge(err))
+}
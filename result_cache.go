@@ -0,0 +1,172 @@
+package ocrworker
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultResultCacheSize = 10000
+
+var resultCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ocr_result_cache_lookups_total",
+		Help: "Lookups in the result cache, result is hit or miss.",
+	},
+	[]string{"result"},
+)
+
+// ResultCacheConfig enables answering requests for documents which were processed before from memory
+type ResultCacheConfig struct {
+	// TTL is the time in seconds a result is kept, 0 disables the cache
+	TTL uint
+	// MaxEntries is the number of results kept, the least recently used are evicted first
+	MaxEntries uint
+}
+
+func DefaultResultCacheConfig() ResultCacheConfig {
+	return ResultCacheConfig{TTL: 0, MaxEntries: defaultResultCacheSize}
+}
+
+type resultCacheEntry struct {
+	key     string
+	result  OcrResult
+	expires time.Time
+}
+
+type pendingCacheKey struct {
+	key     string
+	expires time.Time
+}
+
+// ocrResultCache keeps successful results by cacheKey. Requests which may be cached are registered with
+// expect, their result is stored when it arrives from the worker
+type ocrResultCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	pending map[string]pendingCacheKey // RequestID -> cache key
+	now     func() time.Time
+}
+
+var resultCache = newOcrResultCache()
+
+func newOcrResultCache() *ocrResultCache {
+	return &ocrResultCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		pending: make(map[string]pendingCacheKey),
+		now:     time.Now,
+	}
+}
+
+// cacheKey identifies the output of a request: the image and everything which changes how it is processed.
+// Results are never shared across tenants, so the tenant is part of the key. Requests without image bytes,
+// i.e. img_url fetched by the worker, can't be cached
+func (ocrRequest *OcrRequest) cacheKey() string {
+	if len(ocrRequest.ImgBytes) == 0 {
+		return ""
+	}
+	hash := sha256.New()
+	hash.Write(ocrRequest.ImgBytes)
+	// json sorts the keys of maps, so equal arguments give equal keys
+	options, err := json.Marshal(struct {
+		Engine           OcrEngineType          `json:"engine"`
+		EngineArgs       map[string]interface{} `json:"engine_args"`
+		Preprocessors    []string               `json:"preprocessors"`
+		PreprocessorArgs map[string]interface{} `json:"preprocessor_args"`
+		PageNumber       uint16                 `json:"page_number"`
+		Tenant           string                 `json:"tenant"`
+	}{ocrRequest.EngineType, ocrRequest.EngineArgs, ocrRequest.PreprocessorChain, ocrRequest.PreprocessorArgs, ocrRequest.PageNumber,
+		ocrRequest.Tenant})
+	if err != nil {
+		return ""
+	}
+	hash.Write(options)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// get returns the cached result for key, the ID of the result is the one of the request which produced it
+func (c *ocrResultCache) get(key string) (OcrResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if ok && c.now().After(element.Value.(*resultCacheEntry).expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		resultCacheLookups.WithLabelValues("miss").Inc()
+		return OcrResult{}, false
+	}
+	c.lru.MoveToFront(element)
+	resultCacheLookups.WithLabelValues("hit").Inc()
+	return element.Value.(*resultCacheEntry).result, true
+}
+
+// expect registers the cache key of a published request until its deadline
+func (c *ocrResultCache) expect(requestID, key string, deadline time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for id, pending := range c.pending {
+		if now.After(pending.expires) {
+			delete(c.pending, id)
+		}
+	}
+	c.pending[requestID] = pendingCacheKey{key: key, expires: deadline}
+}
+
+// store caches the result of an expected request, failed requests are not cached
+func (c *ocrResultCache) store(ocrResult *OcrResult, config ResultCacheConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending, ok := c.pending[ocrResult.ID]
+	if !ok {
+		return
+	}
+	delete(c.pending, ocrResult.ID)
+	if ocrResult.Status == "error" || config.TTL == 0 || config.MaxEntries == 0 {
+		return
+	}
+	entry := &resultCacheEntry{key: pending.key, result: *ocrResult, expires: c.now().Add(time.Duration(config.TTL) * time.Second)}
+	if element, ok := c.entries[pending.key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[pending.key] = c.lru.PushFront(entry)
+	for uint(c.lru.Len()) > config.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resultCacheEntry).key)
+	}
+}
+
+// addResultCacheFlags registers the flags of the result cache, the returned function has to be called after flagSet was parsed
+func addResultCacheFlags(flagSet *flag.FlagSet) func() ResultCacheConfig {
+	defaults := DefaultResultCacheConfig()
+	var ttl, maxEntries uint
+	flagSet.UintVar(
+		&ttl,
+		"result_cache_ttl",
+		defaults.TTL,
+		"Time in seconds results are kept to answer requests for identical documents without a worker. 0 disables the cache",
+	)
+	flagSet.UintVar(
+		&maxEntries,
+		"result_cache_size",
+		defaults.MaxEntries,
+		"Maximal number of results in the result cache",
+	)
+	return func() ResultCacheConfig {
+		return ResultCacheConfig{TTL: ttl, MaxEntries: maxEntries}
+	}
+}
@@ -0,0 +1,74 @@
+package ocrworker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestResultCacheKey(t *testing.T) {
+	request := OcrRequest{
+		ImgBytes:   []byte("image"),
+		EngineType: EngineTesseract,
+		EngineArgs: map[string]interface{}{"lang": "deu", "psm": "3"},
+	}
+	same := OcrRequest{
+		ImgBytes:   []byte("image"),
+		EngineType: EngineTesseract,
+		EngineArgs: map[string]interface{}{"psm": "3", "lang": "deu"},
+		RequestID:  "other",
+	}
+	assert.Equals(t, request.cacheKey(), same.cacheKey())
+	assert.True(t, request.cacheKey() != "")
+
+	// results are not shared across tenants
+	same.Tenant = "other"
+	assert.True(t, request.cacheKey() != same.cacheKey())
+	same.Tenant = ""
+
+	same.EngineArgs["lang"] = "eng"
+	assert.True(t, request.cacheKey() != same.cacheKey())
+	same.EngineArgs["lang"] = "deu"
+	same.PreprocessorChain = []string{"identity"}
+	assert.True(t, request.cacheKey() != same.cacheKey())
+
+	request.ImgBytes = nil
+	request.ImgUrl = "http://example.com/a.png"
+	assert.Equals(t, request.cacheKey(), "")
+}
+
+func TestResultCacheStoresExpectedResults(t *testing.T) {
+	cache := newOcrResultCache()
+	config := ResultCacheConfig{TTL: 60, MaxEntries: 2}
+	deadline := time.Now().Add(time.Hour)
+
+	// results of requests which weren't expected and failed requests are not cached
+	cache.store(&OcrResult{ID: "unknown", Status: "done"}, config)
+	cache.expect("failed", "a", deadline)
+	cache.store(&OcrResult{ID: "failed", Status: "error"}, config)
+	_, ok := cache.get("a")
+	assert.False(t, ok)
+
+	cache.expect("1", "a", deadline)
+	cache.store(&OcrResult{ID: "1", Status: "done", Text: "text a"}, config)
+	ocrResult, ok := cache.get("a")
+	assert.True(t, ok)
+	assert.Equals(t, ocrResult.Text, "text a")
+
+	// the least recently used result is evicted
+	cache.expect("2", "b", deadline)
+	cache.store(&OcrResult{ID: "2", Status: "done"}, config)
+	_, _ = cache.get("a")
+	cache.expect("3", "c", deadline)
+	cache.store(&OcrResult{ID: "3", Status: "done"}, config)
+	_, ok = cache.get("b")
+	assert.False(t, ok)
+	_, ok = cache.get("a")
+	assert.True(t, ok)
+
+	now := time.Now().Add(2 * time.Minute)
+	cache.now = func() time.Time { return now }
+	_, ok = cache.get("a")
+	assert.False(t, ok)
+}
@@ -3,10 +3,10 @@ package ocrworker
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
@@ -123,7 +123,7 @@ func (t *SandwichEngineArgs) Export() []string {
 }
 
 // ProcessRequest will process incoming OCR request by routing it through the whole process chain
-func (t SandwichEngine) ProcessRequest(ocrRequest *OcrRequest, workerConfig *WorkerConfig) (OcrResult, error) {
+func (t SandwichEngine) ProcessRequest(ctx context.Context, ocrRequest *OcrRequest, workerConfig *WorkerConfig) (OcrResult, error) {
 	logger := zerolog.New(os.Stdout).With().
 		Str("component", "OCR_SANDWICH").
 		Str("RequestID", ocrRequest.RequestID).Timestamp().Logger()
@@ -145,6 +145,7 @@ func (t SandwichEngine) ProcessRequest(ocrRequest *OcrRequest, workerConfig *Wor
 		Bool("Deferred", ocrRequest.Deferred).
 		Uint16("PageNumber", ocrRequest.PageNumber).
 		Uint("TimeOut", ocrRequest.TimeOut).
+		Time("Deadline", ocrRequest.Deadline).
 		Int("ImgBase64Size", len(ocrRequest.ImgBase64)).
 		Int("ImgBytesSize", len(ocrRequest.ImgBytes)).
 		Str("UserAgent", ocrRequest.UserAgent).
@@ -154,11 +155,11 @@ func (t SandwichEngine) ProcessRequest(ocrRequest *OcrRequest, workerConfig *Wor
 	tmpFileName, err := func() (string, error) {
 		switch {
 		case ocrRequest.ImgBase64 != "":
-			return t.tmpFileFromImageBase64(ocrRequest.ImgBase64, ocrRequest.RequestID)
+			return t.tmpFileFromImageBase64(ctx, ocrRequest.ImgBase64, ocrRequest.RequestID)
 		case ocrRequest.ImgUrl != "":
-			return t.tmpFileFromImageURL(ocrRequest.ImgUrl, ocrRequest.RequestID)
+			return t.tmpFileFromImageURL(ctx, ocrRequest.ImgUrl, ocrRequest.RequestID, ocrRequest.imgURLFetchConfig(&workerConfig.ImgURLFetch))
 		default:
-			return t.tmpFileFromImageBytes(ocrRequest.ImgBytes, ocrRequest.RequestID)
+			return t.tmpFileFromImageBytes(ctx, ocrRequest.ImgBytes, ocrRequest.RequestID)
 		}
 	}()
 	if err != nil {
@@ -190,18 +191,15 @@ func (t SandwichEngine) ProcessRequest(ocrRequest *OcrRequest, workerConfig *Wor
 		logger.Error().Err(err).Caller().Msg("error getting engineArgs")
 		return OcrResult{Text: "can not build arguments", Status: "error"}, err
 	}
-	// getting timeout for request
-	configTimeOut := ocrRequest.TimeOut
-
-	ocrResult, err := t.processImageFile(tmpFileName, uplFileType, engineArgs, configTimeOut)
+	ocrResult, err := t.processImageFile(ctx, tmpFileName, uplFileType, engineArgs)
 
 	return ocrResult, err
 }
 
-func (SandwichEngine) tmpFileFromImageBytes(imgBytes []byte, tmpFileName string) (string, error) {
+func (SandwichEngine) tmpFileFromImageBytes(ctx context.Context, imgBytes []byte, tmpFileName string) (string, error) {
 	log.Info().Str("component", "OCR_SANDWICH").Msg("Use pdfsandwich with bytes image")
 	var err error
-	tmpFileName, err = createTempFileName(tmpFileName)
+	tmpFileName, err = createTempFileName(ctx, tmpFileName)
 	if err != nil {
 		return "", err
 	}
@@ -216,14 +214,12 @@ func (SandwichEngine) tmpFileFromImageBytes(imgBytes []byte, tmpFileName string)
 	return tmpFileName, nil
 }
 
-func (SandwichEngine) tmpFileFromImageBase64(base64Image, tmpFileName string) (string, error) {
+func (SandwichEngine) tmpFileFromImageBase64(ctx context.Context, base64Image, tmpFileName string) (string, error) {
 	log.Info().Str("component", "OCR_SANDWICH").Msg("Use pdfsandwich with base 64")
 	var err error
-	if tmpFileName == "" {
-		tmpFileName, err = createTempFileName("")
-		if err != nil {
-			return "", err
-		}
+	tmpFileName, err = createTempFileName(ctx, tmpFileName)
+	if err != nil {
+		return "", err
 	}
 
 	// decoding into bytes the base64 string
@@ -240,18 +236,16 @@ func (SandwichEngine) tmpFileFromImageBase64(base64Image, tmpFileName string) (s
 	return tmpFileName, nil
 }
 
-func (SandwichEngine) tmpFileFromImageURL(imgURL, tmpFileName string) (string, error) {
+func (SandwichEngine) tmpFileFromImageURL(ctx context.Context, imgURL, tmpFileName string, fetchConfig *ImgURLFetchConfig) (string, error) {
 	log.Info().Str("component", "OCR_SANDWICH").Msg("Use pdfsandwich with url")
 	var err error
-	if tmpFileName == "" {
-		tmpFileName, err = createTempFileName("")
-		if err != nil {
-			return "", err
-		}
+	tmpFileName, err = createTempFileName(ctx, tmpFileName)
+	if err != nil {
+		return "", err
 	}
 	// we have to write the contents of the image url to a temp
 	// file, because the leptonica lib can't seem to handle byte arrays
-	err = saveUrlContentToFileName(imgURL, tmpFileName)
+	err = fetchConfig.fetchToFile(ctx, imgURL, tmpFileName)
 	if err != nil {
 		return "", err
 	}
@@ -278,27 +272,26 @@ func (SandwichEngine) buildCmdLineArgs(inputFilename string, engineArgs *Sandwic
 	return cmdArgs, ocrLayerFile
 }
 
-func (SandwichEngine) runExternalCmd(commandToRun string, cmdArgs []string, defaultTimeOutSeconds time.Duration) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeOutSeconds)
-	defer cancel()
-
+// runExternalCmd runs the command until it finishes or ctx is done
+func (SandwichEngine) runExternalCmd(ctx context.Context, commandToRun string, cmdArgs []string) (string, error) {
 	log.Debug().Str("component", "OCR_SANDWICH").
 		Str("command", commandToRun).
 		Interface("cmdArgs", cmdArgs).
 		Msg("running external command")
 
-	cmd := exec.CommandContext(ctx, commandToRun, cmdArgs...)
-	output, err := cmd.CombinedOutput()
-	if ctx.Err() == context.DeadlineExceeded {
-		err = fmt.Errorf("command timed out, terminated: %v", err)
-		// on deadline cancellation the output doesnt matter
-		return "", err
+	output, err := combinedOutput(ctx, commandToRun, cmdArgs...)
+	if ctx.Err() != nil {
+		// on deadline or cancellation the output doesnt matter. A job is canceled if the worker is draining
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("command timed out, terminated: %w", ctx.Err())
+		}
+		return "", fmt.Errorf("command was canceled, terminated: %w", ctx.Err())
 	}
 	// err = "command timed out, terminated: signal: killed"
 	return string(output), err
 }
 
-func (t SandwichEngine) processImageFile(inputFilename, uplFileType string, engineArgs *SandwichEngineArgs, configTimeOut uint) (OcrResult, error) {
+func (t SandwichEngine) processImageFile(ctx context.Context, inputFilename, uplFileType string, engineArgs *SandwichEngineArgs) (OcrResult, error) {
 	// if error flag is true, input files won't be deleted
 	errorFlag := false
 	filesToDelete := make([]string, 0)
@@ -345,10 +338,10 @@ func (t SandwichEngine) processImageFile(inputFilename, uplFileType string, engi
 		switch engineArgs.t2pConverter {
 		case "convert":
 			alternativeConverter = "tiff2pdf"
-			inputFilename = convertImageToPdf(inputFilename)
+			inputFilename = convertImageToPdf(ctx, inputFilename)
 		case "tiff2pdf":
 			alternativeConverter = "convert"
-			inputFilename = tiff2Pdf(inputFilename)
+			inputFilename = tiff2Pdf(ctx, inputFilename)
 		}
 		/* if the first converter fails, we will automatically try the second one.
 		If the second one fails, we will break up processing and return an error to a caller */
@@ -357,9 +350,9 @@ func (t SandwichEngine) processImageFile(inputFilename, uplFileType string, engi
 			logger.Warn().Err(err).Caller().Msg("Error exec " + engineArgs.t2pConverter + " Try to switch the image converter to " + alternativeConverter)
 			switch alternativeConverter {
 			case "convert":
-				inputFilename = convertImageToPdf(originalInputfileName)
+				inputFilename = convertImageToPdf(ctx, originalInputfileName)
 			case "tiff2pdf":
-				inputFilename = tiff2Pdf(originalInputfileName)
+				inputFilename = tiff2Pdf(ctx, originalInputfileName)
 			}
 			if inputFilename == "" {
 				err := fmt.Errorf("entirely failed to convert the input image to intermediate pdf, usually this is caused by a damaged input file")
@@ -372,13 +365,12 @@ func (t SandwichEngine) processImageFile(inputFilename, uplFileType string, engi
 
 	ocrType := strings.ToUpper(engineArgs.ocrType)
 
-	extCommandTimeout := time.Duration(configTimeOut) * time.Second
-
 	cmdArgs, ocrLayerFile = t.buildCmdLineArgs(inputFilename, engineArgs)
+	deadline, _ := ctx.Deadline()
 	logger.Info().Str("command", "pdfsandwich").Interface("cmdArgs", cmdArgs).
-		Uint("command_timeout", configTimeOut).
+		Time("deadline", deadline).
 		Msg("running external pdfsandwich command")
-	output, err := t.runExternalCmd("pdfsandwich", cmdArgs, extCommandTimeout)
+	output, err := t.runExternalCmd(ctx, "pdfsandwich", cmdArgs)
 	if err != nil {
 		errMsg := output
 		if errMsg != "" {
@@ -405,7 +397,7 @@ func (t SandwichEngine) processImageFile(inputFilename, uplFileType string, engi
 		logger.Info().Interface("combinedArgs", combinedArgs).
 			Msg("Arguments for pdftk to combine pdf files")
 
-		_, errPdftk := exec.Command("pdftk", combinedArgs...).CombinedOutput()
+		_, errPdftk := t.runExternalCmd(ctx, "pdftk", combinedArgs)
 		if errPdftk != nil {
 			logger.Error().Err(errPdftk).Caller().
 				Str("file_name", tmpOutCombinedPdf).
@@ -437,10 +429,10 @@ func (t SandwichEngine) processImageFile(inputFilename, uplFileType string, engi
 				Interface("compressedArgs", compressedArgs).
 				Msg("tmpOutCompressedPdf, tmpOutCombinedPdf, combinedArgs ")
 
-			outQpdf, errQpdf := exec.Command("gs", compressedArgs...).CombinedOutput()
+			outQpdf, errQpdf := t.runExternalCmd(ctx, "gs", compressedArgs)
 			if errQpdf != nil {
 				logger.Error().Err(errQpdf).
-					Str("outQpdf", string(outQpdf)).
+					Str("outQpdf", outQpdf).
 					Msg("Error running command")
 				errorFlag = true
 				return OcrResult{Status: "error"}, err
@@ -457,10 +449,9 @@ func (t SandwichEngine) processImageFile(inputFilename, uplFileType string, engi
 		logger.Info().Msg("extracting text from ocr")
 		textFile := fmt.Sprintf("%s%s", strings.TrimSuffix(ocrLayerFile, filepath.Ext(ocrLayerFile)), ".txt")
 		filesToDelete = append(filesToDelete, textFile)
-		cmdArgsPdfToText := exec.Command("pdftotext", ocrLayerFile)
-		outputPdfToText, err := cmdArgsPdfToText.CombinedOutput()
+		outputPdfToText, err := t.runExternalCmd(ctx, "pdftotext", []string{ocrLayerFile})
 		if err != nil {
-			errMsg := fmt.Sprintf(string(outputPdfToText), err)
+			errMsg := fmt.Sprintf(outputPdfToText, err)
 			err := fmt.Errorf(errMsg)
 			logger.Error().Caller().Err(err).Msg("error exec pdftotext")
 			errorFlag = true
@@ -1,9 +1,13 @@
 package ocrworker
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
@@ -33,7 +37,7 @@ func TestSandwichEngineWithRequest(t *testing.T) {
 	workerConfig := workerConfigForTests()
 
 	assert.True(t, err == nil)
-	result, err := engine.ProcessRequest(&ocrRequest, &workerConfig)
+	result, err := engine.ProcessRequest(context.Background(), &ocrRequest, &workerConfig)
 	assert.True(t, err == nil)
 	log.Info().Str("component", "TEST").Interface("result", result)
 }
@@ -63,7 +67,7 @@ func TestSandwichEngineWithJson(t *testing.T) {
 		assert.True(t, err == nil)
 		ocrRequest.ImgBytes = bytes
 		engine := NewOcrEngine(ocrRequest.EngineType)
-		result, err := engine.ProcessRequest(&ocrRequest, &workerConfig)
+		result, err := engine.ProcessRequest(context.Background(), &ocrRequest, &workerConfig)
 		log.Error().Err(err).Str("component", "TEST")
 		assert.True(t, err == nil)
 		log.Info().Str("component", "TEST").Interface("result", result)
@@ -96,9 +100,26 @@ func TestSandwichEngineWithFile(t *testing.T) {
 	engineArgs.ocrOptimize = true
 	engineArgs.lang = "deu"
 	engineArgs.saveFiles = true
-	result, err := engine.processImageFile("docs/testimage.pdf", "PDF", &engineArgs, 20)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	result, err := engine.processImageFile(ctx, "docs/testimage.pdf", "PDF", &engineArgs)
 	log.Warn().Err(err).Str("component", "TEST")
 	assert.True(t, err == nil)
 
 	log.Info().Str("component", "TEST").Interface("result", result)
 }
+
+func TestRunExternalCmdReportsTimeoutAndCancellation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := SandwichEngine{}.runExternalCmd(ctx, "sleep", []string{"5"})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, strings.Contains(err.Error(), "timed out"))
+
+	// a job canceled while the worker drains didn't run into its deadline
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = SandwichEngine{}.runExternalCmd(ctx, "sleep", []string{"5"})
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.False(t, strings.Contains(err.Error(), "timed out"))
+}
@@ -0,0 +1,318 @@
+package ocrworker
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+)
+
+// scheduling modes, selectable by the scheduling flag
+const (
+	// SchedulingPriority uses a single queue and the AMQP priority derived from doc_type
+	SchedulingPriority = "priority"
+	// SchedulingWeighted uses a queue per class, workers consume the classes according to their weights
+	SchedulingWeighted = "weighted"
+)
+
+const (
+	// ClassByDocType and ClassByTenant select what the class of a request is derived from
+	ClassByDocType = "doc_type"
+	ClassByTenant  = "tenant"
+	// defaultClass is used for requests whose doc_type or tenant has no configured weight
+	defaultClass = "standard"
+	// publishedAtHeader holds the time in unix milliseconds a request was published by the http daemon
+	publishedAtHeader = "x-published-at"
+)
+
+var classWait = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "ocr_class_wait_seconds",
+		Help:    "A histogram of the time requests waited in the queue of their class.",
+		Buckets: []float64{.1, .5, 1, 5, 10, 30, 60, 300, 900, 3600},
+	},
+	[]string{"class"},
+)
+
+// SchedulingConfig has to be the same for the http daemon, preprocessors and workers
+type SchedulingConfig struct {
+	Mode    string
+	ClassBy string
+	// Weights of the classes, a class with weight 2 is dispatched twice as often as a class with weight 1
+	Weights map[string]uint
+	// MaxWait in seconds after which a waiting request is dispatched regardless of the weights, 0 disables it
+	MaxWait uint
+}
+
+// DefaultSchedulingConfig keeps the single priority queue
+func DefaultSchedulingConfig() SchedulingConfig {
+	return SchedulingConfig{
+		Mode:    SchedulingPriority,
+		ClassBy: ClassByDocType,
+		Weights: map[string]uint{defaultClass: 1},
+	}
+}
+
+func (c *SchedulingConfig) weighted() bool {
+	return c.Mode == SchedulingWeighted
+}
+
+// classOf returns the class of a request, classes without weight fall back to the default class
+func (c *SchedulingConfig) classOf(ocrRequest *OcrRequest) string {
+	class := ocrRequest.DocType
+	if c.ClassBy == ClassByTenant {
+		class = ocrRequest.Tenant
+	}
+	if _, ok := c.Weights[class]; !ok {
+		return defaultClass
+	}
+	return class
+}
+
+// classes returns the configured classes sorted by name
+func (c *SchedulingConfig) classes() []string {
+	classes := make([]string, 0, len(c.Weights))
+	for class := range c.Weights {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+// queueName returns the queue of a class, the routing key is the same as the queue name
+func (c *SchedulingConfig) queueName(queue, class string) string {
+	return queue + "." + class
+}
+
+// queueNames returns all queues of queue, which is a single one unless weighted scheduling is used
+func (c *SchedulingConfig) queueNames(queue string) []string {
+	if !c.weighted() {
+		return []string{queue}
+	}
+	var names []string
+	for _, class := range c.classes() {
+		names = append(names, c.queueName(queue, class))
+	}
+	return names
+}
+
+// routingKey returns the routing key of the ocr workers for ocrRequest
+func (c *SchedulingConfig) routingKey(routingKey string, ocrRequest *OcrRequest) string {
+	if !c.weighted() {
+		return routingKey
+	}
+	return c.queueName(routingKey, c.classOf(ocrRequest))
+}
+
+func (c *SchedulingConfig) validate() error {
+	switch c.Mode {
+	case SchedulingPriority, SchedulingWeighted:
+	default:
+		return fmt.Errorf("unknown scheduling mode %q, use %s or %s", c.Mode, SchedulingPriority, SchedulingWeighted)
+	}
+	if c.ClassBy != ClassByDocType && c.ClassBy != ClassByTenant {
+		return fmt.Errorf("unknown scheduling class %q, use %s or %s", c.ClassBy, ClassByDocType, ClassByTenant)
+	}
+	for class, weight := range c.Weights {
+		if weight == 0 {
+			return fmt.Errorf("weight of class %q has to be at least 1", class)
+		}
+	}
+	return nil
+}
+
+// addSchedulingFlags registers the scheduling flags. The returned function builds the config
+// and has to be called after flagSet was parsed
+func addSchedulingFlags(flagSet *flag.FlagSet) func() (SchedulingConfig, error) {
+	defaults := DefaultSchedulingConfig()
+	var (
+		mode    string
+		classBy string
+		weights string
+		maxWait uint
+	)
+	flagSet.StringVar(
+		&mode,
+		"scheduling",
+		defaults.Mode,
+		"Scheduling of requests: "+SchedulingPriority+" (one queue, AMQP priority by doc_type) or "+
+			SchedulingWeighted+" (one queue per class, consumed by workers according to scheduling_weights)."+
+			" Has to be the same for http daemon, preprocessors and workers",
+	)
+	flagSet.StringVar(
+		&classBy,
+		"scheduling_class",
+		defaults.ClassBy,
+		"Class of a request for weighted scheduling: "+ClassByDocType+" or "+ClassByTenant,
+	)
+	flagSet.StringVar(
+		&weights,
+		"scheduling_weights",
+		"",
+		"JSON formatted weights of the classes for weighted scheduling e.g. {\"egvp\":5,\"standard\":1}."+
+			" Requests of other classes go to the class "+defaultClass,
+	)
+	flagSet.UintVar(
+		&maxWait,
+		"scheduling_max_wait",
+		0,
+		"Time in seconds after which a waiting request is dispatched before all others, 0 disables it",
+	)
+	return func() (SchedulingConfig, error) {
+		schedulingConfig := defaults
+		schedulingConfig.Mode = mode
+		schedulingConfig.ClassBy = classBy
+		schedulingConfig.MaxWait = maxWait
+		if weights != "" {
+			schedulingConfig.Weights = map[string]uint{}
+			if err := json.Unmarshal([]byte(weights), &schedulingConfig.Weights); err != nil {
+				return schedulingConfig, fmt.Errorf("scheduling_weights is not in a proper JSON format: %v", err)
+			}
+		}
+		if _, ok := schedulingConfig.Weights[defaultClass]; !ok {
+			schedulingConfig.Weights[defaultClass] = 1
+		}
+		return schedulingConfig, schedulingConfig.validate()
+	}
+}
+
+// publishedAt returns when the delivery was published by the http daemon
+func publishedAt(d *amqp.Delivery) (time.Time, bool) {
+	switch millis := d.Headers[publishedAtHeader].(type) {
+	case int64:
+		return time.UnixMilli(millis), true
+	case int32:
+		return time.UnixMilli(int64(millis)), true
+	}
+	return time.Time{}, false
+}
+
+// weightedDispatcher merges the deliveries of the class queues by smooth weighted round-robin.
+// It keeps at most one delivery per class, so the choice is made when a job slot gets free
+type weightedDispatcher struct {
+	classes []string
+	weights []int
+	current []int
+	maxWait time.Duration
+	now     func() time.Time
+}
+
+func newWeightedDispatcher(classes []string, config *SchedulingConfig) *weightedDispatcher {
+	dispatcher := &weightedDispatcher{
+		classes: classes,
+		weights: make([]int, len(classes)),
+		current: make([]int, len(classes)),
+		maxWait: time.Duration(config.MaxWait) * time.Second,
+		now:     time.Now,
+	}
+	for i, class := range classes {
+		dispatcher.weights[i] = int(config.Weights[class])
+	}
+	return dispatcher
+}
+
+// choose returns the index of the class to dispatch next among the classes with a waiting delivery
+// and whether it was promoted because it waited too long
+func (wd *weightedDispatcher) choose(heads []*amqp.Delivery) (int, bool) {
+	chosen := -1
+	if wd.maxWait > 0 {
+		var oldest time.Time
+		for i, head := range heads {
+			if head == nil {
+				continue
+			}
+			if published, ok := publishedAt(head); ok && wd.now().Sub(published) > wd.maxWait &&
+				(chosen < 0 || published.Before(oldest)) {
+				chosen, oldest = i, published
+			}
+		}
+		if chosen >= 0 {
+			return chosen, true
+		}
+	}
+	best := 0
+	for i, head := range heads {
+		if head == nil {
+			continue
+		}
+		if candidate := wd.current[i] + wd.weights[i]; chosen < 0 || candidate > best {
+			chosen, best = i, candidate
+		}
+	}
+	return chosen, false
+}
+
+// commit updates the round-robin state after the delivery of class chosen was dispatched
+func (wd *weightedDispatcher) commit(heads []*amqp.Delivery, chosen int) {
+	total := 0
+	for i, head := range heads {
+		if head != nil {
+			wd.current[i] += wd.weights[i]
+			total += wd.weights[i]
+		}
+	}
+	wd.current[chosen] -= total
+}
+
+// run forwards the deliveries of the class queues to out until all of them are closed
+func (wd *weightedDispatcher) run(in []<-chan amqp.Delivery, out chan<- amqp.Delivery) {
+	defer close(out)
+	heads := make([]*amqp.Delivery, len(in))
+	open := len(in)
+	for open > 0 || hasHead(heads) {
+		// cases 0..len(in)-1 receive from the classes without a waiting delivery, the last case sends
+		cases := make([]reflect.SelectCase, len(in)+1)
+		for i, deliveries := range in {
+			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv}
+			if heads[i] == nil && deliveries != nil {
+				cases[i].Chan = reflect.ValueOf(deliveries)
+			}
+		}
+		chosen, promoted := wd.choose(heads)
+		cases[len(in)] = reflect.SelectCase{Dir: reflect.SelectSend}
+		if chosen >= 0 {
+			cases[len(in)].Chan = reflect.ValueOf(out)
+			cases[len(in)].Send = reflect.ValueOf(*heads[chosen])
+		}
+
+		index, value, ok := reflect.Select(cases)
+		switch {
+		case index == len(in):
+			if !promoted {
+				wd.commit(heads, chosen)
+			}
+			wait := 0.0
+			if published, ok := publishedAt(heads[chosen]); ok {
+				wait = wd.now().Sub(published).Seconds()
+			}
+			classWait.WithLabelValues(wd.classes[chosen]).Observe(wait)
+			if promoted {
+				log.Info().Str("component", "OCR_WORKER").Str("class", wd.classes[chosen]).
+					Str("RequestID", heads[chosen].CorrelationId).Float64("wait", wait).
+					Msg("request exceeded the maximal wait time and was promoted")
+			}
+			heads[chosen] = nil
+		case !ok:
+			in[index] = nil
+			open--
+		default:
+			d := value.Interface().(amqp.Delivery)
+			heads[index] = &d
+		}
+	}
+}
+
+func hasHead(heads []*amqp.Delivery) bool {
+	for _, head := range heads {
+		if head != nil {
+			return true
+		}
+	}
+	return false
+}
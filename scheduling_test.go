@@ -0,0 +1,101 @@
+package ocrworker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func weightedTestConfig() SchedulingConfig {
+	return SchedulingConfig{
+		Mode:    SchedulingWeighted,
+		ClassBy: ClassByDocType,
+		Weights: map[string]uint{"egvp": 3, defaultClass: 1},
+	}
+}
+
+func TestSchedulingRoutingKey(t *testing.T) {
+	config := weightedTestConfig()
+	assert.True(t, config.validate() == nil)
+	assert.Equals(t, config.routingKey("decode-ocr", &OcrRequest{DocType: "egvp"}), "decode-ocr.egvp")
+	assert.Equals(t, config.routingKey("decode-ocr", &OcrRequest{DocType: "unknown"}), "decode-ocr.standard")
+	assert.DeepEquals(t, config.queueNames("decode-ocr"), []string{"decode-ocr.egvp", "decode-ocr.standard"})
+
+	config.ClassBy = ClassByTenant
+	assert.Equals(t, config.routingKey("decode-ocr", &OcrRequest{DocType: "egvp", Tenant: "acme"}), "decode-ocr.standard")
+
+	config = DefaultSchedulingConfig()
+	assert.Equals(t, config.routingKey("decode-ocr", &OcrRequest{DocType: "egvp"}), "decode-ocr")
+	assert.DeepEquals(t, config.queueNames("decode-ocr"), []string{"decode-ocr"})
+
+	config.Mode = "unknown"
+	assert.True(t, config.validate() != nil)
+}
+
+func TestWeightedDispatcherChoose(t *testing.T) {
+	config := weightedTestConfig()
+	dispatcher := newWeightedDispatcher(config.classes(), &config)
+	heads := []*amqp.Delivery{{}, {}}
+
+	counts := make([]int, 2)
+	for i := 0; i < 8; i++ {
+		chosen, promoted := dispatcher.choose(heads)
+		assert.False(t, promoted)
+		dispatcher.commit(heads, chosen)
+		counts[chosen]++
+	}
+	// egvp has weight 3, standard weight 1
+	assert.DeepEquals(t, counts, []int{6, 2})
+
+	// only classes with a waiting delivery are chosen
+	chosen, _ := dispatcher.choose([]*amqp.Delivery{nil, {}})
+	assert.Equals(t, chosen, 1)
+	chosen, _ = dispatcher.choose([]*amqp.Delivery{nil, nil})
+	assert.Equals(t, chosen, -1)
+}
+
+func TestWeightedDispatcherPromotion(t *testing.T) {
+	config := weightedTestConfig()
+	config.MaxWait = 60
+	dispatcher := newWeightedDispatcher(config.classes(), &config)
+	now := time.Now()
+	heads := []*amqp.Delivery{
+		{Headers: amqp.Table{publishedAtHeader: now.Add(-10 * time.Second).UnixMilli()}},
+		{Headers: amqp.Table{publishedAtHeader: now.Add(-2 * time.Minute).UnixMilli()}},
+	}
+	chosen, promoted := dispatcher.choose(heads)
+	assert.True(t, promoted)
+	assert.Equals(t, chosen, 1)
+}
+
+func TestWeightedDispatcherRun(t *testing.T) {
+	config := weightedTestConfig()
+	dispatcher := newWeightedDispatcher(config.classes(), &config)
+	egvp := make(chan amqp.Delivery, 2)
+	standard := make(chan amqp.Delivery, 2)
+	egvp <- amqp.Delivery{CorrelationId: "e1"}
+	standard <- amqp.Delivery{CorrelationId: "s1"}
+	standard <- amqp.Delivery{CorrelationId: "s2"}
+	close(egvp)
+	close(standard)
+
+	out := make(chan amqp.Delivery)
+	go dispatcher.run([]<-chan amqp.Delivery{egvp, standard}, out)
+	received := map[string]bool{}
+	for d := range out {
+		received[d.CorrelationId] = true
+	}
+	assert.Equals(t, len(received), 3)
+}
+
+func TestAdmissionStateOfQueues(t *testing.T) {
+	state := admissionStateOfQueues([]OcrQueueManager{
+		{NumMessages: 3, NumConsumers: 2},
+		{NumMessages: 4, NumConsumers: 1},
+	}, 2)
+	assert.Equals(t, state.NumMessages, uint(7))
+	assert.Equals(t, state.NumConsumers, uint(1))
+	assert.Equals(t, state.Capacity, uint(2))
+}
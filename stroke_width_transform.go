@@ -1,19 +1,19 @@
 package ocrworker
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 
 	"github.com/rs/zerolog/log"
 )
 
 type StrokeWidthTransformer struct{}
 
-func (s StrokeWidthTransformer) preprocess(ocrRequest *OcrRequest) error {
+func (s StrokeWidthTransformer) preprocess(ctx context.Context, ocrRequest *OcrRequest) error {
 	// write bytes to a temp file
 
-	tmpFileNameInput, err := createTempFileName("")
+	tmpFileNameInput, err := createTempFileName(ctx, "")
 	tmpFileNameInput = fmt.Sprintf("%s.png", tmpFileNameInput)
 	if err != nil {
 		return err
@@ -25,7 +25,7 @@ func (s StrokeWidthTransformer) preprocess(ocrRequest *OcrRequest) error {
 		}
 	}(tmpFileNameInput)
 
-	tmpFileNameOutput, err := createTempFileName("")
+	tmpFileNameOutput, err := createTempFileName(ctx, "")
 	tmpFileNameOutput = fmt.Sprintf("%s.png", tmpFileNameOutput)
 	if err != nil {
 		return err
@@ -48,12 +48,16 @@ func (s StrokeWidthTransformer) preprocess(ocrRequest *OcrRequest) error {
 		Str("tmpFileNameInput", tmpFileNameInput).Str("tmpFileNameOutput", tmpFileNameOutput).
 		Str("darkOnLightSetting", darkOnLightSetting).Msg("DetectText")
 
-	out, err := exec.Command(
+	out, err := combinedOutput(
+		ctx,
 		"DetectText",
 		tmpFileNameInput,
 		tmpFileNameOutput,
 		darkOnLightSetting,
-	).CombinedOutput()
+	)
+	if ctx.Err() != nil {
+		return fmt.Errorf("DetectText was terminated: %v", ctx.Err())
+	}
 	if err != nil {
 		log.Error().Err(err).Msg(string(out))
 	}
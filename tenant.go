@@ -0,0 +1,75 @@
+package ocrworker
+
+import (
+	"math"
+	"sync"
+)
+
+// defaultTenant is the metrics label of requests without tenant, e.g. if authentication is disabled
+const defaultTenant = "default"
+
+var (
+	// requestTenants maps the RequestID of a deferred request to the tenant which owns its result
+	requestTenants = sync.Map{}
+	// tenantLoad counts the requests in flight per tenant
+	tenantLoad = &clientTracker{
+		inFlight: make(map[string]uint),
+		owners:   make(map[string]string),
+		gauge:    tenantInFlightGauge,
+	}
+)
+
+func tenantLabel(tenant string) string {
+	if tenant == "" {
+		return defaultTenant
+	}
+	return tenant
+}
+
+// tenantFromPrincipal returns the tenant of the authenticated client, requests without authentication
+// belong to the default tenant. A client without tenant is a tenant of its own, so clients only share
+// their results if they are configured with the same tenant
+func tenantFromPrincipal(principal *Principal) string {
+	if principal == nil {
+		return ""
+	}
+	if principal.Tenant == "" {
+		return principal.ClientID
+	}
+	return principal.Tenant
+}
+
+// canReadResult reports whether principal may read the result of requestID. Unknown requests are
+// reported as readable, so the caller answers with "not found" in both cases
+func canReadResult(principal *Principal, requestID string) bool {
+	owner, ok := requestTenants.Load(requestID)
+	if !ok || (principal != nil && principal.HasScope(ScopeAdmin)) {
+		return true
+	}
+	return owner.(string) == tenantFromPrincipal(principal)
+}
+
+// fairPriority lowers the priority of a request by one for every multiple of its fair share a tenant
+// has in flight, so a batch of one tenant doesn't starve the requests of other tenants
+func fairPriority(tenant string, priority uint8) uint8 {
+	active := tenantLoad.active()
+	if active <= 1 {
+		return priority
+	}
+	admissionStateMu.RLock()
+	capacity := admissionState.Capacity
+	admissionStateMu.RUnlock()
+	share := uint(math.Ceil(float64(capacity) / float64(active)))
+	if share == 0 {
+		share = 1
+	}
+	load := tenantLoad.count(tenant)
+	if load <= share {
+		return priority
+	}
+	penalty := load / share
+	if penalty >= uint(priority) {
+		return 0
+	}
+	return priority - uint8(penalty)
+}
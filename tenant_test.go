@@ -0,0 +1,149 @@
+package ocrworker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestCanReadResult(t *testing.T) {
+	requestTenants.Store("req1", "acme")
+	defer requestTenants.Delete("req1")
+
+	assert.True(t, canReadResult(&Principal{Tenant: "acme"}, "req1"))
+	assert.False(t, canReadResult(&Principal{Tenant: "other"}, "req1"))
+	assert.False(t, canReadResult(nil, "req1"))
+	assert.True(t, canReadResult(&Principal{Tenant: "other", Scopes: []string{ScopeAdmin}}, "req1"))
+	// unknown requests are answered with "not found" by the caller
+	assert.True(t, canReadResult(&Principal{Tenant: "other"}, "req2"))
+}
+
+func TestTenantlessClientsAreIsolated(t *testing.T) {
+	apiKeyStore, err := NewAPIKeyStore([]APIKey{
+		{Key: "key1", ClientID: "client1"},
+		{Key: "key2", ClientID: "client2"},
+		{Key: "key3", ClientID: "client3", Tenant: "acme"},
+		{Key: "key4", ClientID: "client4", Tenant: "acme"},
+	})
+	assert.True(t, err == nil)
+	var principal *Principal
+	handler := NewAPIKeyAuth(apiKeyStore).Wrap(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		principal = principalFromContext(req.Context())
+	}))
+	principalOf := func(key string) *Principal {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(APIKeyHeader, key)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return principal
+	}
+
+	requestTenants.Store("req1", tenantFromPrincipal(principalOf("key1")))
+	requestTenants.Store("req3", tenantFromPrincipal(principalOf("key3")))
+	defer requestTenants.Delete("req1")
+	defer requestTenants.Delete("req3")
+	assert.Equals(t, tenantFromPrincipal(principalOf("key1")), "client1")
+	assert.True(t, canReadResult(principalOf("key1"), "req1"))
+	// keys without tenant don't share their results
+	assert.False(t, canReadResult(principalOf("key2"), "req1"))
+	assert.False(t, deliveryVisible(principalOf("key2"), "client1"))
+	// keys of the same tenant do
+	assert.True(t, canReadResult(principalOf("key4"), "req3"))
+	assert.False(t, canReadResult(principalOf("key1"), "req3"))
+}
+
+// acceptRequests lets the http handlers accept requests as if the broker had capacity, the returned function
+// restores the previous state
+func acceptRequests(capacity uint) func() {
+	ServiceCanAcceptMu.Lock()
+	ServiceCanAccept = true
+	ServiceCanAcceptMu.Unlock()
+	admissionStateMu.Lock()
+	previous := admissionState
+	admissionState.Capacity = capacity
+	admissionStateMu.Unlock()
+	return func() {
+		ServiceCanAcceptMu.Lock()
+		ServiceCanAccept = false
+		ServiceCanAcceptMu.Unlock()
+		admissionStateMu.Lock()
+		admissionState = previous
+		admissionStateMu.Unlock()
+	}
+}
+
+// cacheTestResult answers requests of tenant for image with text from the result cache, so they are handled
+// without a broker
+func cacheTestResult(image []byte, tenant, text string) {
+	key := (&OcrRequest{ImgBytes: image, Tenant: tenant}).cacheKey()
+	resultCache.expect("cached", key, time.Now().Add(time.Hour))
+	resultCache.store(&OcrResult{ID: "cached", Status: "done", Text: text}, ResultCacheConfig{TTL: 60, MaxEntries: 10})
+}
+
+func TestClientCannotChooseRequestID(t *testing.T) {
+	defer acceptRequests(100)()
+	cacheTestResult(pngHeader, "other", "cached text")
+	config := DefaultTestConfig()
+	config.ResultCache.TTL = 60
+	apiKeyStore, err := NewAPIKeyStore([]APIKey{
+		{Key: "key1", ClientID: "client1", Tenant: "acme"},
+		{Key: "key2", ClientID: "client2", Tenant: "other"},
+	})
+	assert.True(t, err == nil)
+	handler := NewAPIKeyAuth(apiKeyStore).Wrap(NewOcrHttpHandler(&config))
+
+	// the pending job of acme
+	requestTenants.Store("victim", "acme")
+	defer requestTenants.Delete("victim")
+
+	body := `{"img_base64":"` + base64.StdEncoding.EncodeToString(pngHeader) + `","req_id":"victim","deferred":true}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/ocr", strings.NewReader(body))
+	req.Header.Set(APIKeyHeader, "key2")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equals(t, recorder.Code, http.StatusAccepted)
+	var ocrResult OcrResult
+	assert.True(t, json.Unmarshal(recorder.Body.Bytes(), &ocrResult) == nil)
+	defer deleteRequestFromQueue(ocrResult.ID)
+
+	// the job of the other tenant got an id of its own, the job of acme is untouched
+	assert.True(t, ocrResult.ID != "victim")
+	assert.True(t, canReadResult(&Principal{Tenant: "other"}, ocrResult.ID))
+	assert.True(t, canReadResult(&Principal{Tenant: "acme"}, "victim"))
+	assert.False(t, canReadResult(&Principal{Tenant: "other"}, "victim"))
+}
+
+func TestFairPriority(t *testing.T) {
+	admissionStateMu.Lock()
+	admissionState = AdmissionState{Capacity: 4}
+	admissionStateMu.Unlock()
+	defer func() {
+		admissionStateMu.Lock()
+		admissionState = AdmissionState{}
+		admissionStateMu.Unlock()
+	}()
+
+	requestIDs := []string{"a1", "a2", "a3", "a4", "a5", "a6"}
+	for _, requestID := range requestIDs {
+		tenantLoad.acquire("acme", requestID, math.MaxUint)
+	}
+	defer func() {
+		for _, requestID := range append(requestIDs, "b1") {
+			tenantLoad.release(requestID)
+		}
+	}()
+	// a single tenant may use all capacity
+	assert.Equals(t, fairPriority("acme", 5), uint8(5))
+
+	tenantLoad.acquire("other", "b1", math.MaxUint)
+	// fair share is 2, acme has 6 requests in flight
+	assert.Equals(t, fairPriority("acme", 5), uint8(2))
+	assert.Equals(t, fairPriority("acme", 1), uint8(0))
+	assert.Equals(t, fairPriority("other", 5), uint8(5))
+}
@@ -1,10 +1,10 @@
 package ocrworker
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"os"
-	"os/exec"
 
 	"github.com/rs/zerolog/log"
 )
@@ -93,15 +93,15 @@ func (t TesseractEngineArgs) Export() []string {
 }
 
 // ProcessRequest will process incoming OCR request by routing it through the whole process chain
-func (t TesseractEngine) ProcessRequest(ocrRequest *OcrRequest, _ *WorkerConfig) (OcrResult, error) {
+func (t TesseractEngine) ProcessRequest(ctx context.Context, ocrRequest *OcrRequest, workerConfig *WorkerConfig) (OcrResult, error) {
 	tmpFileName, err := func() (string, error) {
 		switch {
 		case ocrRequest.ImgBase64 != "":
-			return t.tmpFileFromImageBase64(ocrRequest.ImgBase64)
+			return t.tmpFileFromImageBase64(ctx, ocrRequest.ImgBase64)
 		case ocrRequest.ImgUrl != "":
-			return t.tmpFileFromImageUrl(ocrRequest.ImgUrl)
+			return t.tmpFileFromImageUrl(ctx, ocrRequest.ImgUrl, ocrRequest.imgURLFetchConfig(&workerConfig.ImgURLFetch))
 		default:
-			return t.tmpFileFromImageBytes(ocrRequest.ImgBytes)
+			return t.tmpFileFromImageBytes(ctx, ocrRequest.ImgBytes)
 		}
 	}()
 	if err != nil {
@@ -124,15 +124,15 @@ func (t TesseractEngine) ProcessRequest(ocrRequest *OcrRequest, _ *WorkerConfig)
 		}(tmpFileName)
 	}
 
-	ocrResult, err := t.processImageFile(tmpFileName, *engineArgs)
+	ocrResult, err := t.processImageFile(ctx, tmpFileName, *engineArgs)
 
 	return ocrResult, err
 }
 
-func (TesseractEngine) tmpFileFromImageBytes(imgBytes []byte) (string, error) {
+func (TesseractEngine) tmpFileFromImageBytes(ctx context.Context, imgBytes []byte) (string, error) {
 	log.Info().Str("component", "OCR_TESSERACT").Msg("Use tesseract with bytes image")
 
-	tmpFileName, err := createTempFileName("")
+	tmpFileName, err := createTempFileName(ctx, "")
 	if err != nil {
 		return "", err
 	}
@@ -147,10 +147,10 @@ func (TesseractEngine) tmpFileFromImageBytes(imgBytes []byte) (string, error) {
 	return tmpFileName, nil
 }
 
-func (TesseractEngine) tmpFileFromImageBase64(base64Image string) (string, error) {
+func (TesseractEngine) tmpFileFromImageBase64(ctx context.Context, base64Image string) (string, error) {
 	log.Info().Str("component", "OCR_TESSERACT").Msg("Use tesseract with base 64")
 
-	tmpFileName, err := createTempFileName("")
+	tmpFileName, err := createTempFileName(ctx, "")
 	if err != nil {
 		return "", err
 	}
@@ -170,16 +170,16 @@ func (TesseractEngine) tmpFileFromImageBase64(base64Image string) (string, error
 	return tmpFileName, nil
 }
 
-func (TesseractEngine) tmpFileFromImageUrl(imgUrl string) (string, error) {
+func (TesseractEngine) tmpFileFromImageUrl(ctx context.Context, imgUrl string, fetchConfig *ImgURLFetchConfig) (string, error) {
 	log.Info().Str("component", "OCR_TESSERACT").Msg("Use tesseract with url")
 
-	tmpFileName, err := createTempFileName("")
+	tmpFileName, err := createTempFileName(ctx, "")
 	if err != nil {
 		return "", err
 	}
 	// we have to write the contents of the image url to a temp
 	// file, because the leptonica lib can't seem to handle byte arrays
-	err = saveUrlContentToFileName(imgUrl, tmpFileName)
+	err = fetchConfig.fetchToFile(ctx, imgUrl, tmpFileName)
 	if err != nil {
 		return "", err
 	}
@@ -187,7 +187,7 @@ func (TesseractEngine) tmpFileFromImageUrl(imgUrl string) (string, error) {
 	return tmpFileName, nil
 }
 
-func (TesseractEngine) processImageFile(inputFilename string, engineArgs TesseractEngineArgs) (OcrResult, error) {
+func (TesseractEngine) processImageFile(ctx context.Context, inputFilename string, engineArgs TesseractEngineArgs) (OcrResult, error) {
 	// if the input filename is /tmp/ocrimage, set the output file basename
 	// to /tmp/ocrimage as well, which will produce /tmp/ocrimage.txt output
 	tmpOutFileBaseName := inputFilename
@@ -201,9 +201,13 @@ func (TesseractEngine) processImageFile(inputFilename string, engineArgs Tessera
 	cmdArgs = append(cmdArgs, cflags...)
 	log.Info().Str("component", "OCR_TESSERACT").Interface("cmdArgs", cmdArgs)
 
-	// exec tesseract
-	cmd := exec.Command("tesseract", cmdArgs...)
-	output, err := cmd.CombinedOutput()
+	// exec tesseract, the process will be killed if the job deadline is reached
+	output, err := combinedOutput(ctx, "tesseract", cmdArgs...)
+	if ctx.Err() != nil {
+		err = fmt.Errorf("tesseract was terminated: %v", ctx.Err())
+		log.Error().Err(err).Str("component", "OCR_TESSERACT").Msg("job deadline reached")
+		return OcrResult{Status: "error"}, err
+	}
 	if err != nil {
 		log.Error().Err(err).Str("component", "OCR_TESSERACT").Str("component", "OCR_TESSERACT").
 			Msg(string(output))
@@ -1,6 +1,7 @@
 package ocrworker
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"testing"
@@ -29,7 +30,7 @@ func TestTesseractEngineWithRequest(t *testing.T) {
 	}
 	workerConfig := workerConfigForTests()
 	assert.True(t, err == nil)
-	result, err := engine.ProcessRequest(&ocrRequest, &workerConfig)
+	result, err := engine.ProcessRequest(context.Background(), &ocrRequest, &workerConfig)
 	assert.True(t, err == nil)
 	log.Info().Str("component", "TEST").Interface("result", result)
 }
@@ -56,7 +57,7 @@ func TestTesseractEngineWithJson(t *testing.T) {
 		ocrRequest.ImgBytes = bytes
 		workerConfig := workerConfigForTests()
 		engine := NewOcrEngine(ocrRequest.EngineType)
-		result, err := engine.ProcessRequest(&ocrRequest, &workerConfig)
+		result, err := engine.ProcessRequest(context.Background(), &ocrRequest, &workerConfig)
 		log.Error().Err(err).Str("component", "TEST")
 
 		assert.True(t, err == nil)
@@ -84,7 +85,7 @@ func TestTesseractEngineWithFile(t *testing.T) {
 
 	engine := TesseractEngine{}
 	engineArgs := TesseractEngineArgs{}
-	result, err := engine.processImageFile("docs/testimage.png", engineArgs)
+	result, err := engine.processImageFile(context.Background(), "docs/testimage.png", engineArgs)
 	assert.True(t, err == nil)
 	log.Info().Str("component", "TEST").Interface("result", result)
 }
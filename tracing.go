@@ -0,0 +1,363 @@
+package ocrworker
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracing exporters, selectable by the tracing_exporter flag
+const (
+	// TracingOff doesn't record spans, the trace context of the clients is passed on nevertheless
+	TracingOff = ""
+	// TracingOTLP sends spans to an OpenTelemetry collector over OTLP/HTTP
+	TracingOTLP = "otlp"
+	// TracingStdout writes spans as json to stdout
+	TracingStdout = "stdout"
+)
+
+const (
+	tracerName = "github.com/xf0e/open-ocr"
+	// tracingShutdownTimeout is the time the spans left in the exporter get to be sent on exit
+	tracingShutdownTimeout = 5 * time.Second
+	// requestIDAttribute correlates the spans of a job with the RequestID of the log
+	requestIDAttribute    = attribute.Key("ocr.request_id")
+	rejectReasonAttribute = attribute.Key("ocr.reject_reason")
+)
+
+// tracer creates the spans of all components. Until StartTracing installs a provider it only passes on the
+// trace context of the parent
+var tracer = otel.Tracer(tracerName)
+
+var (
+	tracerProvider   *sdktrace.TracerProvider
+	tracerProviderMu sync.Mutex
+)
+
+// TracingConfig selects where the spans of a process are exported to, tracing is off by default
+type TracingConfig struct {
+	Exporter string
+	// Endpoint is the url of the OTLP/HTTP collector e.g. http://localhost:4318, empty uses the
+	// OTEL_EXPORTER_OTLP_* environment variables
+	Endpoint string
+	// SampleRatio is the share of the traces started by this process which are recorded, a trace continued
+	// from a client or another component is recorded if its parent was
+	SampleRatio float64
+}
+
+// DefaultTracingConfig records all traces once an exporter is set
+func DefaultTracingConfig() TracingConfig {
+	return TracingConfig{Exporter: TracingOff, SampleRatio: 1}
+}
+
+func (c *TracingConfig) validate() error {
+	switch c.Exporter {
+	case TracingOff, TracingOTLP, TracingStdout:
+	default:
+		return fmt.Errorf("unknown tracing exporter %q, use %s or %s", c.Exporter, TracingOTLP, TracingStdout)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("tracing_sample_ratio has to be between 0 and 1")
+	}
+	return nil
+}
+
+// addTracingFlags registers the tracing flags. The returned function builds the config
+// and has to be called after flagSet was parsed
+func addTracingFlags(flagSet *flag.FlagSet) func() (TracingConfig, error) {
+	defaults := DefaultTracingConfig()
+	var (
+		exporter    string
+		endpoint    string
+		sampleRatio float64
+	)
+	flagSet.StringVar(
+		&exporter,
+		"tracing_exporter",
+		defaults.Exporter,
+		"Exporter of the OpenTelemetry spans: "+TracingOTLP+" (OTLP/HTTP, see tracing_endpoint) or "+TracingStdout+
+			". Empty disables tracing, the trace context is passed on nevertheless",
+	)
+	flagSet.StringVar(
+		&endpoint,
+		"tracing_endpoint",
+		defaults.Endpoint,
+		"URL of the OTLP/HTTP collector e.g. http://localhost:4318, empty uses the OTEL_EXPORTER_OTLP_* environment variables",
+	)
+	flagSet.Float64Var(
+		&sampleRatio,
+		"tracing_sample_ratio",
+		defaults.SampleRatio,
+		"Share of the traces started by this process which are recorded, between 0 and 1."+
+			" Traces continued from a client or another component follow the decision of their parent",
+	)
+	return func() (TracingConfig, error) {
+		tracingConfig := TracingConfig{Exporter: exporter, Endpoint: endpoint, SampleRatio: sampleRatio}
+		return tracingConfig, tracingConfig.validate()
+	}
+}
+
+// StartTracing installs the exporter of config for the process serviceName, StopTracing has to be called
+// before the process exits
+func StartTracing(config TracingConfig, serviceName string) error {
+	// the trace context travels in the http and amqp headers even if this process doesn't record spans
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if config.Exporter == TracingOff {
+		return nil
+	}
+	ctx := context.Background()
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch config.Exporter {
+	case TracingOTLP:
+		var options []otlptracehttp.Option
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(config.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	case TracingStdout:
+		exporter, err = stdouttrace.New()
+	default:
+		err = fmt.Errorf("unknown tracing exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	tracerProviderMu.Lock()
+	tracerProvider = provider
+	tracerProviderMu.Unlock()
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warn().Err(err).Str("component", "OCR_TRACING").Msg("spans could not be exported")
+	}))
+	log.Info().Str("component", "OCR_TRACING").Str("exporter", config.Exporter).Str("service", serviceName).
+		Float64("sample_ratio", config.SampleRatio).Msg("tracing is enabled")
+	return nil
+}
+
+// StopTracing sends the spans left in the exporter of StartTracing, it does nothing if tracing is off
+func StopTracing() {
+	tracerProviderMu.Lock()
+	defer tracerProviderMu.Unlock()
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Str("component", "OCR_TRACING").Msg("tracing shutdown failed, spans may be lost")
+	}
+	tracerProvider = nil
+}
+
+// endSpan marks the span as failed if err is not nil and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endAdmissionSpan records the decision of an admission check and ends its span
+func endAdmissionSpan(span trace.Span, admitted bool) {
+	span.SetAttributes(attribute.Bool("ocr.admitted", admitted))
+	span.End()
+}
+
+// contextWithTraceParent returns a context which is not canceled with the trace of parent, e.g. for work
+// which continues after the http request was answered
+func contextWithTraceParent(parent trace.SpanContext) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), parent)
+}
+
+// amqpHeaders carries the trace context in the headers of a message
+type amqpHeaders amqp.Table
+
+func (h amqpHeaders) Get(key string) string {
+	value, _ := h[key].(string)
+	return value
+}
+
+func (h amqpHeaders) Set(key, value string) {
+	h[key] = value
+}
+
+func (h amqpHeaders) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// traceHeaders returns a copy of headers with the trace context of ctx added
+func traceHeaders(ctx context.Context, headers amqp.Table) amqp.Table {
+	traced := make(amqp.Table, len(headers)+2)
+	for key, value := range headers {
+		traced[key] = value
+	}
+	otel.GetTextMapPropagator().Inject(ctx, amqpHeaders(traced))
+	return traced
+}
+
+// contextFromHeaders continues the trace of a message below ctx
+func contextFromHeaders(ctx context.Context, headers amqp.Table) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, amqpHeaders(headers))
+}
+
+// startConsumerSpan starts the span of a preprocessor or worker processing the delivery, it continues the trace
+// of the request below ctx
+func startConsumerSpan(ctx context.Context, name string, d *amqp.Delivery) (context.Context, trace.Span) {
+	return tracer.Start(contextFromHeaders(ctx, d.Headers), name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingDestinationName(d.Exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(d.RoutingKey),
+			requestIDAttribute.String(d.CorrelationId),
+		))
+}
+
+// startPublishSpan starts the span of publishing the request to routingKey
+func startPublishSpan(ctx context.Context, exchange, routingKey, requestID string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "publish "+routingKey,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingDestinationName(exchange),
+			semconv.MessagingRabbitmqDestinationRoutingKey(routingKey),
+			requestIDAttribute.String(requestID),
+		))
+}
+
+// traceCarrier returns the trace context of ctx in a form which can be persisted, nil if there is none
+func traceCarrier(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// contextFromCarrier continues the trace persisted by traceCarrier
+func contextFromCarrier(ctx context.Context, carrier map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// combinedOutput runs an external command like exec.CommandContext(ctx, name, args...).CombinedOutput()
+// in a span of its own
+func combinedOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "exec "+name, trace.WithAttributes(semconv.ProcessExecutableName(name)))
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		span.SetAttributes(semconv.ProcessExitCode(exitErr.ExitCode()))
+	}
+	endSpan(span, err)
+	return output, err
+}
+
+// WithTracing starts a server span for every http request, continuing the trace of the client if it sent a
+// traceparent header. The span is named after the route of the request
+func WithTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, req.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(req.Method),
+				semconv.URLPath(req.URL.Path),
+				attribute.String("http.request_id", requestIDFromContext(req.Context())),
+			))
+		defer span.End()
+		recorder := &statusRecorder{ResponseWriter: w}
+		traced := req.WithContext(ctx)
+		next.ServeHTTP(recorder, traced)
+		// the routes of the api are named by APIRouter, the mux only knows its prefix
+		if traced.Pattern != "" && traced.Pattern != APIPrefix+"/" {
+			setHTTPRoute(ctx, req.Method, traced.Pattern)
+		}
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// setHTTPRoute names the server span of the request after the pattern of its route, e.g. "POST /v1/ocr"
+func setHTTPRoute(ctx context.Context, method, pattern string) {
+	route := pattern
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		route = path
+	}
+	span := trace.SpanFromContext(ctx)
+	span.SetName(method + " " + route)
+	span.SetAttributes(semconv.HTTPRoute(route))
+}
+
+// statusRecorder keeps the status of the response, Unwrap lets http.ResponseController reach the
+// flusher of the server
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
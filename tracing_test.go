@@ -0,0 +1,170 @@
+package ocrworker
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	testSpans     *tracetest.InMemoryExporter
+	testSpansOnce sync.Once
+)
+
+// recordSpans installs a provider keeping the spans in memory. The provider can only be set once per process,
+// so the spans of earlier tests are dropped instead
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	testSpansOnce.Do(func() {
+		testSpans = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(testSpans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	testSpans.Reset()
+	t.Cleanup(testSpans.Reset)
+	return testSpans
+}
+
+func findSpan(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, span := range spans {
+		if span.Name == name {
+			return span, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingFlags(t *testing.T) {
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	tracingConfig := addTracingFlags(flagSet)
+	assert.True(t, flagSet.Parse(nil) == nil)
+	config, err := tracingConfig()
+	assert.True(t, err == nil)
+	// tracing is off by default
+	assert.Equals(t, config, DefaultTracingConfig())
+	assert.Equals(t, config.Exporter, TracingOff)
+
+	for _, args := range [][]string{
+		{"-tracing_exporter", "jaeger"},
+		{"-tracing_exporter", TracingOTLP, "-tracing_sample_ratio", "1.5"},
+	} {
+		flagSet = flag.NewFlagSet("test", flag.ContinueOnError)
+		tracingConfig = addTracingFlags(flagSet)
+		assert.True(t, flagSet.Parse(args) == nil)
+		_, err = tracingConfig()
+		assert.True(t, err != nil)
+	}
+}
+
+func TestAMQPTraceHeaders(t *testing.T) {
+	spans := recordSpans(t)
+	ctx, span := startPublishSpan(context.Background(), "open-ocr-exchange", "decode-ocr", "4711")
+	headers := amqp.Table{publishedAtHeader: int64(1)}
+	traced := traceHeaders(ctx, headers)
+	span.End()
+	// the headers of the delivery are kept
+	assert.Equals(t, len(headers), 1)
+	assert.Equals(t, traced[publishedAtHeader], int64(1))
+	assert.True(t, traced["traceparent"] != nil)
+
+	d := &amqp.Delivery{Headers: traced, Exchange: "open-ocr-exchange", RoutingKey: "decode-ocr", CorrelationId: "4711"}
+	_, consumerSpan := startConsumerSpan(context.Background(), "ocr decode-ocr", d)
+	consumerSpan.End()
+	assert.Equals(t, len(spans.GetSpans()), 2)
+	consumer, ok := findSpan(spans.GetSpans(), "ocr decode-ocr")
+	assert.True(t, ok)
+	assert.Equals(t, consumer.Parent.SpanID(), span.SpanContext().SpanID())
+	assert.Equals(t, consumer.SpanContext.TraceID(), span.SpanContext().TraceID())
+	assert.Equals(t, spanAttribute(consumer, requestIDAttribute).AsString(), "4711")
+
+	// a message without trace context starts a new trace
+	_, orphan := startConsumerSpan(context.Background(), "orphan", &amqp.Delivery{})
+	orphan.End()
+	assert.True(t, orphan.SpanContext().TraceID() != span.SpanContext().TraceID())
+}
+
+func TestWithTracing(t *testing.T) {
+	spans := recordSpans(t)
+	config := DefaultTestConfig()
+	batchHandler := NewOcrHttpBatchHandler(&config)
+	mux := http.NewServeMux()
+	api := NewAPIRouter(mux)
+	api.Handle("GET /batches/{id}/results", http.HandlerFunc(batchHandler.Results))
+	api.Handle("POST /ocr", http.HandlerFunc(HealthzHandler), "/ocr")
+	mux.HandleFunc("GET /healthz", HealthzHandler)
+	handler := WithRequestID(WithTracing(mux))
+
+	request := httptest.NewRequest(http.MethodGet, "/v1/batches/a/results?format=pdf", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/ocr", nil))
+
+	recorded := spans.GetSpans()
+	assert.Equals(t, len(recorded), 3)
+	span, ok := findSpan(recorded, "GET /v1/batches/{id}/results")
+	assert.True(t, ok)
+	// the trace of the client is continued
+	assert.Equals(t, span.SpanContext.TraceID().String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Equals(t, span.Parent.SpanID().String(), "00f067aa0ba902b7")
+	assert.Equals(t, spanAttribute(span, "http.response.status_code").AsInt64(), int64(http.StatusBadRequest))
+	assert.Equals(t, span.Status.Code, codes.Unset)
+	_, ok = findSpan(recorded, "GET /healthz")
+	assert.True(t, ok)
+	// a deprecated alias is named by its own pattern
+	_, ok = findSpan(recorded, "POST /ocr")
+	assert.True(t, ok)
+}
+
+func TestCombinedOutputSpan(t *testing.T) {
+	spans := recordSpans(t)
+	_, err := combinedOutput(context.Background(), "sh", "-c", "exit 3")
+	assert.True(t, err != nil)
+	span, ok := findSpan(spans.GetSpans(), "exec sh")
+	assert.True(t, ok)
+	assert.Equals(t, span.Status.Code, codes.Error)
+	assert.Equals(t, spanAttribute(span, "process.exit.code").AsInt64(), int64(3))
+}
+
+func TestOutboxTraceContext(t *testing.T) {
+	spans := recordSpans(t)
+	outbox := newTestOutbox(t, t.TempDir())
+	outbox.post = func(*outboxEntry, string, uint) (int, error) {
+		return 200, nil
+	}
+	ctx, requestSpan := tracer.Start(context.Background(), "POST /v1/ocr")
+	requestSpan.End()
+	outbox.Enqueue(ctx, OcrResult{ID: "1", Status: "done"}, "http://localhost/postback", "", "")
+	for delivery, _ := outbox.Get("1"); delivery.State == DeliveryPending; delivery, _ = outbox.Get("1") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the trace context is persisted with the delivery, so it survives a restart
+	reloaded := newTestOutbox(t, outbox.config.Dir)
+	assert.True(t, reloaded.entries["1"].TraceContext["traceparent"] != "")
+	postback, ok := findSpan(spans.GetSpans(), "postback")
+	assert.True(t, ok)
+	assert.Equals(t, postback.SpanContext.TraceID(), requestSpan.SpanContext().TraceID())
+	assert.Equals(t, spanAttribute(postback, "http.response.status_code").AsInt64(), int64(200))
+}
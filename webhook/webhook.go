@@ -0,0 +1,103 @@
+// Package webhook signs the results open-ocr posts to reply_to addresses and lets receivers verify them.
+//
+// The signature is an HMAC-SHA256 over the timestamp, a dot and the request body, keyed with the secret
+// shared between open-ocr and the receiver:
+//
+//	X-Open-Ocr-Timestamp: 1700000000
+//	X-Open-Ocr-Signature: sha256=<hex encoded HMAC>
+//
+// Receivers should use Verify or VerifyRequest, which also reject old timestamps to prevent replays.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader holds one or more comma separated signatures, more than one during a secret rotation
+	SignatureHeader = "X-Open-Ocr-Signature"
+	// TimestampHeader holds the time of signing in unix seconds
+	TimestampHeader = "X-Open-Ocr-Timestamp"
+	// DefaultTolerance is the maximal age of a signature accepted by VerifyRequest
+	DefaultTolerance = 5 * time.Minute
+
+	signaturePrefix = "sha256="
+)
+
+var (
+	ErrMissingSignature = errors.New("webhook: signature or timestamp header is missing")
+	ErrInvalidTimestamp = errors.New("webhook: timestamp is invalid or outside of the tolerance")
+	ErrInvalidSignature = errors.New("webhook: signature does not match")
+)
+
+// Sign returns the signature of body for the value of SignatureHeader
+func Sign(secret []byte, timestamp time.Time, body []byte) string {
+	return signaturePrefix + hex.EncodeToString(mac(secret, strconv.FormatInt(timestamp.Unix(), 10), body))
+}
+
+// SetHeaders signs body and sets the signature and timestamp headers
+func SetHeaders(header http.Header, secret []byte, timestamp time.Time, body []byte) {
+	header.Set(TimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+	header.Set(SignatureHeader, Sign(secret, timestamp, body))
+}
+
+// Verify checks the signature headers of a postback against body. Signatures older or newer than
+// tolerance are rejected, a tolerance of 0 disables the check
+func Verify(secret []byte, header http.Header, body []byte, tolerance time.Duration) error {
+	timestamp := header.Get(TimestampHeader)
+	signatures := header.Get(SignatureHeader)
+	if timestamp == "" || signatures == "" {
+		return ErrMissingSignature
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	if tolerance > 0 {
+		age := time.Since(time.Unix(unix, 0))
+		if age > tolerance || age < -tolerance {
+			return ErrInvalidTimestamp
+		}
+	}
+	expected := mac(secret, timestamp, body)
+	for _, signature := range strings.Split(signatures, ",") {
+		signature = strings.TrimSpace(signature)
+		if !strings.HasPrefix(signature, signaturePrefix) {
+			continue
+		}
+		decoded, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+		if err == nil && hmac.Equal(decoded, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// VerifyRequest reads the body of a postback and verifies it with DefaultTolerance.
+// The body is returned and can be read again from req.Body
+func VerifyRequest(secret []byte, req *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, Verify(secret, req.Header, body, DefaultTolerance)
+}
+
+func mac(secret []byte, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
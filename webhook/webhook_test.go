@@ -0,0 +1,53 @@
+package webhook
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"text":"hello","status":"done","id":"1"}`)
+	header := http.Header{}
+	SetHeaders(header, secret, time.Now(), body)
+
+	assert.True(t, Verify(secret, header, body, DefaultTolerance) == nil)
+	assert.Equals(t, Verify([]byte("other"), header, body, DefaultTolerance), ErrInvalidSignature)
+	assert.Equals(t, Verify(secret, header, []byte(`{"text":"changed"}`), DefaultTolerance), ErrInvalidSignature)
+	assert.Equals(t, Verify(secret, http.Header{}, body, DefaultTolerance), ErrMissingSignature)
+
+	// one of the signatures has to match during a secret rotation
+	header.Set(SignatureHeader, Sign([]byte("old"), time.Now(), body)+", "+header.Get(SignatureHeader))
+	assert.True(t, Verify(secret, header, body, DefaultTolerance) == nil)
+}
+
+func TestVerifyRejectsOldTimestamp(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte("{}")
+	header := http.Header{}
+	SetHeaders(header, secret, time.Now().Add(-time.Hour), body)
+
+	assert.Equals(t, Verify(secret, header, body, DefaultTolerance), ErrInvalidTimestamp)
+	assert.True(t, Verify(secret, header, body, 0) == nil)
+}
+
+func TestVerifyRequest(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"id":"1"}`)
+	req := httptest.NewRequest("POST", "/postback", bytes.NewReader(body))
+	SetHeaders(req.Header, secret, time.Now(), body)
+
+	read, err := VerifyRequest(secret, req)
+	assert.True(t, err == nil)
+	assert.True(t, bytes.Equal(read, body))
+
+	var again bytes.Buffer
+	_, err = again.ReadFrom(req.Body)
+	assert.True(t, err == nil)
+	assert.True(t, bytes.Equal(again.Bytes(), body))
+}